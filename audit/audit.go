@@ -0,0 +1,130 @@
+// Package audit records console actions to the append-only audit log and
+// optionally forwards each entry to syslog or a webhook.
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"copilot-go/store"
+)
+
+const forwardBuffer = 256
+
+// Config selects where entries are forwarded besides the local audit log.
+type Config struct {
+	// Syslog is "local" for the local syslog daemon or a udp://, tcp:// or
+	// unix:// address. Not supported on Windows.
+	Syslog string
+	// Webhook receives each entry as a JSON POST.
+	Webhook string
+	// WebhookSecret, if set, signs webhook bodies with HMAC-SHA256 in the
+	// X-Audit-Signature header.
+	WebhookSecret string
+}
+
+// ConfigFromEnv reads AUDIT_SYSLOG, AUDIT_WEBHOOK_URL and AUDIT_WEBHOOK_SECRET.
+func ConfigFromEnv() Config {
+	return Config{
+		Syslog:        os.Getenv("AUDIT_SYSLOG"),
+		Webhook:       os.Getenv("AUDIT_WEBHOOK_URL"),
+		WebhookSecret: os.Getenv("AUDIT_WEBHOOK_SECRET"),
+	}
+}
+
+// sink delivers entries to one external destination.
+type sink interface {
+	name() string
+	send(e store.AuditEntry) error
+}
+
+var (
+	sinksMu    sync.RWMutex
+	sinks      []chan store.AuditEntry
+	forwarding sync.WaitGroup
+)
+
+// Init starts forwarding to the destinations in cfg.
+func Init(cfg Config) error {
+	var started []sink
+	if cfg.Syslog != "" {
+		s, err := newSyslogSink(cfg.Syslog)
+		if err != nil {
+			return err
+		}
+		started = append(started, s)
+	}
+	if cfg.Webhook != "" {
+		s, err := newWebhookSink(cfg.Webhook, cfg.WebhookSecret)
+		if err != nil {
+			return err
+		}
+		started = append(started, s)
+	}
+
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range started {
+		ch := make(chan store.AuditEntry, forwardBuffer)
+		sinks = append(sinks, ch)
+		forwarding.Add(1)
+		go forward(s, ch)
+		slog.Info("forwarding audit log", "to", s.name())
+	}
+	return nil
+}
+
+func forward(s sink, ch <-chan store.AuditEntry) {
+	defer forwarding.Done()
+	for e := range ch {
+		if err := s.send(e); err != nil {
+			slog.Error("failed to forward audit entry", "to", s.name(), "seq", e.Seq, "err", err)
+		}
+	}
+}
+
+// Close stops forwarding and waits until the queued entries are delivered or
+// ctx ends. Entries recorded afterwards are only written to the local log.
+func Close(ctx context.Context) {
+	sinksMu.Lock()
+	for _, ch := range sinks {
+		close(ch)
+	}
+	sinks = nil
+	sinksMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		forwarding.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("gave up forwarding queued audit entries", "err", ctx.Err())
+	}
+}
+
+// Record stamps e, appends it to the audit log and queues it for forwarding.
+func Record(e store.AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if err := store.AppendAudit(&e); err != nil {
+		return err
+	}
+
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	for _, ch := range sinks {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("audit forward buffer full, dropping entry", "seq", e.Seq)
+		}
+	}
+	return nil
+}
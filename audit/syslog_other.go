@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package audit
+
+import "errors"
+
+func newSyslogSink(addr string) (sink, error) {
+	return nil, errors.New("audit syslog forwarding is not supported on this platform")
+}
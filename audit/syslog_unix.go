@@ -0,0 +1,53 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/url"
+
+	"copilot-go/store"
+)
+
+type syslogSink struct {
+	addr string
+	w    *syslog.Writer
+}
+
+// newSyslogSink connects to addr: "local", or a udp://, tcp:// or unix:// URL.
+func newSyslogSink(addr string) (*syslogSink, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit syslog address %q", addr)
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			network, raddr = u.Scheme, u.Host
+		case "unix", "unixgram":
+			network, raddr = u.Scheme, u.Path
+		default:
+			return nil, fmt.Errorf("invalid audit syslog address %q: want local, udp://, tcp:// or unix://", addr)
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "copilot-go")
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog %s: %w", addr, err)
+	}
+	return &syslogSink{addr: addr, w: w}, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog " + s.addr
+}
+
+func (s *syslogSink) send(e store.AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.w.Notice(string(data))
+}
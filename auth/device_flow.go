@@ -6,7 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
@@ -57,7 +57,7 @@ func (e *errSlowDown) Error() string {
 }
 
 func StartDeviceFlow() (*AuthSession, error) {
-	log.Printf("[DeviceFlow] Starting device flow, client_id=%s", config.GithubClientID)
+	slog.Info("starting device flow", "client_id", config.GithubClientID)
 
 	body, _ := json.Marshal(map[string]string{
 		"client_id": config.GithubClientID,
@@ -74,7 +74,7 @@ func StartDeviceFlow() (*AuthSession, error) {
 	client := config.NewHTTPClient(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("[DeviceFlow] Request to %s failed: %v", config.GithubDeviceURL, err)
+		slog.Error("device code request failed", "url", config.GithubDeviceURL, "err", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -84,7 +84,8 @@ func StartDeviceFlow() (*AuthSession, error) {
 		return nil, err
 	}
 
-	log.Printf("[DeviceFlow] Device code response (status %d): %s", resp.StatusCode, string(respBody))
+	// The body carries the device code, which is a credential; log only the status.
+	slog.Debug("device code response", "status", resp.StatusCode)
 
 	var dcResp deviceCodeResponse
 	if err := json.Unmarshal(respBody, &dcResp); err != nil {
@@ -105,7 +106,7 @@ func StartDeviceFlow() (*AuthSession, error) {
 		session.Interval = 5
 	}
 
-	log.Printf("[DeviceFlow] Session created: id=%s userCode=%s interval=%d expiresIn=%d", session.ID, session.UserCode, session.Interval, dcResp.ExpiresIn)
+	slog.Info("device flow session created", "session", session.ID, "user_code", session.UserCode, "interval", session.Interval, "expires_in", dcResp.ExpiresIn)
 
 	authSessions.Store(session.ID, session)
 
@@ -116,7 +117,7 @@ func StartDeviceFlow() (*AuthSession, error) {
 
 func pollForToken(session *AuthSession) {
 	interval := time.Duration(session.Interval) * time.Second
-	log.Printf("[DeviceFlow] Poll goroutine started for session %s, interval=%v", session.ID, interval)
+	slog.Debug("device flow polling started", "session", session.ID, "interval", interval)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -124,7 +125,7 @@ func pollForToken(session *AuthSession) {
 		select {
 		case <-ticker.C:
 			if time.Now().After(session.ExpiresAt) {
-				log.Printf("[DeviceFlow] Session %s expired", session.ID)
+				slog.Info("device flow session expired", "session", session.ID)
 				session.Status = "expired"
 				session.Error = "device code expired"
 				authSessions.Store(session.ID, session)
@@ -137,22 +138,22 @@ func pollForToken(session *AuthSession) {
 				var sd *errSlowDown
 				if errors.As(err, &sd) {
 					interval = time.Duration(sd.Interval) * time.Second
-					log.Printf("[DeviceFlow] Session %s slow_down, new interval=%v", session.ID, interval)
+					slog.Debug("device flow slow_down", "session", session.ID, "interval", interval)
 					ticker.Reset(interval)
 				} else {
-					log.Printf("[DeviceFlow] Session %s poll: %v", session.ID, err)
+					slog.Debug("device flow poll", "session", session.ID, "err", err)
 				}
 				continue
 			}
 
 			if token != "" {
-				log.Printf("[DeviceFlow] Session %s got token (len=%d)", session.ID, len(token))
+				slog.Info("device flow completed", "session", session.ID)
 				session.Status = "completed"
 				session.AccessToken = token
 				authSessions.Store(session.ID, session)
 				return
 			}
-			log.Printf("[DeviceFlow] Session %s poll: empty token, no error", session.ID)
+			slog.Debug("device flow poll returned no token", "session", session.ID)
 		}
 	}
 }
@@ -174,7 +175,7 @@ func requestToken(deviceCode string) (string, error) {
 	client := config.NewHTTPClient(10 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("[DeviceFlow] Token request HTTP error: %v", err)
+		slog.Warn("device flow token request failed", "err", err)
 		return "", err
 	}
 	defer resp.Body.Close()
@@ -184,13 +185,13 @@ func requestToken(deviceCode string) (string, error) {
 		return "", err
 	}
 
-	log.Printf("[DeviceFlow] Token response (status %d): %s", resp.StatusCode, string(respBody))
-
+	// Never log the body: on success it contains the GitHub access token.
 	var tokenResp tokenResponse
 	if err := json.Unmarshal(respBody, &tokenResp); err != nil {
-		log.Printf("[DeviceFlow] Token response parse error: %v, body: %s", err, string(respBody))
+		slog.Warn("device flow token response parse error", "status", resp.StatusCode, "err", err)
 		return "", err
 	}
+	slog.Debug("device flow token response", "status", resp.StatusCode, "error", tokenResp.Error)
 
 	if tokenResp.Error == "slow_down" {
 		interval := tokenResp.Interval
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-go/config"
+	"copilot-go/configfile"
+	"copilot-go/handler"
+	"copilot-go/instance"
+	"copilot-go/store"
+)
+
+// configCheckInterval is how often GitOps mode looks for changes to the
+// configuration file and the secret files it references.
+const configCheckInterval = 5 * time.Second
+
+// loadConfig loads the declarative configuration and fills in the flags it
+// covers that were not given on the command line.
+func loadConfig(path string, webPort, proxyPort *int, dataDir *string) (*configfile.Config, error) {
+	cfg, err := configfile.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	overrideFlags(cfg, webPort, proxyPort, dataDir)
+	return cfg, nil
+}
+
+func overrideFlags(cfg *configfile.Config, webPort, proxyPort *int, dataDir *string) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if cfg.WebPort != nil && !explicit["web-port"] {
+		*webPort = *cfg.WebPort
+	}
+	if cfg.ProxyPort != nil && !explicit["proxy-port"] {
+		*proxyPort = *cfg.ProxyPort
+	}
+	if !explicit["data-dir"] {
+		*dataDir = cfg.DataDir
+	}
+}
+
+// checkConfig implements -check-config: it prints what applying cfg would
+// change in the data directory, without changing anything, and returns the
+// exit code.
+func checkConfig(cfg *configfile.Config, prune bool) int {
+	changes, err := cfg.Plan(prune)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration cannot be applied: %v\n", err)
+		return 1
+	}
+	if cfg.Path != "" {
+		fmt.Printf("Configuration %s is valid.\n", cfg.Path)
+	} else {
+		fmt.Println("Configuration is valid.")
+	}
+	if len(changes) == 0 {
+		fmt.Printf("No changes to %s.\n", store.AppDir)
+		return 0
+	}
+	fmt.Printf("%d changes to %s:\n", len(changes), store.AppDir)
+	for _, ch := range changes {
+		fmt.Println("  " + ch.String())
+	}
+	return 0
+}
+
+// printConfigError prints a configuration error for -check-config, one
+// problem per line.
+func printConfigError(err error) {
+	var invalid *configfile.Error
+	if !errors.As(err, &invalid) {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	where := "Configuration"
+	if invalid.Path != "" {
+		where = "Configuration " + invalid.Path
+	}
+	fmt.Fprintf(os.Stderr, "%s is invalid:\n", where)
+	for _, p := range invalid.Problems {
+		fmt.Fprintln(os.Stderr, "  "+p)
+	}
+}
+
+// applyConfig writes cfg to the data directory, logging and auditing each
+// change. With prune, objects cfg does not declare are deleted.
+func applyConfig(cfg *configfile.Config, prune bool) ([]configfile.Change, error) {
+	changes, err := cfg.Apply(prune)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range changes {
+		slog.Info("Applied configuration change", "change", ch.String())
+		handler.RecordConfigChange(ch)
+	}
+	return changes, nil
+}
+
+// configWatcher keeps the data directory and the running instances in line
+// with the configuration file in GitOps mode.
+type configWatcher struct {
+	cfg       *configfile.Config
+	autoStart bool
+	stamp     string
+
+	// The settings that only take effect on restart, as started with.
+	webPort, proxyPort int
+	dataDir            string
+
+	quit     chan struct{}  // closed to stop the watcher
+	done     chan struct{}  // closed when run returns
+	starting sync.WaitGroup // instances being started by reconcile
+}
+
+func newConfigWatcher(cfg *configfile.Config, autoStart bool, webPort, proxyPort int, dataDir string) *configWatcher {
+	return &configWatcher{
+		cfg:       cfg,
+		autoStart: autoStart,
+		stamp:     fileStamp(cfg.Files()),
+		webPort:   webPort,
+		proxyPort: proxyPort,
+		dataDir:   dataDir,
+	}
+}
+
+// start watches the configuration in the background until stop.
+func (w *configWatcher) start() {
+	if w == nil {
+		return
+	}
+	w.quit, w.done = make(chan struct{}), make(chan struct{})
+	go w.run(w.quit, w.done)
+}
+
+// stop ends the watching and waits for a reload in progress and the
+// instances it is starting, so that nothing changes the data directory or
+// starts instances during a shutdown or handoff. It may be called on a nil or
+// stopped watcher.
+func (w *configWatcher) stop() {
+	if w == nil || w.quit == nil {
+		return
+	}
+	close(w.quit)
+	<-w.done
+	w.starting.Wait()
+	w.quit = nil
+}
+
+func (w *configWatcher) run(quit, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		if stamp := fileStamp(w.cfg.Files()); stamp != w.stamp {
+			w.stamp = stamp
+			w.reload()
+		}
+	}
+}
+
+// fileStamp summarizes the modification time and size of files, following
+// symlinks, so that a swapped Kubernetes ConfigMap or Secret is noticed.
+func fileStamp(files []string) string {
+	var b strings.Builder
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d\n", f, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&b, "%s:missing\n", f)
+		}
+	}
+	return b.String()
+}
+
+// reload applies the configuration file again. An invalid file is reported
+// and the current configuration stays in effect.
+func (w *configWatcher) reload() {
+	cfg, err := configfile.Load(w.cfg.Path)
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the current configuration", "err", err)
+		return
+	}
+	web, proxy, dir := w.webPort, w.proxyPort, w.dataDir
+	overrideFlags(cfg, &web, &proxy, &dir)
+	if web != w.webPort || proxy != w.proxyPort || dir != w.dataDir {
+		slog.Warn("Ports and the data directory changed in the configuration take effect on restart")
+	}
+
+	changes, err := applyConfig(cfg, true)
+	if err != nil {
+		slog.Error("Configuration reload failed", "err", err)
+		return
+	}
+	handler.SetGitOps(cfg.Path, cfg.ProxyURL != nil)
+	if !reflect.DeepEqual(cfg.RateLimitRPM, w.cfg.RateLimitRPM) {
+		if cfg.RateLimitRPM != nil {
+			instance.SetGlobalRPM(*cfg.RateLimitRPM)
+		} else {
+			instance.SetGlobalRPM(0)
+			instance.InitRateLimiter()
+		}
+	}
+	w.cfg = cfg
+	w.reconcile(changes)
+	slog.Info("Reloaded configuration", "file", cfg.Path, "changes", len(changes))
+}
+
+// instanceFields are the account fields that need the instance restarted.
+var instanceFields = []string{"githubToken", "accountType", "enabled"}
+
+// reconcile starts and stops instances and refreshes the in-memory pool and
+// proxy settings after changes were applied.
+func (w *configWatcher) reconcile(changes []configfile.Change) {
+	poolsChanged := false
+	for _, ch := range changes {
+		switch ch.Kind {
+		case configfile.KindAccount:
+			if ch.Action == configfile.ActionDelete {
+				instance.StopInstance(ch.ID)
+				continue
+			}
+			a := *ch.After.(*store.Account)
+			running := instance.GetInstanceStatus(a.ID) == "running"
+			if ch.Action == configfile.ActionUpdate {
+				if !slices.ContainsFunc(ch.Fields, func(f string) bool { return slices.Contains(instanceFields, f) }) {
+					continue
+				}
+				instance.StopInstance(a.ID)
+			}
+			if a.Enabled && (w.autoStart || running) {
+				w.starting.Add(1)
+				go func() {
+					defer w.starting.Done()
+					if err := instance.StartInstance(a); err != nil {
+						slog.Warn("Failed to start account", "account", a.Name, "err", err)
+					}
+				}()
+			}
+		case configfile.KindPool:
+			rpm := 0
+			if p, ok := ch.After.(*store.Pool); ok {
+				rpm = p.RateLimitRPM
+			}
+			instance.SetPoolRPM(ch.ID, rpm)
+			poolsChanged = true
+		case configfile.KindProxyConfig:
+			config.SetProxyURL(ch.After.(*store.ProxyConfig).ProxyURL)
+			instance.RebuildHTTPClients()
+		}
+	}
+	if poolsChanged {
+		instance.ClearStickySessions()
+	}
+}
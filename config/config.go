@@ -21,6 +21,8 @@ const (
 	GithubDeviceURL  = "https://github.com/login/device/code"
 	GithubTokenURL   = "https://github.com/login/oauth/access_token"
 	GithubUserURL    = "https://api.github.com/user"
+
+	GithubCopilotUserURL = "https://api.github.com/copilot_internal/user"
 )
 
 // proxyURL is the global outbound HTTP proxy. Protected by proxyMu.
@@ -74,6 +76,11 @@ type ModelLimits struct {
 	MaxContextWindow int `json:"max_context_window,omitempty"`
 }
 
+type ModelBilling struct {
+	IsPremium  bool    `json:"is_premium"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+}
+
 type ModelEntry struct {
 	ID           string             `json:"id"`
 	Object       string             `json:"object"`
@@ -83,6 +90,7 @@ type ModelEntry struct {
 	Version      string             `json:"version,omitempty"`
 	Vendor       string             `json:"vendor,omitempty"`
 	Capabilities *ModelCapabilities `json:"capabilities,omitempty"`
+	Billing      *ModelBilling      `json:"billing,omitempty"`
 }
 
 type CopilotTokenResponse struct {
@@ -92,6 +100,7 @@ type CopilotTokenResponse struct {
 
 type State struct {
 	mu             sync.RWMutex
+	AccountID      string
 	GithubToken    string
 	CopilotToken   string
 	TokenExpiresAt int64 // Unix timestamp when the Copilot token expires
@@ -0,0 +1,409 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"time"
+
+	"copilot-go/store"
+
+	"github.com/google/uuid"
+)
+
+// Change actions.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Kinds of object a Change applies to, as used in audit actions and targets.
+const (
+	KindAccount     = "account"
+	KindPool        = "pool"
+	KindModelMap    = "model_map"
+	KindProxyConfig = "proxy_config"
+)
+
+var kindLabels = map[string]string{
+	KindAccount:     "account",
+	KindPool:        "pool",
+	KindModelMap:    "model mapping",
+	KindProxyConfig: "proxy URL",
+}
+
+// Change is one difference between the configuration and the data directory.
+type Change struct {
+	Action string
+	Kind   string
+	ID     string   // account or pool ID, Copilot model ID
+	Name   string   // shown instead of the ID when set
+	Fields []string // the fields an update changes
+
+	// Before and After are the stored object around the change, nil if it
+	// does not exist on that side. They may hold secrets.
+	Before, After any
+}
+
+// String describes the change without values, e.g. "~ pool team (strategy)".
+func (ch Change) String() string {
+	sign := map[string]string{ActionCreate: "+", ActionUpdate: "~", ActionDelete: "-"}[ch.Action]
+	s := sign + " " + kindLabels[ch.Kind]
+	if name := ch.Name; name != "" || ch.ID != "" {
+		if name == "" {
+			name = ch.ID
+		}
+		s += " " + name
+	}
+	if len(ch.Fields) > 0 {
+		s += " (" + strings.Join(ch.Fields, ", ") + ")"
+	}
+	return s
+}
+
+// state is the stored objects the configuration covers.
+type state struct {
+	accounts []store.Account
+	pools    []store.Pool
+	mappings []store.ModelMapping
+	proxyURL string
+}
+
+// loadState reads the stored objects; a data directory that does not exist
+// yet reads as empty.
+func loadState() (*state, error) {
+	var s state
+	var err error
+	if s.accounts, err = store.GetAccounts(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("load accounts: %w", err)
+	}
+	if s.pools, err = store.GetPools(); err != nil {
+		return nil, fmt.Errorf("load pools: %w", err)
+	}
+	if s.mappings, err = store.GetModelMappings(); err != nil {
+		return nil, fmt.Errorf("load model mappings: %w", err)
+	}
+	proxy, err := store.GetProxyConfig()
+	if err != nil {
+		return nil, fmt.Errorf("load proxy config: %w", err)
+	}
+	s.proxyURL = proxy.ProxyURL
+	return &s, nil
+}
+
+// Plan returns the changes Apply would make, without writing anything. With
+// prune, stored accounts, pools and model mappings that the configuration does
+// not declare are deleted; the default pool is kept.
+func (c *Config) Plan(prune bool) ([]Change, error) {
+	cur, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	want, err := c.desired(cur, prune)
+	if err != nil {
+		return nil, err
+	}
+	return diff(cur, want), nil
+}
+
+// Apply writes the declared proxy URL, accounts, pools and model mappings to
+// the data directory, replacing stored objects with the same name, ID or
+// Copilot ID, and returns what changed. See Plan for prune.
+func (c *Config) Apply(prune bool) ([]Change, error) {
+	cur, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	want, err := c.desired(cur, prune)
+	if err != nil {
+		return nil, err
+	}
+	changes := diff(cur, want)
+
+	mappingsChanged := false
+	for _, ch := range changes {
+		var err error
+		switch ch.Kind {
+		case KindAccount:
+			if ch.Action == ActionDelete {
+				err = store.DeleteAccount(ch.ID)
+			} else {
+				_, err = store.PutAccount(*ch.After.(*store.Account))
+			}
+		case KindPool:
+			if ch.Action == ActionDelete {
+				err = store.DeletePool(ch.ID)
+			} else {
+				_, err = store.PutPool(*ch.After.(*store.Pool))
+			}
+		case KindModelMap:
+			mappingsChanged = true
+		case KindProxyConfig:
+			err = store.UpdateProxyConfig(store.ProxyConfig{ProxyURL: want.proxyURL})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", kindLabels[ch.Kind], ch.ID, err)
+		}
+	}
+	if mappingsChanged {
+		if err := store.SetModelMappings(want.mappings); err != nil {
+			return nil, fmt.Errorf("model mappings: %w", err)
+		}
+	}
+	return changes, nil
+}
+
+// desired returns cur with the configuration applied.
+func (c *Config) desired(cur *state, prune bool) (*state, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	want := &state{proxyURL: cur.proxyURL}
+	if c.ProxyURL != nil {
+		want.proxyURL = *c.ProxyURL
+	}
+
+	// Accounts, matched by name
+	if !prune {
+		want.accounts = append(want.accounts, cur.accounts...)
+	}
+	for _, d := range c.Accounts {
+		i := indexOf(want.accounts, func(a store.Account) bool { return a.Name == d.Name })
+		var a store.Account
+		if j := indexOf(cur.accounts, func(a store.Account) bool { return a.Name == d.Name }); j >= 0 {
+			a = cur.accounts[j] // keeps the ID, creation time and API key
+		} else {
+			a = store.Account{ID: uuid.New().String(), ApiKey: "sk-" + uuid.New().String(), CreatedAt: now}
+		}
+		a.Name = d.Name
+		a.GithubToken = d.GithubToken
+		a.AccountType = d.AccountType
+		if a.AccountType == "" {
+			a.AccountType = "individual"
+		}
+		if d.ApiKey != "" {
+			a.ApiKey = d.ApiKey
+		}
+		a.Enabled = d.Enabled == nil || *d.Enabled
+		a.Priority = d.Priority
+		a.AllowedIPs = d.AllowedIPs
+		if i >= 0 {
+			want.accounts[i] = a
+		} else {
+			want.accounts = append(want.accounts, a)
+		}
+	}
+
+	// Pools, matched by ID, with members resolved against the new accounts
+	accountID := make(map[string]string, 2*len(want.accounts))
+	for _, a := range want.accounts {
+		accountID[a.ID] = a.ID
+		accountID[a.Name] = a.ID
+	}
+	if !prune {
+		want.pools = append(want.pools, cur.pools...)
+	} else if j := indexOf(cur.pools, func(p store.Pool) bool { return p.ID == store.DefaultPoolID }); j >= 0 {
+		want.pools = append(want.pools, cur.pools[j])
+	}
+	for _, d := range c.Pools {
+		members := make([]string, 0, len(d.Members))
+		for _, m := range d.Members {
+			id, ok := accountID[m]
+			if !ok {
+				return nil, fmt.Errorf("pool %q: member %q is not a known account name or ID", d.ID, m)
+			}
+			members = append(members, id)
+		}
+
+		var p store.Pool
+		if j := indexOf(cur.pools, func(p store.Pool) bool { return p.ID == d.ID }); j >= 0 {
+			p = cur.pools[j] // keeps the creation time, keys and per-key policies
+		} else {
+			p = store.Pool{ApiKeys: []string{"sk-pool-" + uuid.New().String()}, CreatedAt: now}
+		}
+		p.ID = d.ID
+		p.Name = d.Name
+		if p.Name == "" {
+			p.Name = d.ID
+		}
+		p.Enabled = d.Enabled == nil || *d.Enabled
+		p.Strategy = d.Strategy
+		if p.Strategy == "" {
+			p.Strategy = "round-robin"
+		}
+		p.Members = members
+		p.Models = d.Models
+		p.RateLimitRPM = d.RateLimitRPM
+		p.Sticky = d.Sticky
+		p.StickyTTLMinutes = d.StickyTTLMinutes
+		p.StreamFailover = d.StreamFailover
+		if len(d.ApiKeys) > 0 {
+			p.ApiKeys = d.ApiKeys
+			p.Hedging = keepKeys(p.Hedging, p.HasApiKey)
+			p.AllowedIPs = keepKeys(p.AllowedIPs, p.HasApiKey)
+		}
+		if i := indexOf(want.pools, func(w store.Pool) bool { return w.ID == d.ID }); i >= 0 {
+			want.pools[i] = p
+		} else {
+			want.pools = append(want.pools, p)
+		}
+	}
+
+	// Model mappings, matched by Copilot ID
+	if !prune {
+		want.mappings = append(want.mappings, cur.mappings...)
+	}
+	for _, d := range c.ModelMap {
+		m := store.ModelMapping{CopilotID: d.CopilotID, DisplayID: d.DisplayID, DisplayName: d.DisplayName}
+		if i := indexOf(want.mappings, func(w store.ModelMapping) bool { return w.CopilotID == d.CopilotID }); i >= 0 {
+			want.mappings[i] = m
+		} else {
+			want.mappings = append(want.mappings, m)
+		}
+	}
+	return want, nil
+}
+
+// diff lists the changes that turn cur into want.
+func diff(cur, want *state) []Change {
+	var changes []Change
+
+	accountChange := func(before, after *store.Account) []string {
+		return changedFields(
+			field{"name", before.Name, after.Name},
+			field{"githubToken", before.GithubToken, after.GithubToken},
+			field{"accountType", before.AccountType, after.AccountType},
+			field{"apiKey", before.ApiKey, after.ApiKey},
+			field{"enabled", before.Enabled, after.Enabled},
+			field{"priority", before.Priority, after.Priority},
+			field{"allowedIPs", before.AllowedIPs, after.AllowedIPs},
+		)
+	}
+	changes = append(changes, diffList(KindAccount, cur.accounts, want.accounts,
+		func(a store.Account) string { return a.ID },
+		func(a store.Account) string { return a.Name },
+		accountChange)...)
+
+	poolChange := func(before, after *store.Pool) []string {
+		return changedFields(
+			field{"name", before.Name, after.Name},
+			field{"enabled", before.Enabled, after.Enabled},
+			field{"strategy", before.Strategy, after.Strategy},
+			field{"apiKeys", before.ApiKeys, after.ApiKeys},
+			field{"members", before.Members, after.Members},
+			field{"models", before.Models, after.Models},
+			field{"rateLimitRPM", before.RateLimitRPM, after.RateLimitRPM},
+			field{"sticky", before.Sticky, after.Sticky},
+			field{"stickyTTLMinutes", before.StickyTTLMinutes, after.StickyTTLMinutes},
+			field{"streamFailover", before.StreamFailover, after.StreamFailover},
+			field{"hedging", before.Hedging, after.Hedging},
+			field{"allowedIPs", before.AllowedIPs, after.AllowedIPs},
+		)
+	}
+	changes = append(changes, diffList(KindPool, cur.pools, want.pools,
+		func(p store.Pool) string { return p.ID },
+		func(p store.Pool) string { return p.ID },
+		poolChange)...)
+
+	mappingChange := func(before, after *store.ModelMapping) []string {
+		return changedFields(
+			field{"displayId", before.DisplayID, after.DisplayID},
+			field{"displayName", before.DisplayName, after.DisplayName},
+		)
+	}
+	changes = append(changes, diffList(KindModelMap, cur.mappings, want.mappings,
+		func(m store.ModelMapping) string { return m.CopilotID },
+		func(m store.ModelMapping) string { return m.CopilotID },
+		mappingChange)...)
+
+	if cur.proxyURL != want.proxyURL {
+		ch := Change{Action: ActionUpdate, Kind: KindProxyConfig,
+			Before: &store.ProxyConfig{ProxyURL: cur.proxyURL}, After: &store.ProxyConfig{ProxyURL: want.proxyURL}}
+		if cur.proxyURL == "" {
+			ch.Action = ActionCreate
+		} else if want.proxyURL == "" {
+			ch.Action = ActionDelete
+		}
+		changes = append(changes, ch)
+	}
+	return changes
+}
+
+// diffList matches cur and want by id and reports created, updated and
+// deleted objects, in that order.
+func diffList[T any](kind string, cur, want []T, id, name func(T) string, changed func(before, after *T) []string) []Change {
+	before := make(map[string]*T, len(cur))
+	for i := range cur {
+		before[id(cur[i])] = &cur[i]
+	}
+	var created, updated, deleted []Change
+	seen := make(map[string]bool, len(want))
+	for i := range want {
+		w := &want[i]
+		key := id(*w)
+		seen[key] = true
+		b, ok := before[key]
+		if !ok {
+			created = append(created, Change{Action: ActionCreate, Kind: kind, ID: key, Name: name(*w), After: w})
+		} else if fields := changed(b, w); len(fields) > 0 {
+			updated = append(updated, Change{Action: ActionUpdate, Kind: kind, ID: key, Name: name(*w), Fields: fields, Before: b, After: w})
+		}
+	}
+	for i := range cur {
+		if key := id(cur[i]); !seen[key] {
+			deleted = append(deleted, Change{Action: ActionDelete, Kind: kind, ID: key, Name: name(cur[i]), Before: &cur[i]})
+		}
+	}
+	return append(append(created, updated...), deleted...)
+}
+
+type field struct {
+	name          string
+	before, after any
+}
+
+// changedFields returns the names of the fields whose values differ. Empty
+// and nil slices and maps are equal.
+func changedFields(fields ...field) []string {
+	var names []string
+	for _, f := range fields {
+		if !sameValue(f.before, f.after) {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+func sameValue(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() == reflect.Slice || va.Kind() == reflect.Map {
+		if va.Len() == 0 && vb.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func indexOf[T any](list []T, match func(T) bool) int {
+	for i, v := range list {
+		if match(v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// keepKeys returns a copy of m without the entries whose key fails keep.
+func keepKeys[V any](m map[string]V, keep func(string) bool) map[string]V {
+	var kept map[string]V
+	for k, v := range m {
+		if keep(k) {
+			if kept == nil {
+				kept = make(map[string]V)
+			}
+			kept[k] = v
+		}
+	}
+	return kept
+}
@@ -0,0 +1,415 @@
+// Package configfile loads the declarative configuration: a YAML or TOML
+// file overlaid with COPILOT_GO_* environment variables. It declares the
+// ports, data directory and outbound proxy, and the accounts, pools and model
+// mappings written to the data directory on startup.
+//
+// Precedence, highest first: command-line flags, COPILOT_GO_* variables, the
+// file, the older environment variables (RATE_LIMIT_RPM), then the values
+// stored through the console and the built-in defaults.
+package configfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"copilot-go/netacl"
+	"copilot-go/store"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Config is the declarative configuration. Unset fields leave the flag
+// defaults and stored settings alone.
+type Config struct {
+	WebPort      *int           `yaml:"webPort" toml:"webPort"`
+	ProxyPort    *int           `yaml:"proxyPort" toml:"proxyPort"`
+	DataDir      string         `yaml:"dataDir" toml:"dataDir"`
+	ProxyURL     *string        `yaml:"proxyURL" toml:"proxyURL"` // "" clears a proxy set in the console
+	RateLimitRPM *int           `yaml:"rateLimitRPM" toml:"rateLimitRPM"`
+	Accounts     []Account      `yaml:"accounts" toml:"accounts"`
+	Pools        []Pool         `yaml:"pools" toml:"pools"`
+	ModelMap     []ModelMapping `yaml:"modelMappings" toml:"modelMappings"`
+
+	// Path is the file the configuration was loaded from, "" if none.
+	Path string `yaml:"-" toml:"-"`
+
+	files []string // secret files read while resolving
+}
+
+// Files returns the configuration file and the secret files it references.
+func (c *Config) Files() []string {
+	if c.Path == "" {
+		return c.files
+	}
+	return append([]string{c.Path}, c.files...)
+}
+
+// Account declares a GitHub account, matched to a stored one by name. Each
+// secret is given inline, read from a file (trailing newline trimmed) or read
+// from an environment variable.
+type Account struct {
+	Name            string   `yaml:"name" toml:"name"`
+	AccountType     string   `yaml:"accountType" toml:"accountType"` // individual (default), business or enterprise
+	GithubToken     string   `yaml:"githubToken" toml:"githubToken"`
+	GithubTokenFile string   `yaml:"githubTokenFile" toml:"githubTokenFile"`
+	GithubTokenEnv  string   `yaml:"githubTokenEnv" toml:"githubTokenEnv"`
+	ApiKey          string   `yaml:"apiKey" toml:"apiKey"` // none = keep the stored key or generate one
+	ApiKeyFile      string   `yaml:"apiKeyFile" toml:"apiKeyFile"`
+	ApiKeyEnv       string   `yaml:"apiKeyEnv" toml:"apiKeyEnv"`
+	Enabled         *bool    `yaml:"enabled" toml:"enabled"` // default true
+	Priority        int      `yaml:"priority" toml:"priority"`
+	AllowedIPs      []string `yaml:"allowedIPs" toml:"allowedIPs"`
+}
+
+// Pool declares a pool, matched to a stored one by ID. Members are account
+// names or IDs.
+type Pool struct {
+	ID               string   `yaml:"id" toml:"id"`
+	Name             string   `yaml:"name" toml:"name"`       // default the ID
+	Enabled          *bool    `yaml:"enabled" toml:"enabled"` // default true
+	Strategy         string   `yaml:"strategy" toml:"strategy"`
+	ApiKeys          []string `yaml:"apiKeys" toml:"apiKeys"`         // none = keep the stored keys or generate one
+	ApiKeysFile      string   `yaml:"apiKeysFile" toml:"apiKeysFile"` // one key per line
+	Members          []string `yaml:"members" toml:"members"`
+	Models           []string `yaml:"models" toml:"models"`
+	RateLimitRPM     int      `yaml:"rateLimitRPM" toml:"rateLimitRPM"`
+	Sticky           bool     `yaml:"sticky" toml:"sticky"`
+	StickyTTLMinutes int      `yaml:"stickyTTLMinutes" toml:"stickyTTLMinutes"`
+	StreamFailover   string   `yaml:"streamFailover" toml:"streamFailover"`
+}
+
+// ModelMapping declares a model mapping, matched to a stored one by Copilot ID.
+type ModelMapping struct {
+	CopilotID   string `yaml:"copilotId" toml:"copilotId"`
+	DisplayID   string `yaml:"displayId" toml:"displayId"`
+	DisplayName string `yaml:"displayName" toml:"displayName"`
+}
+
+// EnvAccountName is the account declared by COPILOT_GO_GITHUB_TOKEN.
+const EnvAccountName = "default"
+
+// Load reads the file at path ("" for none), applies the COPILOT_GO_*
+// variables, resolves secrets and validates the result. All problems found
+// are reported together.
+func Load(path string) (*Config, error) {
+	cfg := &Config{Path: path}
+	if path != "" {
+		if err := decodeFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+	errs := cfg.applyEnv()
+	errs = append(errs, cfg.resolve()...)
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, invalid(path, errs)
+	}
+	return cfg, nil
+}
+
+func decodeFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(bytes.NewReader(data), yaml.DisallowUnknownField()).Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			return nil // an empty file
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, yaml.FormatError(err, false, false))
+		}
+	case ".toml":
+		err = toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, tomlError(err))
+		}
+	default:
+		return fmt.Errorf("%s: unknown format, use a .yaml, .yml or .toml file", path)
+	}
+	return nil
+}
+
+// tomlError describes a TOML error with its position, listing every unknown
+// field.
+func tomlError(err error) string {
+	var strict *toml.StrictMissingError
+	if errors.As(err, &strict) {
+		fields := make([]string, len(strict.Errors))
+		for i, e := range strict.Errors {
+			row, _ := e.Position()
+			fields[i] = fmt.Sprintf("%q (line %d)", strings.Join(e.Key(), "."), row)
+		}
+		return "unknown field " + strings.Join(fields, ", ")
+	}
+	var decode *toml.DecodeError
+	if errors.As(err, &decode) {
+		row, col := decode.Position()
+		return fmt.Sprintf("[%d:%d] %v", row, col, err)
+	}
+	return err.Error()
+}
+
+// Error lists every problem found in a configuration.
+type Error struct {
+	Path     string // "" if there is no file
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	where := "configuration"
+	if e.Path != "" {
+		where = e.Path
+	}
+	return fmt.Sprintf("invalid %s: %s", where, strings.Join(e.Problems, "; "))
+}
+
+func invalid(path string, errs []error) error {
+	e := &Error{Path: path}
+	for _, err := range errs {
+		e.Problems = append(e.Problems, err.Error())
+	}
+	return e
+}
+
+// applyEnv overrides the file with COPILOT_GO_WEB_PORT, COPILOT_GO_PROXY_PORT,
+// COPILOT_GO_DATA_DIR, COPILOT_GO_PROXY_URL and COPILOT_GO_RATE_LIMIT_RPM.
+// COPILOT_GO_GITHUB_TOKEN or COPILOT_GO_GITHUB_TOKEN_FILE declare the
+// account EnvAccountName, with COPILOT_GO_ACCOUNT_TYPE and COPILOT_GO_API_KEY.
+func (c *Config) applyEnv() []error {
+	var errs []error
+	envInt := func(name string, dst **int) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+			return
+		}
+		*dst = &n
+	}
+	envInt("COPILOT_GO_WEB_PORT", &c.WebPort)
+	envInt("COPILOT_GO_PROXY_PORT", &c.ProxyPort)
+	envInt("COPILOT_GO_RATE_LIMIT_RPM", &c.RateLimitRPM)
+	if v := os.Getenv("COPILOT_GO_DATA_DIR"); v != "" {
+		c.DataDir = v
+	}
+	if v, ok := os.LookupEnv("COPILOT_GO_PROXY_URL"); ok {
+		c.ProxyURL = &v
+	}
+
+	token, tokenFile := os.Getenv("COPILOT_GO_GITHUB_TOKEN"), os.Getenv("COPILOT_GO_GITHUB_TOKEN_FILE")
+	if token == "" && tokenFile == "" {
+		return errs
+	}
+	a := Account{
+		Name:            EnvAccountName,
+		AccountType:     os.Getenv("COPILOT_GO_ACCOUNT_TYPE"),
+		GithubToken:     token,
+		GithubTokenFile: tokenFile,
+		ApiKey:          os.Getenv("COPILOT_GO_API_KEY"),
+	}
+	for i := range c.Accounts {
+		if c.Accounts[i].Name == EnvAccountName {
+			c.Accounts[i] = a
+			return errs
+		}
+	}
+	c.Accounts = append(c.Accounts, a)
+	return errs
+}
+
+// resolve replaces secrets given by file or environment variable with their
+// values.
+func (c *Config) resolve() []error {
+	var errs []error
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		where := accountWhere(i, a.Name)
+		c.files = appendNonEmpty(c.files, a.GithubTokenFile, a.ApiKeyFile)
+		var err error
+		if a.GithubToken, err = secret(a.GithubToken, a.GithubTokenFile, a.GithubTokenEnv); err != nil {
+			errs = append(errs, fmt.Errorf("%s: githubToken: %w", where, err))
+		} else if a.GithubToken == "" {
+			errs = append(errs, fmt.Errorf("%s: one of githubToken, githubTokenFile or githubTokenEnv is required", where))
+		}
+		if a.ApiKey, err = secret(a.ApiKey, a.ApiKeyFile, a.ApiKeyEnv); err != nil {
+			errs = append(errs, fmt.Errorf("%s: apiKey: %w", where, err))
+		}
+		a.GithubTokenFile, a.GithubTokenEnv, a.ApiKeyFile, a.ApiKeyEnv = "", "", "", ""
+	}
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if p.ApiKeysFile == "" {
+			continue
+		}
+		c.files = append(c.files, p.ApiKeysFile)
+		data, err := os.ReadFile(p.ApiKeysFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %q: apiKeysFile: %w", p.ID, err))
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if key := strings.TrimSpace(line); key != "" && !strings.HasPrefix(key, "#") {
+				p.ApiKeys = append(p.ApiKeys, key)
+			}
+		}
+		p.ApiKeysFile = ""
+	}
+	return errs
+}
+
+// secret returns the one of value, the contents of file or the variable env
+// that is set, or "" if none is.
+func secret(value, file, env string) (string, error) {
+	set := 0
+	for _, s := range []string{value, file, env} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return "", errors.New("set only one of the value, file or environment variable")
+	}
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		v := strings.TrimSpace(string(data))
+		if v == "" {
+			return "", fmt.Errorf("%s is empty", file)
+		}
+		return v, nil
+	case env != "":
+		v := os.Getenv(env)
+		if v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+func (c *Config) validate() []error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for name, port := range map[string]*int{"webPort": c.WebPort, "proxyPort": c.ProxyPort} {
+		if port != nil && (*port < 0 || *port > 65535) {
+			fail("%s: %d is not a port", name, *port)
+		}
+	}
+	if c.ProxyURL != nil && *c.ProxyURL != "" {
+		if _, err := url.ParseRequestURI(*c.ProxyURL); err != nil {
+			fail("proxyURL: invalid URL %q", *c.ProxyURL)
+		}
+	}
+	if c.RateLimitRPM != nil && *c.RateLimitRPM < 0 {
+		fail("rateLimitRPM: must not be negative")
+	}
+
+	keys := make(map[string]string) // API key -> where it is declared
+	useKey := func(key, where string) {
+		if other, ok := keys[key]; ok {
+			fail("%s: API key is also used by %s", where, other)
+		}
+		keys[key] = where
+	}
+
+	names := make(map[string]bool)
+	for i, a := range c.Accounts {
+		where := accountWhere(i, a.Name)
+		if a.Name == "" {
+			fail("%s: name is required", where)
+		} else if names[a.Name] {
+			fail("%s: declared twice", where)
+		}
+		names[a.Name] = true
+		switch a.AccountType {
+		case "", "individual", "business", "enterprise":
+		default:
+			fail("%s: accountType must be individual, business or enterprise", where)
+		}
+		if a.ApiKey != "" {
+			useKey(a.ApiKey, where)
+		}
+		if _, err := netacl.Parse(a.AllowedIPs); err != nil {
+			fail("%s: allowedIPs: %v", where, err)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i, p := range c.Pools {
+		where := fmt.Sprintf("pool %q", p.ID)
+		if p.ID == "" {
+			where = fmt.Sprintf("pools[%d]", i)
+			fail("%s: id is required", where)
+		} else if ids[p.ID] {
+			fail("%s: declared twice", where)
+		}
+		ids[p.ID] = true
+		if !store.ValidStrategy(p.Strategy) {
+			fail("%s: unknown strategy %q, want one of %s", where, p.Strategy, strings.Join(store.Strategies, ", "))
+		}
+		switch p.StreamFailover {
+		case store.StreamFailoverOff, store.StreamFailoverRetry, store.StreamFailoverContinue:
+		default:
+			fail("%s: streamFailover must be empty, \"retry\" or \"continue\"", where)
+		}
+		if p.RateLimitRPM < 0 || p.StickyTTLMinutes < 0 {
+			fail("%s: rateLimitRPM and stickyTTLMinutes must not be negative", where)
+		}
+		for _, key := range p.ApiKeys {
+			useKey(key, where)
+		}
+	}
+
+	copilotIDs, displayIDs := make(map[string]bool), make(map[string]bool)
+	for i, m := range c.ModelMap {
+		if m.CopilotID == "" || m.DisplayID == "" {
+			fail("modelMappings[%d]: copilotId and displayId are required", i)
+			continue
+		}
+		if copilotIDs[m.CopilotID] {
+			fail("modelMappings[%d]: copilotId %q is mapped twice", i, m.CopilotID)
+		}
+		if displayIDs[m.DisplayID] {
+			fail("modelMappings[%d]: displayId %q is used twice", i, m.DisplayID)
+		}
+		copilotIDs[m.CopilotID], displayIDs[m.DisplayID] = true, true
+	}
+	return errs
+}
+
+// accountWhere names the i-th declared account in errors.
+func accountWhere(i int, name string) string {
+	if name == "" {
+		return fmt.Sprintf("accounts[%d]", i)
+	}
+	return fmt.Sprintf("account %q", name)
+}
+
+func appendNonEmpty(list []string, values ...string) []string {
+	for _, v := range values {
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+
+	"copilot-go/netacl"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPFilter rejects clients outside acl with 403. Client addresses come from
+// gin's ClientIP, so X-Forwarded-For is only honored from trusted proxies.
+// Unix socket clients are not filtered.
+func IPFilter(acl netacl.ACL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !viaUnixSocket(c) && !acl.Permits(c.ClientIP()) {
+			slog.DebugContext(c.Request.Context(), "rejected client by IP ACL", "ip", c.ClientIP(), "path", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "access denied"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// keyAllowsClient reports whether an API key's address restrictions admit
+// the client. Restrictions that fail to parse admit no one; Unix socket
+// clients are local and always admitted.
+func keyAllowsClient(c *gin.Context, allowed []string) bool {
+	if len(allowed) == 0 || viaUnixSocket(c) {
+		return true
+	}
+	list, err := netacl.Parse(allowed)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "invalid API key IP restriction", "err", err)
+		return false
+	}
+	return netacl.ACL{Allow: list}.Permits(c.ClientIP())
+}
+
+// validateAllowedIPs checks an allowedIPs value from a request body, writing
+// a 400 and returning false if any entry is not an address or CIDR range.
+func validateAllowedIPs(c *gin.Context, allowed []string) bool {
+	if _, err := netacl.Parse(allowed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// --- Pool key address restriction handlers ---
+
+func handleSetPoolKeyAllowedIPs(c *gin.Context) {
+	var body struct {
+		AllowedIPs []string `json:"allowedIPs"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || len(body.AllowedIPs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "allowedIPs must list at least one address or CIDR range"})
+		return
+	}
+	if !validateAllowedIPs(c, body.AllowedIPs) {
+		return
+	}
+	setPoolKeyAllowedIPs(c, body.AllowedIPs)
+}
+
+func handleDeletePoolKeyAllowedIPs(c *gin.Context) {
+	setPoolKeyAllowedIPs(c, nil)
+}
+
+func setPoolKeyAllowedIPs(c *gin.Context, allowed []string) {
+	id := c.Param("id")
+	before, _ := store.GetPool(id)
+	pool, err := store.SetPoolKeyAllowedIPs(id, c.Param("key"), allowed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	action := "pool.set_allowed_ips"
+	if allowed == nil {
+		action = "pool.delete_allowed_ips"
+	}
+	recordAudit(c, action, "pool:"+id, before, pool)
+	c.JSON(http.StatusOK, pool)
+}
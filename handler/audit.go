@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"copilot-go/audit"
+	"copilot-go/instance"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxAuditLimit = 500
+
+// auditSecretFields are replaced with RedactedValue in audit diffs. A change
+// to one is still recorded, just without its value.
+var auditSecretFields = map[string]bool{
+	"githubtoken":  true,
+	"copilottoken": true,
+	"accesstoken":  true,
+	"token":        true,
+	"password":     true,
+	"passwordhash": true,
+	"secret":       true,
+	"totpsecret":   true,
+	"totppending":  true,
+}
+
+// recordAudit appends an audit entry for the current console request. before
+// and after are the target's state around the action (nil if it did not
+// exist); only the fields that differ are kept, with secrets redacted. The
+// action has already happened, so a failure to record it is only logged.
+func recordAudit(c *gin.Context, action, target string, before, after interface{}) {
+	e := store.AuditEntry{
+		Actor:     c.GetString(ctxAdminUser),
+		Session:   c.GetString(ctxAdminSession),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Action:    action,
+		Target:    target,
+		Changes:   auditChanges(before, after),
+	}
+	if err := audit.Record(e); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to record audit entry", "action", action, "target", target, "err", err)
+	}
+}
+
+// auditChanges diffs the top-level JSON fields of before and after.
+func auditChanges(before, after interface{}) map[string]store.AuditChange {
+	b, a := auditFields(before), auditFields(after)
+	changes := make(map[string]store.AuditChange)
+	for _, fields := range []map[string]interface{}{b, a} {
+		for k := range fields {
+			if _, seen := changes[k]; seen {
+				continue
+			}
+			bv, inBefore := b[k]
+			av, inAfter := a[k]
+			if inBefore == inAfter && reflect.DeepEqual(bv, av) {
+				continue
+			}
+			var change store.AuditChange
+			if inBefore {
+				change.Before, _ = json.Marshal(redactAuditValue(k, bv))
+			}
+			if inAfter {
+				change.After, _ = json.Marshal(redactAuditValue(k, av))
+			}
+			changes[k] = change
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// auditFields flattens v to its JSON object fields. Non-object values are
+// returned under "value".
+func auditFields(v interface{}) map[string]interface{} {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(data, &fields) == nil {
+		return fields
+	}
+	var value interface{}
+	_ = json.Unmarshal(data, &value)
+	return map[string]interface{}{"value": value}
+}
+
+// redactAuditValue masks secrets in the field named key: tokens and passwords
+// are removed, API keys are masked like in usage history, and credentials in
+// proxy URLs are stripped.
+func redactAuditValue(key string, v interface{}) interface{} {
+	switch k := strings.ToLower(key); {
+	case auditSecretFields[k]:
+		if v == nil || v == "" {
+			return v
+		}
+		return instance.RedactedValue
+	case k == "apikey" || k == "key":
+		if s, ok := v.(string); ok {
+			return store.MaskApiKey(s)
+		}
+	case k == "apikeys":
+		if list, ok := v.([]interface{}); ok {
+			masked := make([]interface{}, len(list))
+			for i, item := range list {
+				masked[i] = redactAuditValue("apiKey", item)
+			}
+			return masked
+		}
+	case k == "hedging" || k == "allowedips":
+		// Hedge policies and pool address restrictions are keyed by API key.
+		if m, ok := v.(map[string]interface{}); ok {
+			masked := make(map[string]interface{}, len(m))
+			for key, policy := range m {
+				masked[store.MaskApiKey(key)] = policy
+			}
+			return masked
+		}
+	case k == "proxyurl":
+		if s, ok := v.(string); ok {
+			return redactProxyURL(s)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[k] = redactAuditValue(k, child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = redactAuditValue("", child)
+		}
+		return out
+	}
+	return v
+}
+
+// redactProxyURL strips the password from a proxy URL.
+func redactProxyURL(s string) string {
+	if s == "" {
+		return s
+	}
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return instance.RedactedValue
+}
+
+// handleListAudit pages through the audit log, newest first.
+// Query params: before (seq cursor from the previous page's "next"), limit
+// (default 50), actor, action (exact, or a prefix ending in "." like "pool."),
+// target, and from/to (RFC3339).
+func handleListAudit(c *gin.Context) {
+	q := store.AuditQuery{
+		Limit:  50,
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Target: c.Query("target"),
+	}
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC3339 timestamp", param)})
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := c.Query("before"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a positive sequence number"})
+			return
+		}
+		q.Before = n
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)})
+			return
+		}
+		q.Limit = n
+	}
+
+	entries, next, err := store.QueryAudit(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"entries": entries}
+	if next > 0 {
+		resp["next"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
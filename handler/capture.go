@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"copilot-go/instance"
+	"copilot-go/logging"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replayHeader marks a request replayed from a capture; its value is the
+// original request ID.
+const replayHeader = "X-Replay-Of"
+
+// replaySkipHeaders are captured headers that are not sent again on replay.
+var replaySkipHeaders = map[string]bool{
+	"authorization":   true,
+	"x-api-key":       true,
+	"content-length":  true,
+	"host":            true,
+	"connection":      true,
+	"accept-encoding": true,
+	"x-request-id":    true,
+	"traceparent":     true,
+	"x-replay-of":     true,
+}
+
+// captureWriter copies up to limit bytes of the response body.
+type captureWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *captureWriter) capture(data []byte) {
+	room := w.limit - w.buf.Len()
+	if len(data) > room {
+		data = data[:max(room, 0)]
+		w.truncated = true
+	}
+	w.buf.Write(data)
+}
+
+// captureTraffic records a redacted copy of every authenticated request and
+// its response while capture is enabled.
+func captureTraffic() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := instance.CaptureMaxBodyBytes()
+		if limit == 0 {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		var reqBody []byte
+		if c.Request.Body != nil {
+			reqBody, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+		ctx, recorder := instance.WithCaptureRecorder(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		w := &captureWriter{ResponseWriter: c.Writer, limit: limit}
+		c.Writer = w
+		c.Next()
+
+		if c.GetString("apiKey") == "" {
+			return // rejected by proxyAuth
+		}
+		reqTruncated := len(reqBody) > limit
+		if reqTruncated {
+			reqBody = reqBody[:limit]
+		}
+		accountID := instance.RequestUsageFrom(c).AccountID()
+		if accountID == "" {
+			accountID = c.GetString("accountID")
+		}
+		replayOf := c.GetHeader(replayHeader)
+		if !logging.ValidRequestID(replayOf) {
+			replayOf = ""
+		}
+		instance.RecordCapture(store.Capture{
+			ID:         c.GetString("requestID"),
+			Time:       start.UTC(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			AccountID:  accountID,
+			PoolID:     c.GetString("poolID"),
+			ApiKey:     store.MaskApiKey(c.GetString("apiKey")),
+			Model:      store.ToDisplayID(c.GetString("requestModel")),
+			Status:     c.Writer.Status(),
+			DurationMs: time.Since(start).Milliseconds(),
+			ReplayOf:   replayOf,
+			Request:    instance.CaptureMessage(c.Request.Header, reqBody, reqTruncated),
+			Response:   instance.CaptureMessage(w.Header(), w.buf.Bytes(), w.truncated),
+			Upstream:   recorder.Exchanges(),
+		})
+	}
+}
+
+// ReplayCapture re-sends a captured request to the proxy at baseURL,
+// authenticated with the account's own API key so that account serves it.
+// Redacted body fields are sent as captured. The caller closes resp.Body.
+func ReplayCapture(ctx context.Context, baseURL string, capture *store.Capture, account *store.Account) (*http.Response, error) {
+	if capture.Request.Truncated {
+		return nil, errors.New("captured request body was truncated and cannot be replayed")
+	}
+	body := []byte(capture.Request.Body)
+	if len(body) == 0 {
+		body = []byte(capture.Request.Text)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, capture.Method, strings.TrimRight(baseURL, "/")+capture.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range capture.Request.Headers {
+		if v == instance.RedactedValue || replaySkipHeaders[strings.ToLower(k)] {
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", "Bearer "+account.ApiKey)
+	req.Header.Set(replayHeader, capture.ID)
+	return replayClient.Do(req)
+}
+
+// replayClient talks to this machine's own proxy, so it accepts the proxy's
+// certificate even when it is self-signed.
+var replayClient = &http.Client{Transport: &http.Transport{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}}
+
+// --- Capture console handlers ---
+
+func handleGetCapture(c *gin.Context) {
+	capture, err := store.FindCapture(c.Param("id"))
+	if errors.Is(err, store.ErrCaptureNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "capture not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, capture)
+}
+
+// handleReplayCapture replays a captured request against the chosen account
+// and returns the redacted response together with the replay's request ID.
+func handleReplayCapture(proxyPort int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			AccountID string `json:"accountId"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.AccountID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "accountId is required"})
+			return
+		}
+
+		capture, err := store.FindCapture(c.Param("id"))
+		if errors.Is(err, store.ErrCaptureNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "capture not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		account, err := store.GetAccount(body.AccountID)
+		if err != nil || account == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+			return
+		}
+		if proxyPort == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "replay needs the proxy's TCP port, it only listens on a Unix socket"})
+			return
+		}
+
+		resp, err := ReplayCapture(c.Request.Context(), LocalProxyURL(proxyBind, proxyPort, proxyTLS), capture, account)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("replay failed: %v", err)})
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		recordAudit(c, "capture.replay", "capture:"+capture.ID, nil, gin.H{
+			"accountId": account.ID,
+			"requestId": resp.Header.Get("X-Request-Id"),
+		})
+
+		limit := instance.CaptureMaxBodyBytes()
+		if limit == 0 {
+			limit = 1 << 20
+		}
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+		truncated := len(respBody) > limit
+		if truncated {
+			respBody = respBody[:limit]
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"requestId": resp.Header.Get("X-Request-Id"),
+			"status":    resp.StatusCode,
+			"response":  instance.CaptureMessage(resp.Header, respBody, truncated),
+		})
+	}
+}
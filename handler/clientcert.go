@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"copilot-go/store"
+	"copilot-go/tlsutil"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientCertAPIKey returns the API key bound to the request's verified client
+// certificate, or "" if there is none. Pool bindings use the pool's first key,
+// so its per-key settings apply.
+func clientCertAPIKey(c *gin.Context) string {
+	tlsState := c.Request.TLS
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 {
+		return ""
+	}
+	leaf := tlsState.VerifiedChains[0][0]
+	binding := store.MatchClientCert(tlsutil.Fingerprint(leaf), leaf.Subject.CommonName)
+	if binding == nil {
+		slog.DebugContext(c.Request.Context(), "client certificate has no binding", "cn", leaf.Subject.CommonName)
+		return ""
+	}
+	c.Set("clientCert", binding.ID)
+	if binding.ApiKey != "" {
+		return binding.ApiKey
+	}
+	pool, _ := store.GetPool(binding.PoolID)
+	if pool == nil || len(pool.ApiKeys) == 0 {
+		slog.WarnContext(c.Request.Context(), "client certificate is bound to a pool without API keys", "binding", binding.ID, "pool", binding.PoolID)
+		return ""
+	}
+	return pool.ApiKeys[0]
+}
+
+// clientCertView masks the bound API key for viewers.
+func clientCertView(c *gin.Context, cert store.ClientCert) store.ClientCert {
+	if hidesSecrets(c) {
+		cert.ApiKey = store.MaskApiKey(cert.ApiKey)
+	}
+	return cert
+}
+
+// --- Client certificate binding handlers ---
+
+func handleGetClientCerts(c *gin.Context) {
+	certs, err := store.ListClientCerts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	out := make([]store.ClientCert, len(certs))
+	for i, cert := range certs {
+		out[i] = clientCertView(c, cert)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// handleAddClientCert binds a certificate, given by fingerprint, common name
+// or as PEM, to an existing API key or pool.
+func handleAddClientCert(c *gin.Context) {
+	var body struct {
+		store.ClientCert
+		Certificate string `json:"certificate"` // PEM; its fingerprint is bound
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Certificate != "" {
+		block, _ := pem.Decode([]byte(body.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "certificate must be a PEM certificate"})
+			return
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid certificate: " + err.Error()})
+			return
+		}
+		body.Fingerprint = tlsutil.Fingerprint(cert)
+		if body.Name == "" {
+			body.Name = cert.Subject.CommonName
+		}
+	}
+	if body.Name == "" {
+		body.Name = body.CommonName
+	}
+	switch {
+	case body.ApiKey != "":
+		pool, _ := store.GetPoolByApiKey(body.ApiKey)
+		account, _ := store.GetAccountByApiKey(body.ApiKey)
+		if pool == nil && account == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "apiKey does not belong to an account or pool"})
+			return
+		}
+	case body.PoolID != "":
+		if pool, _ := store.GetPool(body.PoolID); pool == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+			return
+		}
+	}
+	cert, err := store.AddClientCert(body.ClientCert)
+	if errors.Is(err, store.ErrClientCertExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, "client_cert.create", "client_cert:"+cert.ID, nil, cert)
+	c.JSON(http.StatusCreated, cert)
+}
+
+func handleDeleteClientCert(c *gin.Context) {
+	id := c.Param("id")
+	cert, err := store.DeleteClientCert(id)
+	if errors.Is(err, store.ErrClientCertNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, "client_cert.delete", "client_cert:"+id, cert, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
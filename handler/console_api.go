@@ -1,24 +1,26 @@
 package handler
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"copilot-go/auth"
 	"copilot-go/config"
 	"copilot-go/instance"
+	"copilot-go/oidc"
 	"copilot-go/store"
 	"copilot-go/web"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 // RegisterConsoleAPI registers all Web Console management API routes.
@@ -37,7 +39,7 @@ func RegisterConsoleAPI(r *gin.Engine, proxyPort int) {
 		// Production: serve from embedded filesystem
 		distFS, err := fs.Sub(web.Dist, "dist")
 		if err != nil {
-			log.Printf("Warning: failed to access embedded web dist: %v", err)
+			slog.Error("failed to access embedded web dist", "err", err)
 		} else {
 			assetsFS, _ := fs.Sub(distFS, "assets")
 			r.StaticFS("/assets", http.FS(assetsFS))
@@ -59,22 +61,64 @@ func RegisterConsoleAPI(r *gin.Engine, proxyPort int) {
 	// Public endpoints
 	api.GET("/config", func(c *gin.Context) {
 		needsSetup, _ := store.IsSetupRequired()
+		managedBy, _ := gitopsOwner()
 		c.JSON(http.StatusOK, gin.H{
-			"proxyPort":  proxyPort,
-			"needsSetup": needsSetup,
+			"proxyPort":   proxyPort,
+			"proxySocket": proxySocket,
+			"needsSetup":  needsSetup,
+			"sso":         oidc.Enabled(),
+			"managedBy":   managedBy, // configuration file owning accounts, pools and model mappings
 		})
 	})
 
 	api.POST("/auth/setup", handleSetup)
 	api.POST("/auth/login", handleLogin)
+	api.POST("/auth/login/2fa", handleLoginTwoFactor)
+	api.GET("/auth/oidc/login", handleOIDCLogin)
+	api.GET("/auth/oidc/callback", handleOIDCCallback)
 
 	// Protected endpoints
 	protected := api.Group("")
-	protected.Use(adminAuthMiddleware())
+	protected.Use(adminAuthMiddleware(), rejectConfigOwned())
 
 	protected.GET("/auth/check", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"valid": true})
+		resp := gin.H{
+			"valid":    true,
+			"username": c.GetString(ctxAdminUser),
+			"role":     c.GetString(ctxAdminRole),
+		}
+		if needsEnrollment(c.GetString(ctxAdminUser)) {
+			resp["twoFactorEnrollmentRequired"] = true
+		}
+		if _, fromCookie := sessionToken(c); fromCookie {
+			resp["csrfToken"] = store.CSRFToken(c.GetString(ctxAdminToken))
+		}
+		c.JSON(http.StatusOK, resp)
 	})
+	protected.PUT("/auth/password", handleChangePassword)
+	protected.POST("/auth/logout", handleLogout)
+	protected.GET("/auth/sessions", handleListSessions)
+	protected.DELETE("/auth/sessions", handleRevokeOtherSessions)
+	protected.DELETE("/auth/sessions/:id", handleRevokeSession)
+
+	// Two-factor authentication
+	protected.GET("/auth/2fa", handleGetTwoFactor)
+	protected.POST("/auth/2fa/enroll", handleBeginTwoFactor)
+	protected.POST("/auth/2fa/confirm", handleConfirmTwoFactor)
+	protected.POST("/auth/2fa/recovery-codes", handleRegenerateRecoveryCodes)
+	protected.DELETE("/auth/2fa", handleDisableTwoFactor)
+	protected.GET("/security", handleGetSecurity)
+	protected.PUT("/security", handleUpdateSecurity)
+	protected.GET("/security/throttles", handleGetThrottles)
+	protected.DELETE("/security/throttles/:kind/:key", handleResetThrottle)
+
+	// Console users
+	protected.GET("/users", handleGetUsers)
+	protected.POST("/users", handleCreateUser)
+	protected.PUT("/users/:username", handleUpdateUser)
+	protected.DELETE("/users/:username", handleDeleteUser)
+	protected.POST("/users/:username/password", handleResetUserPassword)
+	protected.DELETE("/users/:username/2fa", handleResetUserTwoFactor)
 
 	// Account routes
 	protected.GET("/accounts", handleGetAccounts)
@@ -87,13 +131,33 @@ func RegisterConsoleAPI(r *gin.Engine, proxyPort int) {
 	protected.POST("/accounts/:id/start", handleStartAccount)
 	protected.POST("/accounts/:id/stop", handleStopAccount)
 	protected.GET("/accounts/:id/usage", handleGetAccountUsage)
+	protected.POST("/accounts/:id/circuit-breaker/reset", handleResetCircuitBreaker)
 
 	// Device flow auth
 	protected.POST("/auth/device-code", handleDeviceCode)
 	protected.GET("/auth/poll/:sessionId", handlePollSession)
 	protected.POST("/auth/complete", handleCompleteAuth)
 
-	// Pool config
+	// Pools
+	protected.GET("/pools", handleGetPools)
+	protected.POST("/pools", handleCreatePool)
+	protected.GET("/pools/:id", handleGetPoolByID)
+	protected.PUT("/pools/:id", handleUpdatePoolByID)
+	protected.DELETE("/pools/:id", handleDeletePool)
+	protected.POST("/pools/:id/keys", handleAddPoolKey)
+	protected.DELETE("/pools/:id/keys/:key", handleRevokePoolKey)
+	protected.POST("/pools/:id/regenerate-key", handleRegeneratePoolKeys)
+	protected.PUT("/pools/:id/keys/:key/hedging", handleSetPoolKeyHedging)
+	protected.DELETE("/pools/:id/keys/:key/hedging", handleDeletePoolKeyHedging)
+	protected.PUT("/pools/:id/keys/:key/allowed-ips", handleSetPoolKeyAllowedIPs)
+	protected.DELETE("/pools/:id/keys/:key/allowed-ips", handleDeletePoolKeyAllowedIPs)
+
+	// Client certificates authenticating to the proxy
+	protected.GET("/client-certs", handleGetClientCerts)
+	protected.POST("/client-certs", handleAddClientCert)
+	protected.DELETE("/client-certs/:id", handleDeleteClientCert)
+
+	// Legacy single-pool config, backed by the default pool
 	protected.GET("/pool", handleGetPool)
 	protected.PUT("/pool", handleUpdatePool)
 	protected.POST("/pool/regenerate-key", handleRegeneratePoolKey)
@@ -113,25 +177,116 @@ func RegisterConsoleAPI(r *gin.Engine, proxyPort int) {
 
 	// Proxy usage stats (from in-memory tracking)
 	protected.GET("/usage", handleGetProxyUsage)
+	protected.GET("/usage/hedging", handleGetHedgeStats)
+	protected.GET("/usage/query", handleQueryUsage)
 	protected.GET("/usage/:id", handleGetProxyAccountUsage)
 
+	// Cached Copilot premium quota
+	protected.GET("/quota", handleGetQuota)
+
+	// Per-account circuit breakers
+	protected.GET("/circuit-breakers", handleGetCircuitBreakers)
+
+	// Captured requests
+	protected.GET("/logs", handleListLogs)
+	protected.GET("/logs/:id", handleGetLog)
+	protected.GET("/captures/:id", handleGetCapture)
+	protected.POST("/captures/:id/replay", handleReplayCapture(proxyPort))
+
+	// Audit trail of console actions
+	protected.GET("/audit", handleListAudit)
+
 	// Claude Code command generator
 	protected.POST("/claude-code-command", handleClaudeCodeCommand(proxyPort))
 }
 
+// Gin context keys set by adminAuthMiddleware.
+const (
+	ctxAdminUser    = "adminUser"
+	ctxAdminRole    = "adminRole"
+	ctxAdminSession = "adminSession"
+	ctxAdminToken   = "adminToken"
+)
+
+// routeRoles lists the routes whose required role differs from the default:
+// viewer for GET and admin for everything else.
+var routeRoles = map[string]string{
+	"PUT /api/auth/password":            store.RoleViewer,
+	"POST /api/auth/logout":             store.RoleViewer,
+	"DELETE /api/auth/sessions":         store.RoleViewer,
+	"DELETE /api/auth/sessions/:id":     store.RoleViewer,
+	"POST /api/auth/2fa/enroll":         store.RoleViewer,
+	"POST /api/auth/2fa/confirm":        store.RoleViewer,
+	"POST /api/auth/2fa/recovery-codes": store.RoleViewer,
+	"DELETE /api/auth/2fa":              store.RoleViewer,
+
+	"POST /api/accounts/:id/start":                 store.RoleOperator,
+	"POST /api/accounts/:id/stop":                  store.RoleOperator,
+	"POST /api/accounts/:id/regenerate-key":        store.RoleOperator,
+	"POST /api/accounts/:id/circuit-breaker/reset": store.RoleOperator,
+	"POST /api/pools/:id/keys":                     store.RoleOperator,
+	"DELETE /api/pools/:id/keys/:key":              store.RoleOperator,
+	"POST /api/pools/:id/regenerate-key":           store.RoleOperator,
+	"PUT /api/pools/:id/keys/:key/hedging":         store.RoleOperator,
+	"DELETE /api/pools/:id/keys/:key/hedging":      store.RoleOperator,
+	"PUT /api/pools/:id/keys/:key/allowed-ips":     store.RoleOperator,
+	"DELETE /api/pools/:id/keys/:key/allowed-ips":  store.RoleOperator,
+	"POST /api/pool/regenerate-key":                store.RoleOperator,
+	"POST /api/claude-code-command":                store.RoleOperator,
+
+	// Captured bodies may hold prompts and other sensitive content.
+	"GET /api/logs":                 store.RoleOperator,
+	"GET /api/logs/:id":             store.RoleOperator,
+	"GET /api/captures/:id":         store.RoleOperator,
+	"POST /api/captures/:id/replay": store.RoleOperator,
+	"GET /api/auth/poll/:sessionId": store.RoleAdmin, // returns the new GitHub token
+	"GET /api/users":                store.RoleAdmin,
+	"GET /api/audit":                store.RoleAdmin,
+	"GET /api/security":             store.RoleAdmin,
+	"GET /api/security/throttles":   store.RoleAdmin,
+}
+
+// requiredRole returns the least role allowed to call a route.
+func requiredRole(method, route string) string {
+	if role, ok := routeRoles[method+" "+route]; ok {
+		return role
+	}
+	if method == http.MethodGet {
+		return store.RoleViewer
+	}
+	return store.RoleAdmin
+}
+
 func adminAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		token, fromCookie := sessionToken(c)
+		if token == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing authorization header"})
 			return
 		}
 
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if !store.ValidateSession(token) {
+		session := store.LookupSession(token)
+		if session == nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired session"})
 			return
 		}
+		if fromCookie && !validCSRF(c, token) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing or invalid " + csrfHeader + " header"})
+			return
+		}
+		c.Set(ctxAdminUser, session.Username)
+		c.Set(ctxAdminRole, session.Role)
+		c.Set(ctxAdminSession, session.ID)
+		c.Set(ctxAdminToken, token)
+
+		if need := requiredRole(c.Request.Method, c.FullPath()); !store.RoleAtLeast(session.Role, need) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("requires the %s role", need)})
+			return
+		}
+		if !enrollmentRoutes[c.Request.Method+" "+c.FullPath()] && needsEnrollment(session.Username) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "two-factor enrollment required"})
+			return
+		}
 		c.Next()
 	}
 }
@@ -142,49 +297,87 @@ func handleSetup(c *gin.Context) {
 	var body struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"` // use a session cookie instead of a bearer token
 	}
 	if err := c.ShouldBindJSON(&body); err != nil || body.Password == "" || body.Username == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
 		return
 	}
 
+	done, ok := beginLogin(c, body.Username)
+	if !ok {
+		return
+	}
+	defer done()
 	needsSetup, _ := store.IsSetupRequired()
 	if !needsSetup {
+		loginFailed(c, body.Username)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "admin already configured"})
 		return
 	}
 
 	if err := store.SetupAdmin(body.Username, body.Password); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	token, err := store.LoginAdmin(body.Username, body.Password)
+	token, err := store.LoginAdmin(body.Username, body.Password, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	c.Set(ctxAdminUser, body.Username)
+	c.Set(ctxAdminSession, store.SessionID(token))
+	recordAudit(c, "auth.setup", "user:"+body.Username, nil, nil)
+	respondLogin(c, token, body.Cookie)
 }
 
 func handleLogin(c *gin.Context) {
 	var body struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"` // use a session cookie instead of a bearer token
 	}
 	if err := c.ShouldBindJSON(&body); err != nil || body.Password == "" || body.Username == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
 		return
 	}
 
-	token, err := store.LoginAdmin(body.Username, body.Password)
+	c.Set(ctxAdminUser, body.Username)
+	done, ok := beginLogin(c, body.Username)
+	if !ok {
+		return
+	}
+	defer done()
+	user, err := store.VerifyPassword(body.Username, body.Password)
 	if err != nil {
+		loginFailed(c, body.Username)
+		recordAudit(c, "auth.login_failed", "user:"+body.Username, nil, nil)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	// With 2FA on, the session is only created by handleLoginTwoFactor.
+	if user.TwoFactor {
+		challenge, err := store.NewLoginChallenge(user.Username, body.Cookie)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "challenge": challenge})
+		return
+	}
+
+	token, err := store.CreateSession(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	loginSucceeded(body.Username)
+	c.Set(ctxAdminSession, store.SessionID(token))
+	recordAudit(c, "auth.login", "user:"+body.Username, nil, nil)
+	respondLogin(c, token, body.Cookie)
 }
 
 // --- Account handlers ---
@@ -198,16 +391,18 @@ func handleGetAccounts(c *gin.Context) {
 
 	type accountWithStatus struct {
 		store.Account
-		Status string `json:"status"`
-		Error  string `json:"error,omitempty"`
+		Status         string                          `json:"status"`
+		Error          string                          `json:"error,omitempty"`
+		CircuitBreaker instance.CircuitBreakerSnapshot `json:"circuitBreaker"`
 	}
 
 	var result []accountWithStatus
 	for _, a := range accounts {
 		aws := accountWithStatus{
-			Account: a,
-			Status:  instance.GetInstanceStatus(a.ID),
-			Error:   instance.GetInstanceError(a.ID),
+			Account:        accountView(c, a),
+			Status:         instance.GetInstanceStatus(a.ID),
+			Error:          instance.GetInstanceError(a.ID),
+			CircuitBreaker: instance.GetCircuitBreakerSnapshot(a.ID),
 		}
 		result = append(result, aws)
 	}
@@ -243,7 +438,7 @@ func handleGetAllUsage(c *gin.Context) {
 		}
 		// Only fetch usage for running instances
 		if status == "running" {
-			usage, err := fetchCopilotUsage(a.ID)
+			usage, err := instance.FetchCopilotUsage(a.ID)
 			if err == nil {
 				item.Usage = usage
 			}
@@ -268,7 +463,7 @@ func handleGetAccount(c *gin.Context) {
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
-		"account": account,
+		"account": accountView(c, *account),
 		"status":  instance.GetInstanceStatus(id),
 		"error":   instance.GetInstanceError(id),
 	})
@@ -293,6 +488,7 @@ func handleAddAccount(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "account.create", "account:"+account.ID, nil, account)
 	c.JSON(http.StatusCreated, account)
 }
 
@@ -303,7 +499,23 @@ func handleUpdateAccount(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	if v, ok := updates["allowedIPs"]; ok {
+		allowed, ok := v.([]interface{})
+		if !ok && v != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "allowedIPs must be a list"})
+			return
+		}
+		entries := make([]string, 0, len(allowed))
+		for _, a := range allowed {
+			s, _ := a.(string)
+			entries = append(entries, s)
+		}
+		if !validateAllowedIPs(c, entries) {
+			return
+		}
+	}
 
+	before, _ := store.GetAccount(id)
 	account, err := store.UpdateAccount(id, updates)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -313,26 +525,35 @@ func handleUpdateAccount(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
 		return
 	}
+	recordAudit(c, "account.update", "account:"+id, before, account)
 	c.JSON(http.StatusOK, account)
 }
 
 func handleDeleteAccount(c *gin.Context) {
 	id := c.Param("id")
+	before, _ := store.GetAccount(id)
 	instance.StopInstance(id)
 	if err := store.DeleteAccount(id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "account.delete", "account:"+id, before, nil)
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func handleRegenerateKey(c *gin.Context) {
 	id := c.Param("id")
+	before, _ := store.GetAccount(id)
 	newKey, err := store.RegenerateApiKey(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	var oldKey string
+	if before != nil {
+		oldKey = before.ApiKey
+	}
+	recordAudit(c, "account.regenerate_key", "account:"+id, gin.H{"apiKey": oldKey}, gin.H{"apiKey": newKey})
 	c.JSON(http.StatusOK, gin.H{"apiKey": newKey})
 }
 
@@ -348,12 +569,14 @@ func handleStartAccount(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "account.start", "account:"+id, nil, nil)
 	c.JSON(http.StatusOK, gin.H{"status": "running"})
 }
 
 func handleStopAccount(c *gin.Context) {
 	id := c.Param("id")
 	instance.StopInstance(id)
+	recordAudit(c, "account.stop", "account:"+id, nil, nil)
 	c.JSON(http.StatusOK, gin.H{"status": "stopped"})
 }
 
@@ -367,6 +590,13 @@ func handleGetAccountUsage(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+func handleResetCircuitBreaker(c *gin.Context) {
+	id := c.Param("id")
+	instance.ResetCircuitBreaker(id)
+	recordAudit(c, "account.reset_circuit_breaker", "account:"+id, nil, nil)
+	c.JSON(http.StatusOK, instance.GetCircuitBreakerSnapshot(id))
+}
+
 // --- Device flow handlers ---
 
 func handleDeviceCode(c *gin.Context) {
@@ -432,86 +662,304 @@ func handleCompleteAuth(c *gin.Context) {
 	}
 
 	auth.CleanupSession(body.SessionID)
+	recordAudit(c, "account.create", "account:"+account.ID, nil, account)
 	c.JSON(http.StatusCreated, account)
 }
 
 // --- Pool handlers ---
 
-func handleGetPool(c *gin.Context) {
-	cfg, err := store.GetPoolConfig()
+func handleGetPools(c *gin.Context) {
+	pools, err := store.GetPools()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, cfg)
+	for i := range pools {
+		pools[i] = poolView(c, pools[i])
+	}
+	c.JSON(http.StatusOK, pools)
 }
 
-func handleUpdatePool(c *gin.Context) {
+func handleGetPoolByID(c *gin.Context) {
+	pool, err := store.GetPool(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	c.JSON(http.StatusOK, poolView(c, *pool))
+}
+
+func handleCreatePool(c *gin.Context) {
+	var body struct {
+		ID               string   `json:"id"`
+		Name             string   `json:"name" binding:"required"`
+		Enabled          bool     `json:"enabled"`
+		Strategy         string   `json:"strategy"`
+		Members          []string `json:"members"`
+		Models           []string `json:"models"`
+		RateLimitRPM     int      `json:"rateLimitRPM"`
+		Sticky           bool     `json:"sticky"`
+		StickyTTLMinutes int      `json:"stickyTTLMinutes"`
+		StreamFailover   string   `json:"streamFailover"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if !store.ValidStrategy(body.Strategy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalidStrategyMessage()})
+		return
+	}
+	if !validStreamFailover(body.StreamFailover) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "streamFailover must be empty, \"retry\" or \"continue\""})
+		return
+	}
+
+	pool, err := store.CreatePool(store.Pool{
+		ID:               body.ID,
+		Name:             body.Name,
+		Enabled:          body.Enabled,
+		Strategy:         body.Strategy,
+		Members:          body.Members,
+		Models:           body.Models,
+		RateLimitRPM:     body.RateLimitRPM,
+		Sticky:           body.Sticky,
+		StickyTTLMinutes: body.StickyTTLMinutes,
+		StreamFailover:   body.StreamFailover,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	instance.SetPoolRPM(pool.ID, pool.RateLimitRPM)
+	recordAudit(c, "pool.create", "pool:"+pool.ID, nil, pool)
+	c.JSON(http.StatusCreated, pool)
+}
+
+func handleUpdatePoolByID(c *gin.Context) {
 	var updates map[string]interface{}
 	if err := c.ShouldBindJSON(&updates); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
-
-	// Read existing config first, then merge updates
-	existing, err := store.GetPoolConfig()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	pool, ok := updatePool(c, c.Param("id"), updates)
+	if !ok {
 		return
 	}
+	c.JSON(http.StatusOK, pool)
+}
 
-	if v, ok := updates["enabled"]; ok {
-		if b, ok := v.(bool); ok {
-			existing.Enabled = b
-		}
+// updatePool applies updates to a pool and syncs the in-memory rate limiter and
+// sticky sessions. Returns false if an error response was written.
+func updatePool(c *gin.Context, id string, updates map[string]interface{}) (*store.Pool, bool) {
+	if v, ok := updates["strategy"].(string); ok && !store.ValidStrategy(v) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalidStrategyMessage()})
+		return nil, false
 	}
-	if v, ok := updates["strategy"]; ok {
-		if s, ok := v.(string); ok && s != "" {
-			existing.Strategy = s
-		}
+	if v, ok := updates["streamFailover"].(string); ok && !validStreamFailover(v) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "streamFailover must be empty, \"retry\" or \"continue\""})
+		return nil, false
 	}
-	if v, ok := updates["rateLimitRPM"]; ok {
-		switch rv := v.(type) {
-		case float64:
-			existing.RateLimitRPM = int(rv)
-		case int:
-			existing.RateLimitRPM = rv
-		}
+	before, _ := store.GetPool(id)
+	pool, err := store.UpdatePool(id, updates)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
 	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return nil, false
+	}
+	recordAudit(c, "pool.update", "pool:"+id, before, pool)
 
-	// Generate a key if pool is being enabled and has no key yet
-	if existing.Enabled && existing.ApiKey == "" {
-		existing.ApiKey = "sk-pool-" + uuid.New().String()
+	// Sync per-account rate limiter.
+	instance.SetPoolRPM(pool.ID, pool.RateLimitRPM)
+
+	// Drop pinned sessions so a strategy or membership change takes effect immediately.
+	instance.ClearStickySessions()
+
+	return pool, true
+}
+
+func invalidStrategyMessage() string {
+	return "strategy must be one of " + strings.Join(store.Strategies, ", ")
+}
+
+func validStreamFailover(mode string) bool {
+	switch mode {
+	case store.StreamFailoverOff, store.StreamFailoverRetry, store.StreamFailoverContinue:
+		return true
 	}
+	return false
+}
 
-	if existing.Strategy == "" {
-		existing.Strategy = "round-robin"
+func handleDeletePool(c *gin.Context) {
+	id := c.Param("id")
+	if id == store.DefaultPoolID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the default pool cannot be deleted"})
+		return
 	}
+	before, _ := store.GetPool(id)
+	if err := store.DeletePool(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	instance.SetPoolRPM(id, 0)
+	recordAudit(c, "pool.delete", "pool:"+id, before, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
 
-	if err := store.UpdatePoolConfig(existing); err != nil {
+func handleAddPoolKey(c *gin.Context) {
+	id := c.Param("id")
+	key, err := store.AddPoolApiKey(id)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if key == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	recordAudit(c, "pool.add_key", "pool:"+id, nil, gin.H{"apiKey": key})
+	c.JSON(http.StatusCreated, gin.H{"apiKey": key})
+}
 
-	// Sync per-account rate limiter.
-	instance.SetPerAccountRPM(existing.RateLimitRPM)
+func handleRevokePoolKey(c *gin.Context) {
+	id := c.Param("id")
+	before, _ := store.GetPool(id)
+	pool, err := store.RevokePoolApiKey(id, c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	recordAudit(c, "pool.revoke_key", "pool:"+id, before, pool)
+	c.JSON(http.StatusOK, pool)
+}
 
-	c.JSON(http.StatusOK, existing)
+func handleRegeneratePoolKeys(c *gin.Context) {
+	pool, ok := regeneratePoolKeys(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, pool)
 }
 
-func handleRegeneratePoolKey(c *gin.Context) {
-	_, err := store.RegeneratePoolApiKey()
+// regeneratePoolKeys replaces a pool's API keys. Returns false if an error
+// response was written.
+func regeneratePoolKeys(c *gin.Context, id string) (*store.Pool, bool) {
+	before, _ := store.GetPool(id)
+	pool, err := store.RegeneratePoolApiKeys(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return nil, false
+	}
+	recordAudit(c, "pool.regenerate_keys", "pool:"+id, before, pool)
+	return pool, true
+}
+
+func handleSetPoolKeyHedging(c *gin.Context) {
+	var policy store.HedgePolicy
+	if err := c.ShouldBindJSON(&policy); err != nil || policy.ThresholdMs <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "thresholdMs must be a positive number"})
 		return
 	}
-	// Return the full config so frontend gets the complete PoolConfig object
-	cfg, err := store.GetPoolConfig()
+	setPoolKeyHedging(c, &policy)
+}
+
+func handleDeletePoolKeyHedging(c *gin.Context) {
+	setPoolKeyHedging(c, nil)
+}
+
+func setPoolKeyHedging(c *gin.Context, policy *store.HedgePolicy) {
+	id := c.Param("id")
+	before, _ := store.GetPool(id)
+	pool, err := store.SetPoolKeyHedging(id, c.Param("key"), policy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	action := "pool.set_hedging"
+	if policy == nil {
+		action = "pool.delete_hedging"
+	}
+	recordAudit(c, action, "pool:"+id, before, pool)
+	c.JSON(http.StatusOK, pool)
+}
+
+// --- Legacy single-pool handlers (operate on the default pool) ---
+
+// legacyPoolConfig renders the default pool in the pre-named-pools shape
+// expected by existing clients of /api/pool.
+func legacyPoolConfig(p *store.Pool) gin.H {
+	apiKey := ""
+	if len(p.ApiKeys) > 0 {
+		apiKey = p.ApiKeys[0]
+	}
+	return gin.H{
+		"enabled":          p.Enabled,
+		"strategy":         p.Strategy,
+		"apiKey":           apiKey,
+		"rateLimitRPM":     p.RateLimitRPM,
+		"sticky":           p.Sticky,
+		"stickyTTLMinutes": p.StickyTTLMinutes,
+		"streamFailover":   p.StreamFailover,
+	}
+}
+
+func handleGetPool(c *gin.Context) {
+	pool, err := store.GetPool(store.DefaultPoolID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, cfg)
+	if pool == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pool not found"})
+		return
+	}
+	view := poolView(c, *pool)
+	c.JSON(http.StatusOK, legacyPoolConfig(&view))
+}
+
+func handleUpdatePool(c *gin.Context) {
+	var updates map[string]interface{}
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	// Membership, allowlists and keys are managed through /api/pools.
+	delete(updates, "members")
+	delete(updates, "models")
+	delete(updates, "name")
+
+	pool, ok := updatePool(c, store.DefaultPoolID, updates)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, legacyPoolConfig(pool))
+}
+
+func handleRegeneratePoolKey(c *gin.Context) {
+	pool, ok := regeneratePoolKeys(c, store.DefaultPoolID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, legacyPoolConfig(pool))
 }
 
 // --- Model map handlers ---
@@ -533,10 +981,12 @@ func handleSetModelMap(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	before, _ := store.GetModelMappings()
 	if err := store.SetModelMappings(body.Mappings); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "model_map.replace", "model_map", gin.H{"mappings": before}, gin.H{"mappings": body.Mappings})
 	c.JSON(http.StatusOK, gin.H{"mappings": body.Mappings})
 }
 
@@ -546,22 +996,37 @@ func handleAddModelMapping(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	before := findModelMapping(mapping.CopilotID)
 	if err := store.AddModelMapping(mapping); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "model_map.add", "model_map:"+mapping.CopilotID, before, mapping)
 	c.JSON(http.StatusCreated, mapping)
 }
 
 func handleDeleteModelMapping(c *gin.Context) {
 	copilotID := c.Param("copilotId")
+	before := findModelMapping(copilotID)
 	if err := store.DeleteModelMapping(copilotID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "model_map.delete", "model_map:"+copilotID, before, nil)
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+// findModelMapping returns the mapping for copilotID, or nil.
+func findModelMapping(copilotID string) *store.ModelMapping {
+	mappings, _ := store.GetModelMappings()
+	for i := range mappings {
+		if mappings[i].CopilotID == copilotID {
+			return &mappings[i]
+		}
+	}
+	return nil
+}
+
 // --- Copilot models handler ---
 
 func handleGetCopilotModels(c *gin.Context) {
@@ -624,7 +1089,7 @@ func handleGetProxyConfig(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, cfg)
+	c.JSON(http.StatusOK, proxyConfigView(c, cfg))
 }
 
 func handleUpdateProxyConfig(c *gin.Context) {
@@ -639,10 +1104,12 @@ func handleUpdateProxyConfig(c *gin.Context) {
 			return
 		}
 	}
+	before, _ := store.GetProxyConfig()
 	if err := store.UpdateProxyConfig(cfg); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(c, "proxy_config.update", "proxy_config", before, cfg)
 	config.SetProxyURL(cfg.ProxyURL)
 	instance.RebuildHTTPClients()
 	c.JSON(http.StatusOK, cfg)
@@ -661,6 +1128,130 @@ func handleGetProxyAccountUsage(c *gin.Context) {
 	c.JSON(http.StatusOK, snapshot)
 }
 
+func handleGetHedgeStats(c *gin.Context) {
+	c.JSON(http.StatusOK, instance.GetHedgeStats())
+}
+
+// handleQueryUsage aggregates persisted usage history.
+// Query params: from, to (RFC3339, default last 24h), groupBy (comma-separated
+// dimensions), interval (hour|day), and any dimension name as an exact filter.
+func handleQueryUsage(c *gin.Context) {
+	now := time.Now()
+	q := store.UsageQuery{
+		From:     now.Add(-24 * time.Hour),
+		To:       now,
+		Interval: c.Query("interval"),
+		Filters:  make(map[string]string),
+	}
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC3339 timestamp", param)})
+				return
+			}
+			*dst = t
+		}
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if v := c.Query("groupBy"); v != "" {
+		q.GroupBy = strings.Split(v, ",")
+	}
+	for _, dim := range store.UsageDimensions {
+		if v, ok := c.GetQuery(dim); ok {
+			q.Filters[dim] = v
+		}
+	}
+
+	rows, err := store.QueryUsage(q)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"from": q.From.UTC().Format(time.RFC3339),
+		"to":   q.To.UTC().Format(time.RFC3339),
+		"rows": rows,
+	})
+}
+
+// --- Quota handlers ---
+
+func handleGetQuota(c *gin.Context) {
+	accounts, err := store.GetEnabledAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	type accountQuotaItem struct {
+		AccountID string                 `json:"accountId"`
+		Name      string                 `json:"name"`
+		Status    string                 `json:"status"`
+		Quota     *instance.AccountQuota `json:"quota"`
+	}
+
+	ids := make([]string, 0, len(accounts))
+	result := make([]accountQuotaItem, 0, len(accounts))
+	for _, a := range accounts {
+		ids = append(ids, a.ID)
+		result = append(result, accountQuotaItem{
+			AccountID: a.ID,
+			Name:      a.Name,
+			Status:    instance.GetInstanceStatus(a.ID),
+			Quota:     instance.GetAccountQuota(a.ID),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": result,
+		"pool":     instance.GetPoolQuotaSummary(ids),
+	})
+}
+
+// --- Circuit breaker handlers ---
+
+func handleGetCircuitBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, instance.GetAllCircuitBreakerSnapshots())
+}
+
+// proxyBind and proxyTLS describe the proxy listener, see SetProxyBind and
+// SetProxyTLS.
+var (
+	proxyBind   string
+	proxyTLS    bool
+	proxyCAFile string
+)
+
+// SetProxyBind records the address the proxy listens on, so the console
+// reaches it there for replays and in generated commands.
+func SetProxyBind(bind string) {
+	proxyBind = bind
+}
+
+// SetProxyTLS records that the proxy serves HTTPS. caFile is the self-signed
+// certificate clients must trust, or "" for a certificate from a known CA.
+func SetProxyTLS(enabled bool, caFile string) {
+	proxyTLS, proxyCAFile = enabled, caFile
+}
+
+// LocalProxyURL returns the base URL for reaching a proxy on this machine
+// that listens on bind and port. A wildcard bind is reached via loopback.
+func LocalProxyURL(bind string, port int, secure bool) string {
+	host := bind
+	if ip := net.ParseIP(bind); bind == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // --- Claude Code command generator ---
 
 func handleClaudeCodeCommand(proxyPort int) gin.HandlerFunc {
@@ -675,7 +1266,6 @@ func handleClaudeCodeCommand(proxyPort int) gin.HandlerFunc {
 			return
 		}
 
-		baseURL := fmt.Sprintf("http://127.0.0.1:%d", proxyPort)
 		model := body.Model
 		if model == "" {
 			model = "claude-sonnet-4"
@@ -685,6 +1275,30 @@ func handleClaudeCodeCommand(proxyPort int) gin.HandlerFunc {
 			smallModel = model
 		}
 
+		// Claude Code only speaks TCP; socket clients get a curl example,
+		// without the key when the socket authenticates by permissions.
+		resp := gin.H{}
+		if proxySocket != "" {
+			auth := ""
+			if proxySocketAuth == "" {
+				auth = fmt.Sprintf(` \`+"\n"+`  -H "x-api-key: %s"`, body.ApiKey)
+			}
+			resp["socket"] = proxySocket
+			resp["curl"] = fmt.Sprintf(
+				`curl --unix-socket %s http://localhost/v1/messages`+auth+` \`+"\n"+
+					`  -H "content-type: application/json" \`+"\n"+
+					`  -d '{"model":"%s","max_tokens":1024,"messages":[{"role":"user","content":"Hello"}]}'`,
+				proxySocket, model,
+			)
+		}
+		if proxyPort == 0 {
+			resp["warning"] = "the proxy only listens on a Unix socket, which Claude Code cannot connect to"
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+
+		baseURL := LocalProxyURL(proxyBind, proxyPort, proxyTLS)
+
 		bash := fmt.Sprintf(
 			`ANTHROPIC_BASE_URL=%s \`+"\n"+
 				`ANTHROPIC_AUTH_TOKEN=%s \`+"\n"+
@@ -718,42 +1332,14 @@ func handleClaudeCodeCommand(proxyPort int) gin.HandlerFunc {
 			baseURL, body.ApiKey, model, smallModel,
 		)
 
-		c.JSON(http.StatusOK, gin.H{
-			"bash":       bash,
-			"powershell": powershell,
-			"cmd":        cmd,
-		})
-	}
-}
-
-// fetchCopilotUsage fetches usage/quota data for a running account from GitHub Copilot API.
-func fetchCopilotUsage(accountID string) (interface{}, error) {
-	state := instance.GetInstanceState(accountID)
-	if state == nil {
-		return nil, fmt.Errorf("instance not running")
-	}
-
-	req, err := http.NewRequest("GET", "https://api.github.com/copilot_internal/user", nil)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range config.GithubHeaders(state) {
-		req.Header[k] = v
-	}
-
-	resp, err := instance.GetDefaultHTTPClient().Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("copilot user API returned status %d", resp.StatusCode)
-	}
+		// Node does not trust a self-signed proxy certificate by default
+		if proxyCAFile != "" {
+			bash = fmt.Sprintf(`NODE_EXTRA_CA_CERTS=%s \`+"\n", proxyCAFile) + bash
+			powershell = fmt.Sprintf(`$env:NODE_EXTRA_CA_CERTS="%s"`+"\n", proxyCAFile) + powershell
+			cmd = fmt.Sprintf(`set NODE_EXTRA_CA_CERTS=%s`+"\n", proxyCAFile) + cmd
+		}
 
-	var usage interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
-		return nil, err
+		resp["bash"], resp["powershell"], resp["cmd"] = bash, powershell, cmd
+		c.JSON(http.StatusOK, resp)
 	}
-	return usage, nil
 }
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"copilot-go/audit"
+	"copilot-go/configfile"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// In GitOps mode, the configuration file owns the accounts, pools, API keys
+// and model mappings, and the proxy URL if it declares one.
+var (
+	gitopsMu    sync.RWMutex
+	gitopsFile  string // "" = the console owns everything
+	gitopsProxy bool
+)
+
+// configOwnedRoutes maps the console routes that change objects owned by the
+// configuration file to what they change. Hedging policies, per-key IP
+// restrictions and client certificates stay editable in the console.
+var configOwnedRoutes = map[string]string{
+	"POST /api/accounts":                    "accounts are",
+	"PUT /api/accounts/:id":                 "accounts are",
+	"DELETE /api/accounts/:id":              "accounts are",
+	"POST /api/accounts/:id/regenerate-key": "accounts are",
+	"POST /api/auth/device-code":            "accounts are",
+	"POST /api/auth/complete":               "accounts are",
+	"POST /api/pools":                       "pools are",
+	"PUT /api/pools/:id":                    "pools are",
+	"DELETE /api/pools/:id":                 "pools are",
+	"POST /api/pools/:id/keys":              "pool API keys are",
+	"DELETE /api/pools/:id/keys/:key":       "pool API keys are",
+	"POST /api/pools/:id/regenerate-key":    "pool API keys are",
+	"PUT /api/pool":                         "pools are",
+	"POST /api/pool/regenerate-key":         "pool API keys are",
+	"PUT /api/model-map":                    "model mappings are",
+	"POST /api/model-map":                   "model mappings are",
+	"DELETE /api/model-map/:copilotId":      "model mappings are",
+	"PUT /api/proxy-config":                 "the proxy URL is",
+}
+
+// SetGitOps makes the objects owned by the configuration file read-only in
+// the console; proxyOwned adds the proxy URL. An empty file turns it off.
+func SetGitOps(file string, proxyOwned bool) {
+	gitopsMu.Lock()
+	gitopsFile, gitopsProxy = file, proxyOwned
+	gitopsMu.Unlock()
+}
+
+func gitopsOwner() (file string, proxyOwned bool) {
+	gitopsMu.RLock()
+	defer gitopsMu.RUnlock()
+	return gitopsFile, gitopsProxy
+}
+
+// rejectConfigOwned answers 409 to requests that would change objects owned
+// by the configuration file.
+func rejectConfigOwned() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		what, ok := configOwnedRoutes[c.Request.Method+" "+c.FullPath()]
+		file, proxyOwned := gitopsOwner()
+		if !ok || file == "" || (c.FullPath() == "/api/proxy-config" && !proxyOwned) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error":     what + " managed by the configuration file " + file + "; change it there and it is reloaded automatically",
+			"managedBy": file,
+		})
+	}
+}
+
+// RecordConfigChange appends an audit entry for a change made by applying
+// the configuration file, with the same action names as the console.
+func RecordConfigChange(ch configfile.Change) {
+	target := ch.Kind
+	if ch.ID != "" {
+		target += ":" + ch.ID
+	}
+	e := store.AuditEntry{
+		Actor:   "config",
+		Action:  ch.Kind + "." + ch.Action,
+		Target:  target,
+		Changes: auditChanges(ch.Before, ch.After),
+	}
+	if err := audit.Record(e); err != nil {
+		slog.Error("failed to record audit entry", "action", e.Action, "target", target, "err", err)
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"copilot-go/instance"
+	"copilot-go/store"
+	"copilot-go/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hedgePolicy returns the hedge policy of the pool key used for the request,
+// or nil if the request should not be hedged.
+func hedgePolicy(c *gin.Context) *store.HedgePolicy {
+	pool := requestPool(c)
+	if pool == nil {
+		return nil
+	}
+	return pool.HedgePolicyFor(c.GetString("apiKey"))
+}
+
+// upstreamResult is the outcome of one upstream request in a hedge race.
+type upstreamResult struct {
+	resolved *resolvedAccount
+	resp     *http.Response
+	err      error
+	cancel   context.CancelFunc
+}
+
+// cancelOnClose cancels the request context of a winning response once its body is closed.
+type cancelOnClose struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// startUpstream runs call in the background with a cancelable child of ctx.
+// A successful response is reported once its first body byte has arrived.
+func startUpstream(ctx context.Context, resolved *resolvedAccount, call upstreamCall, results chan<- upstreamResult) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		resp, err := call(ctx, resolved)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			awaitFirstByte(resp)
+		}
+		results <- upstreamResult{resolved: resolved, resp: resp, err: err, cancel: cancel}
+	}()
+	return cancel
+}
+
+// awaitFirstByte blocks until the first body chunk arrives and puts it back in front of the body.
+func awaitFirstByte(resp *http.Response) {
+	buf := make([]byte, 4096)
+	var n int
+	var err error
+	for n == 0 && err == nil {
+		n, err = resp.Body.Read(buf)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf[:n]), resp.Body), resp.Body}
+}
+
+// hedgedCall runs call against primary and, if nothing arrives within the
+// policy threshold, against a second pool account as well. The first usable
+// response wins and the other request is cancelled through its context.
+// Failed results are recorded and excluded here unless they are returned.
+func hedgedCall(ctx context.Context, c *gin.Context, policy *store.HedgePolicy, exclude map[string]bool, primary *resolvedAccount, call upstreamCall) (*resolvedAccount, *http.Response, error) {
+	poolID := c.GetString("poolID")
+	instance.RecordHedgeEligible(poolID)
+
+	results := make(chan upstreamResult, 2)
+	cancels := map[string]context.CancelFunc{
+		primary.AccountID: startUpstream(ctx, primary, call, results),
+	}
+	pending := 1
+	hedgeAccountID := ""
+
+	timer := time.NewTimer(time.Duration(policy.ThresholdMs) * time.Millisecond)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			hedge := pickHedgeAccount(c, exclude, primary.AccountID)
+			if hedge == nil || !instance.AllowHedge(poolID, c.GetString("apiKey"), policy.MaxPerMinute) {
+				continue
+			}
+			if allowed, _ := instance.CheckRateLimit(poolID, hedge.AccountID); !allowed {
+				continue
+			}
+			instance.RecordRequest(hedge.AccountID, false, false)
+			instance.AcquireBreaker(hedge.AccountID)
+			instance.RecordHedgeSent(poolID, hedge.AccountID)
+			slog.InfoContext(ctx, "no response yet, hedging to another account", "account", primary.AccountID, "threshold_ms", policy.ThresholdMs, "hedge_account", hedge.AccountID)
+			tracing.SpanFromContext(ctx).AddEvent("hedge", tracing.String("copilot.account_id", hedge.AccountID))
+			cancels[hedge.AccountID] = startUpstream(ctx, hedge, call, results)
+			hedgeAccountID = hedge.AccountID
+			pending++
+
+		case r := <-results:
+			pending--
+			usable := r.err == nil && !isRetryableStatus(r.resp.StatusCode)
+			if !usable && pending > 0 {
+				// The other request may still succeed; account for this one and keep waiting.
+				instance.RecordUpstreamResult(r.resolved.AccountID, r.resp, r.err)
+				is429 := r.resp != nil && r.resp.StatusCode == http.StatusTooManyRequests
+				instance.RecordRequest(r.resolved.AccountID, true, is429)
+				if r.resp != nil {
+					_ = r.resp.Body.Close()
+				}
+				r.cancel()
+				exclude[r.resolved.AccountID] = true
+				continue
+			}
+
+			if pending > 0 {
+				loserID := primary.AccountID
+				if r.resolved.AccountID == primary.AccountID {
+					loserID = hedgeAccountID
+				}
+				cancels[loserID]()
+				go drainLoser(results, poolID, loserID)
+			}
+			if usable && r.resolved.AccountID == hedgeAccountID {
+				instance.RecordHedgeWin(poolID)
+			}
+
+			if r.err != nil {
+				r.cancel()
+				return r.resolved, nil, r.err
+			}
+			r.resp.Body = &cancelOnClose{Reader: r.resp.Body, body: r.resp.Body, cancel: r.cancel}
+			return r.resolved, r.resp, nil
+		}
+	}
+}
+
+// drainLoser releases the cancelled request of a hedge race and counts it as wasted.
+func drainLoser(results <-chan upstreamResult, poolID, accountID string) {
+	r := <-results
+	if r.resp != nil {
+		_ = r.resp.Body.Close()
+	}
+	r.cancel()
+	instance.ReleaseBreaker(accountID)
+	instance.RecordWastedRequest(poolID, accountID)
+}
+
+// pickHedgeAccount selects a second pool account for a hedge. Sticky routing is
+// bypassed so the hedge does not re-pin the conversation.
+func pickHedgeAccount(c *gin.Context, exclude map[string]bool, primaryID string) *resolvedAccount {
+	skip := map[string]bool{primaryID: true}
+	for id := range exclude {
+		skip[id] = true
+	}
+	account, err := instance.SelectAccount(instance.SelectOptions{
+		Pool:    requestPool(c),
+		Exclude: skip,
+		Model:   c.GetString("requestModel"),
+	})
+	if err != nil || account == nil {
+		return nil
+	}
+	state := instance.GetInstanceState(account.ID)
+	if state == nil {
+		return nil
+	}
+	return &resolvedAccount{State: state, AccountID: account.ID}
+}
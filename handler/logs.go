@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"copilot-go/anthropic"
+	"copilot-go/instance"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxLogsLimit = 1000
+
+// logDetail is a capture with its streams reassembled and, for Anthropic
+// requests, the translation laid out side by side.
+type logDetail struct {
+	*store.Capture
+	// ReassembledResponse is the client response rebuilt from its stream.
+	ReassembledResponse json.RawMessage `json:"reassembledResponse,omitempty"`
+	// ReassembledUpstream holds each upstream response rebuilt from its stream,
+	// aligned with Capture.Upstream.
+	ReassembledUpstream []json.RawMessage `json:"reassembledUpstream,omitempty"`
+	Translation         *logTranslation   `json:"translation,omitempty"`
+}
+
+// logTranslation pairs the Anthropic request/response seen by the client with
+// the OpenAI request/response exchanged with Copilot.
+type logTranslation struct {
+	Anthropic translationSide `json:"anthropic"`
+	OpenAI    translationSide `json:"openai"`
+	// Retranslated is set when no upstream request was captured and the OpenAI
+	// request was produced by translating the captured request again.
+	Retranslated bool `json:"retranslated,omitempty"`
+}
+
+type translationSide struct {
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// handleListLogs lists captured requests, newest first.
+// Query params: from, to (RFC3339), key, account, pool, model, endpoint,
+// status (code, 4xx/5xx class or "error") and limit (default 100).
+func handleListLogs(c *gin.Context) {
+	q := store.CaptureQuery{
+		ApiKey:    c.Query("key"),
+		AccountID: c.Query("account"),
+		PoolID:    c.Query("pool"),
+		Model:     c.Query("model"),
+		Endpoint:  c.Query("endpoint"),
+		Status:    c.Query("status"),
+		Limit:     100,
+	}
+	for param, dst := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be an RFC3339 timestamp", param)})
+				return
+			}
+			*dst = t
+		}
+	}
+	if !store.ValidCaptureStatus(q.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be a status code, 2xx-5xx or error"})
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxLogsLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxLogsLimit)})
+			return
+		}
+		q.Limit = n
+	}
+
+	logs, err := store.QueryCaptures(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"capturing": instance.CaptureMaxBodyBytes() > 0,
+		"logs":      logs,
+	})
+}
+
+// handleGetLog returns one captured request in full.
+func handleGetLog(c *gin.Context) {
+	capture, err := store.FindCapture(c.Param("id"))
+	if errors.Is(err, store.ErrCaptureNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "log not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	detail := logDetail{Capture: capture}
+	detail.ReassembledResponse = reassembled(capture.Response)
+	if len(capture.Upstream) > 0 {
+		detail.ReassembledUpstream = make([]json.RawMessage, len(capture.Upstream))
+		for i, ex := range capture.Upstream {
+			detail.ReassembledUpstream[i] = reassembled(ex.Response)
+		}
+	}
+	if capture.Path == "/v1/messages" {
+		detail.Translation = messagesTranslation(capture, detail.ReassembledResponse, detail.ReassembledUpstream)
+	}
+	c.JSON(http.StatusOK, detail)
+}
+
+// reassembled rebuilds a streamed message body, or returns nil if it was not a stream.
+func reassembled(msg store.CapturedMessage) json.RawMessage {
+	if msg.Text == "" {
+		return nil
+	}
+	data, _ := instance.ReassembleStream(msg.Text)
+	return data
+}
+
+// messagesTranslation builds the side-by-side view of an Anthropic request.
+// The final upstream exchange is the one whose response reached the client.
+func messagesTranslation(capture *store.Capture, clientResponse json.RawMessage, upstreamResponses []json.RawMessage) *logTranslation {
+	t := &logTranslation{}
+	t.Anthropic.Request = capture.Request.Body
+	t.Anthropic.Response = firstJSON(clientResponse, capture.Response.Body)
+
+	if n := len(capture.Upstream); n > 0 {
+		last := capture.Upstream[n-1]
+		t.OpenAI.Request = last.Request.Body
+		t.OpenAI.Response = firstJSON(upstreamResponses[n-1], last.Response.Body)
+		return t
+	}
+
+	// Nothing reached Copilot (e.g. rejected or no account); show what the
+	// current translation code makes of the request.
+	var payload anthropic.AnthropicMessagesPayload
+	if err := json.Unmarshal(capture.Request.Body, &payload); err == nil {
+		if data, err := json.Marshal(anthropic.TranslateToOpenAI(payload)); err == nil {
+			t.OpenAI.Request = data
+			t.Retranslated = true
+		}
+	}
+	return t
+}
+
+func firstJSON(candidates ...json.RawMessage) json.RawMessage {
+	for _, c := range candidates {
+		if len(strings.TrimSpace(string(c))) > 0 {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"copilot-go/oidc"
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	oidcCallbackPath = "/api/auth/oidc/callback"
+	// oidcStateCookie binds the provider's redirect to the browser that
+	// started the login. It must be SameSite=Lax to survive that redirect.
+	oidcStateCookie = "copilot_oidc_state"
+)
+
+// ssoRole maps the provider's groups to a console role: the highest role of
+// any mapped group, else the configured default. Empty means no access.
+func ssoRole(cfg oidc.Config, groups []string) string {
+	best := ""
+	for _, g := range groups {
+		r, ok := cfg.RoleMap[g]
+		if !ok || !store.ValidRole(r) {
+			continue
+		}
+		if best == "" || !store.RoleAtLeast(best, r) {
+			best = r
+		}
+	}
+	if best == "" {
+		return cfg.DefaultRole
+	}
+	return best
+}
+
+func setOIDCStateCookie(c *gin.Context, state string, maxAge time.Duration) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   secureRequest(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// --- Single sign-on handlers ---
+
+// handleOIDCLogin sends the browser to the identity provider.
+func handleOIDCLogin(c *gin.Context) {
+	scheme := "http"
+	if secureRequest(c) {
+		scheme = "https"
+	}
+	authURL, state, err := oidc.Begin(c.Request.Context(), scheme+"://"+c.Request.Host+oidcCallbackPath)
+	if errors.Is(err, oidc.ErrDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "OIDC login failed", "err", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+	setOIDCStateCookie(c, state, 10*time.Minute)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// handleOIDCCallback finishes a login at the provider's redirect: it verifies
+// the ID token, provisions the user and starts a cookie session.
+func handleOIDCCallback(c *gin.Context) {
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -time.Second)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		c.String(http.StatusBadRequest, "Login state mismatch. Please start the sign-in again.")
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		c.String(http.StatusUnauthorized, "Sign-in failed: %s %s", e, c.Query("error_description"))
+		return
+	}
+
+	id, err := oidc.Finish(c.Request.Context(), state, c.Query("code"))
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "OIDC callback failed", "err", err)
+		c.String(http.StatusUnauthorized, "Sign-in failed: %s", err.Error())
+		return
+	}
+	c.Set(ctxAdminUser, id.Username)
+
+	cfg, _ := oidc.Settings()
+	role := ssoRole(cfg, id.Groups)
+	if role == "" {
+		recordAudit(c, "auth.login_failed", "user:"+id.Username, nil, gin.H{"method": "oidc", "groups": id.Groups})
+		c.String(http.StatusForbidden, "Your account is not in any group with access to this console.")
+		return
+	}
+	user, err := store.ProvisionSSOUser(id.Issuer, id.Subject, id.Username, role)
+	if err != nil {
+		recordAudit(c, "auth.login_failed", "user:"+id.Username, nil, gin.H{"method": "oidc", "error": err.Error()})
+		c.String(http.StatusForbidden, "Sign-in failed: %s", err.Error())
+		return
+	}
+	c.Set(ctxAdminUser, user.Username)
+
+	token, err := store.CreateSession(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Sign-in failed: %s", err.Error())
+		return
+	}
+	session := store.LookupSession(token)
+	setSessionCookie(c, token, time.Until(session.CreatedAt.Add(store.SessionMaxLifetime)))
+	c.Set(ctxAdminSession, session.ID)
+	recordAudit(c, "auth.login", "user:"+user.Username, nil, gin.H{"method": "oidc", "role": role, "subject": id.Subject})
+	c.Redirect(http.StatusFound, "/")
+}
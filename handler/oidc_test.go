@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"copilot-go/oidc"
+	"copilot-go/oidc/oidctest"
+	"copilot-go/store"
+)
+
+func TestSSORole(t *testing.T) {
+	cfg := oidc.Config{
+		RoleMap: map[string]string{
+			"platform": store.RoleAdmin,
+			"sre":      store.RoleOperator,
+			"eng":      store.RoleViewer,
+			"typo":     "superuser",
+		},
+	}
+	for _, tc := range []struct {
+		groups      []string
+		defaultRole string
+		want        string
+	}{
+		{[]string{"eng"}, "", store.RoleViewer},
+		{[]string{"eng", "sre"}, "", store.RoleOperator},
+		{[]string{"sre", "platform", "eng"}, "", store.RoleAdmin},
+		{[]string{"sales"}, "", ""},
+		{nil, "", ""},
+		{[]string{"sales"}, store.RoleViewer, store.RoleViewer},
+		{[]string{"eng"}, store.RoleOperator, store.RoleViewer}, // a mapped group wins over the default
+		{[]string{"typo"}, "", ""},                              // unknown roles are ignored
+	} {
+		cfg.DefaultRole = tc.defaultRole
+		if got := ssoRole(cfg, tc.groups); got != tc.want {
+			t.Errorf("ssoRole(%v, default %q) = %q, want %q", tc.groups, tc.defaultRole, got, tc.want)
+		}
+	}
+}
+
+// ssoTest is a console API with single sign-on through a mock provider.
+type ssoTest struct {
+	*consoleTest
+	idp *oidctest.Provider
+}
+
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+	ct := newConsoleTest(t)
+	idp := oidctest.NewProvider("console")
+	t.Cleanup(func() {
+		_ = oidc.Init(oidc.Config{})
+		idp.Close()
+	})
+	err := oidc.Init(oidc.Config{
+		Issuer:        idp.URL,
+		ClientID:      "console",
+		Scopes:        []string{"openid", "profile", "email", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		RoleMap:       map[string]string{"platform": store.RoleAdmin, "sre": store.RoleOperator, "eng": store.RoleViewer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ssoTest{consoleTest: ct, idp: idp}
+}
+
+// login signs in through the provider with claims and returns the callback
+// response.
+func (st *ssoTest) login(claims map[string]any) *httptest.ResponseRecorder {
+	st.t.Helper()
+	req := httptest.NewRequest("GET", "http://console.test/api/auth/oidc/login", nil)
+	w := httptest.NewRecorder()
+	st.router.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		st.t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	callback, err := st.idp.Login(w.Header().Get("Location"), claims)
+	if err != nil {
+		st.t.Fatalf("provider login: %v", err)
+	}
+	if callback.Path != oidcCallbackPath {
+		st.t.Fatalf("callback to %s, want %s", callback, oidcCallbackPath)
+	}
+
+	req = httptest.NewRequest("GET", callback.String(), nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	st.router.ServeHTTP(w, req)
+	return w
+}
+
+// users reads the stored console users.
+func (st *ssoTest) users() []store.User {
+	st.t.Helper()
+	data, err := os.ReadFile(store.AdminFile())
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	var s struct{ Users []store.User }
+	if err := json.Unmarshal(data, &s); err != nil {
+		st.t.Fatal(err)
+	}
+	return s.Users
+}
+
+// user returns the console user the provider identifies by subject.
+func (st *ssoTest) user(subject string) *store.User {
+	st.t.Helper()
+	for _, u := range st.users() {
+		if u.Source == store.UserSourceOIDC && u.SSOIssuer == st.idp.URL && u.SSOSubject == subject {
+			return &u
+		}
+	}
+	return nil
+}
+
+// localUser returns the console user named username.
+func (st *ssoTest) localUser(username string) *store.User {
+	st.t.Helper()
+	for _, u := range st.users() {
+		if u.Username == username {
+			return &u
+		}
+	}
+	return nil
+}
+
+func TestOIDCCallback(t *testing.T) {
+	st := newSSOTest(t)
+	w := st.login(map[string]any{"sub": "sub-1", "preferred_username": "alice", "groups": []string{"eng"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback: status %d: %s", w.Code, w.Body)
+	}
+	var session string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie && c.Value != "" {
+			session = c.Value
+		}
+	}
+	if s := store.LookupSession(session); s == nil || s.Username != "alice" || s.Role != store.RoleViewer {
+		t.Fatalf("session = %+v, want alice as viewer", s)
+	}
+}
+
+func TestOIDCCallbackBindsSubject(t *testing.T) {
+	st := newSSOTest(t)
+	if _, err := store.CreateUser("bob", "correct horse battery", store.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	st.login(map[string]any{"sub": "sub-1", "preferred_username": "alice", "groups": []string{"eng"}})
+	alice := st.user("sub-1")
+	if alice == nil || alice.Username != "alice" || alice.Role != store.RoleViewer {
+		t.Fatalf("first user = %+v", alice)
+	}
+
+	// Another principal with the same name gets a user of its own.
+	st.login(map[string]any{"sub": "sub-2", "preferred_username": "alice", "groups": []string{"platform"}})
+	other := st.user("sub-2")
+	if other == nil || other.Username == "alice" || other.DisplayName != "alice" || other.Role != store.RoleAdmin {
+		t.Fatalf("second user = %+v", other)
+	}
+	if alice = st.user("sub-1"); alice.Role != store.RoleViewer {
+		t.Fatalf("first user's role changed to %q", alice.Role)
+	}
+
+	// So does one named like a local user.
+	st.login(map[string]any{"sub": "sub-3", "preferred_username": "bob", "groups": []string{"eng"}})
+	if u := st.user("sub-3"); u == nil || u.Username == "bob" {
+		t.Fatalf("user named like a local user = %+v", u)
+	}
+	if bob := st.localUser("bob"); bob.Source != "" || bob.Role != store.RoleAdmin {
+		t.Fatalf("local user changed: %+v", bob)
+	}
+
+	// A renamed principal keeps its user; its role follows its groups.
+	st.login(map[string]any{"sub": "sub-1", "preferred_username": "alice.smith", "groups": []string{"sre"}})
+	alice = st.user("sub-1")
+	if alice.Username != "alice" || alice.DisplayName != "alice.smith" || alice.Role != store.RoleOperator {
+		t.Fatalf("renamed user = %+v", alice)
+	}
+
+	// An unverified email does not name a user.
+	st.login(map[string]any{"sub": "sub-4", "email": "alice", "email_verified": false, "groups": []string{"eng"}})
+	if u := st.user("sub-4"); u == nil || u.Username != "sub-4" {
+		t.Fatalf("user with an unverified email = %+v", u)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	st := newSSOTest(t)
+
+	// No mapped group and no default role.
+	if w := st.login(map[string]any{"sub": "sub-1", "groups": []string{"sales"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("unmapped groups: status %d, want 403", w.Code)
+	}
+	if u := st.user("sub-1"); u != nil {
+		t.Fatalf("user provisioned without a role: %+v", u)
+	}
+
+	// A callback from a browser that did not start the login.
+	req := httptest.NewRequest("GET", "http://console.test/api/auth/oidc/login", nil)
+	w := httptest.NewRecorder()
+	st.router.ServeHTTP(w, req)
+	callback, err := st.idp.Login(w.Header().Get("Location"), map[string]any{"sub": "sub-1", "groups": []string{"eng"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	st.router.ServeHTTP(w, httptest.NewRequest("GET", callback.String(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("callback without the state cookie: status %d, want 400", w.Code)
+	}
+
+	// A token for another client.
+	if w := st.login(map[string]any{"sub": "sub-1", "aud": "another-client", "groups": []string{"eng"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token for another client: status %d, want 401", w.Code)
+	}
+}
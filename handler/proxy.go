@@ -1,15 +1,21 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"copilot-go/config"
 	"copilot-go/instance"
+	"copilot-go/logging"
 	"copilot-go/store"
+	"copilot-go/tracing"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,11 +25,17 @@ func RegisterProxy(r *gin.Engine) {
 	// Initialize rate limiter from environment.
 	instance.InitRateLimiter()
 
-	// Load per-account rate limit from pool config.
-	if poolCfg, err := store.GetPoolConfig(); err == nil && poolCfg != nil {
-		instance.SetPerAccountRPM(poolCfg.RateLimitRPM)
+	// Load per-account rate limits from pool configs.
+	if pools, err := store.GetPools(); err == nil {
+		for _, p := range pools {
+			instance.SetPoolRPM(p.ID, p.RateLimitRPM)
+		}
 	}
 
+	r.Use(traceRequest())
+	r.Use(requestID())
+	r.Use(usageHistory())
+	r.Use(captureTraffic())
 	r.Use(proxyAuth())
 
 	// OpenAI compatible endpoints
@@ -42,44 +54,168 @@ func RegisterProxy(r *gin.Engine) {
 	r.POST("/v1/responses", proxyResponses)
 }
 
-func proxyAuth() gin.HandlerFunc {
+// traceRequest starts the server span for a proxied request, continuing the
+// client's trace when it sends a W3C traceparent header.
+func traceRequest() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			// Also check x-api-key for Anthropic-style auth
-			apiKey := c.GetHeader("x-api-key")
-			if apiKey != "" {
-				authHeader = "Bearer " + apiKey
-			}
+		ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+		ctx, span := tracing.StartWithKind(ctx, tracing.KindServer, c.Request.Method+" "+c.FullPath(),
+			tracing.String("http.request.method", c.Request.Method),
+			tracing.String("http.route", c.FullPath()),
+			tracing.String("user_agent.original", c.Request.UserAgent()))
+		if span == nil {
+			c.Next()
+			return
 		}
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
 
-		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing authorization"})
-			return
+		status := c.Writer.Status()
+		span.SetAttributes(tracing.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+	}
+}
+
+// requestID assigns each request an ID, reusing a well-formed client
+// X-Request-Id, echoes it in the response and sends it upstream to Copilot.
+// Requests are logged at debug level.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-Id")
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
 		}
+		c.Set("requestID", id)
+		c.Header("X-Request-Id", id)
+		ctx := logging.WithRequestID(c.Request.Context(), id)
+		c.Request = c.Request.WithContext(ctx)
 
-		token := strings.TrimPrefix(authHeader, "Bearer ")
+		start := time.Now()
+		c.Next()
+		slog.DebugContext(ctx, "proxy request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"account", c.GetString("accountID"),
+			"pool", c.GetString("poolID"),
+			"model", c.GetString("requestModel"))
+	}
+}
 
-		// Check pool API key first
-		poolCfg, _ := store.GetPoolConfig()
-		if poolCfg != nil && poolCfg.Enabled && poolCfg.ApiKey == token {
-			c.Set("isPool", true)
-			c.Set("poolStrategy", poolCfg.Strategy)
+// usageHistory records a persistent usage event for every authenticated request.
+func usageHistory() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		usage := instance.BeginRequestUsage(c)
+		c.Next()
+		if c.GetString("apiKey") == "" {
+			return // rejected by proxyAuth
+		}
+		ev := usage.Event(
+			c.FullPath(),
+			c.Writer.Status(),
+			c.GetString("accountID"),
+			c.GetString("poolID"),
+			c.GetString("apiKey"),
+			c.GetString("requestModel"),
+		)
+		instance.RecordUsageEvent(ev)
+		tracing.SpanFromContext(c.Request.Context()).SetAttributes(
+			tracing.String("gen_ai.request.model", ev.Model),
+			tracing.String("copilot.account_id", ev.AccountID),
+			tracing.String("copilot.pool_id", ev.PoolID),
+			tracing.Int("gen_ai.usage.input_tokens", ev.InputTokens),
+			tracing.Int("gen_ai.usage.output_tokens", ev.OutputTokens),
+			tracing.Int("gen_ai.usage.cached_tokens", ev.CachedTokens),
+			tracing.Int64("copilot.ttft_ms", ev.TTFTMs))
+	}
+}
+
+func proxyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, span := tracing.Start(c.Request.Context(), "proxyAuth")
+		ok := authenticateProxyRequest(c)
+		if ok {
+			span.SetAttributes(
+				tracing.Bool("copilot.pool_key", c.GetBool("isPool")),
+				tracing.String("copilot.pool_id", c.GetString("poolID")),
+				tracing.String("copilot.account_id", c.GetString("accountID")))
+		} else {
+			span.SetError(http.StatusText(c.Writer.Status()))
+		}
+		span.End()
+		if ok {
 			c.Next()
-			return
 		}
+	}
+}
 
-		// Check individual account API key
-		account, err := store.GetAccountByApiKey(token)
-		if err != nil || account == nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
-			return
+// authenticateProxyRequest resolves the API key, or the key bound to a verified
+// client certificate or the proxy socket, to a pool or account and stores it
+// in the context. It returns false after writing a 401 if the key is invalid.
+func authenticateProxyRequest(c *gin.Context) bool {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		// Also check x-api-key for Anthropic-style auth
+		apiKey := c.GetHeader("x-api-key")
+		if apiKey != "" {
+			authHeader = "Bearer " + apiKey
 		}
+	}
 
-		c.Set("accountID", account.ID)
-		c.Set("isPool", false)
-		c.Next()
+	if authHeader == "" {
+		// Fall back to a client certificate bound to an API key, or to the
+		// Unix socket's configured credentials
+		if apiKey := clientCertAPIKey(c); apiKey != "" {
+			authHeader = "Bearer " + apiKey
+		} else if apiKey := socketAPIKey(c); apiKey != "" {
+			authHeader = "Bearer " + apiKey
+		}
+	}
+
+	if authHeader == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing authorization"})
+		return false
+	}
+
+	if apiKeyThrottled(c) {
+		return false
+	}
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+
+	// Check pool API keys first
+	pool, _ := store.GetPoolByApiKey(token)
+	if pool != nil && pool.Enabled {
+		if !keyAllowsClient(c, pool.AllowedIPsFor(token)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not allowed from this address"})
+			return false
+		}
+		c.Set("isPool", true)
+		c.Set("pool", pool)
+		c.Set("poolID", pool.ID)
+		c.Set("apiKey", token)
+		return true
+	}
+
+	// Check individual account API key
+	account, err := store.GetAccountByApiKey(token)
+	if err != nil || account == nil {
+		apiKeyFailed(c)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+		return false
 	}
+	if !keyAllowsClient(c, account.AllowedIPs) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not allowed from this address"})
+		return false
+	}
+
+	c.Set("accountID", account.ID)
+	c.Set("apiKey", token)
+	c.Set("isPool", false)
+	return true
 }
 
 // resolvedAccount holds the resolved state and account ID.
@@ -88,38 +224,106 @@ type resolvedAccount struct {
 	AccountID string
 }
 
+// proxyError is an error response that has not been written yet.
+type proxyError struct {
+	Status int
+	Body   gin.H
+}
+
+func (e *proxyError) message() string {
+	if inner, ok := e.Body["error"].(gin.H); ok {
+		return fmt.Sprint(inner["message"])
+	}
+	return fmt.Sprint(e.Body["error"])
+}
+
 func resolveState(c *gin.Context, exclude map[string]bool) *resolvedAccount {
+	resolved, perr := pickAccount(c, exclude)
+	if perr != nil {
+		c.JSON(perr.Status, perr.Body)
+		return nil
+	}
+	return resolved
+}
+
+// pickAccount resolves the account for the request without writing a response.
+func pickAccount(c *gin.Context, exclude map[string]bool) (*resolvedAccount, *proxyError) {
+	_, span := tracing.Start(c.Request.Context(), "SelectAccount", tracing.Int("copilot.excluded_accounts", len(exclude)))
+	if pool := requestPool(c); pool != nil {
+		span.SetAttributes(tracing.String("copilot.pool_id", pool.ID), tracing.String("copilot.strategy", pool.Strategy))
+	}
+	resolved, perr := selectRequestAccount(c, exclude)
+	if perr != nil {
+		span.SetError(perr.message())
+	} else {
+		span.SetAttributes(tracing.String("copilot.account_id", resolved.AccountID))
+	}
+	span.End()
+	return resolved, perr
+}
+
+func selectRequestAccount(c *gin.Context, exclude map[string]bool) (*resolvedAccount, *proxyError) {
 	isPool, _ := c.Get("isPool")
 	if isPool == true {
-		strategy := ""
-		if s, ok := c.Get("poolStrategy"); ok {
-			strategy = s.(string)
+		account, err := instance.SelectAccount(instance.SelectOptions{
+			Pool:       requestPool(c),
+			Exclude:    exclude,
+			SessionKey: c.GetString("sessionKey"),
+			Model:      c.GetString("requestModel"),
+		})
+		var unavailable *instance.ModelUnavailableError
+		if errors.As(err, &unavailable) {
+			return nil, &proxyError{http.StatusNotFound, gin.H{"error": fmt.Sprintf("no running account in the pool offers model %s", store.ToDisplayID(unavailable.Model))}}
 		}
-		account, err := instance.SelectAccount(strategy, exclude)
 		if err != nil || account == nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no available accounts in pool"})
-			return nil
+			return nil, &proxyError{http.StatusServiceUnavailable, gin.H{"error": "no available accounts in pool"}}
 		}
 		state := instance.GetInstanceState(account.ID)
 		if state == nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "selected account instance not running"})
-			return nil
+			return nil, &proxyError{http.StatusServiceUnavailable, gin.H{"error": "selected account instance not running"}}
 		}
-		return &resolvedAccount{State: state, AccountID: account.ID}
+		return &resolvedAccount{State: state, AccountID: account.ID}, nil
 	}
 
 	accountID, exists := c.Get("accountID")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "no account context"})
-		return nil
+		return nil, &proxyError{http.StatusUnauthorized, gin.H{"error": "no account context"}}
 	}
 	aid := accountID.(string)
 	state := instance.GetInstanceState(aid)
 	if state == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "account instance not running"})
-		return nil
+		return nil, &proxyError{http.StatusServiceUnavailable, gin.H{"error": "account instance not running"}}
+	}
+	return &resolvedAccount{State: state, AccountID: aid}, nil
+}
+
+// requestPool returns the pool resolved by proxyAuth, or nil outside pool mode.
+func requestPool(c *gin.Context) *store.Pool {
+	if v, ok := c.Get("pool"); ok {
+		return v.(*store.Pool)
+	}
+	return nil
+}
+
+// setSessionKey derives the sticky-routing key for pool requests from the request body.
+func setSessionKey(c *gin.Context, bodyBytes []byte) {
+	if c.GetBool("isPool") {
+		c.Set("sessionKey", instance.DeriveSessionKey(c.Request.Header, bodyBytes))
+	}
+}
+
+// setRequestModel records the targeted Copilot model for usage history and so
+// pool selection can skip accounts that do not offer it, and enforces the
+// pool's model allowlist. Returns false if the model is not allowed (response
+// already written).
+func setRequestModel(c *gin.Context, bodyBytes []byte, anthropicFormat bool) bool {
+	model := instance.ResolveRequestModel(bodyBytes, anthropicFormat)
+	c.Set("requestModel", model)
+	if pool := requestPool(c); pool != nil && !pool.AllowsModel(store.ToDisplayID(model), model) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("model %s is not allowed in this pool", store.ToDisplayID(model))})
+		return false
 	}
-	return &resolvedAccount{State: state, AccountID: aid}
+	return true
 }
 
 // isRetryableStatus returns true for HTTP status codes that warrant a retry with a different account.
@@ -127,85 +331,192 @@ func isRetryableStatus(statusCode int) bool {
 	return statusCode == http.StatusTooManyRequests || (statusCode >= 500 && statusCode <= 599)
 }
 
-// checkRateLimit checks the rate limit for the account and writes a 429 response if exceeded.
-// Returns true if the request is allowed, false if rate limited.
-func checkRateLimit(c *gin.Context, accountID string) bool {
-	allowed, retryAfter := instance.CheckRateLimit(accountID)
+// checkRateLimit checks the rate limit for the account. Returns a 429 error
+// (with Retry-After set) if exceeded, nil if the request is allowed.
+func checkRateLimit(c *gin.Context, accountID string) *proxyError {
+	allowed, retryAfter := instance.CheckRateLimit(c.GetString("poolID"), accountID)
 	if !allowed {
 		c.Header("Retry-After", fmt.Sprintf("%.0f", retryAfter))
-		c.JSON(http.StatusTooManyRequests, gin.H{
+		return &proxyError{http.StatusTooManyRequests, gin.H{
 			"error": gin.H{
 				"message": "rate limit exceeded",
 				"type":    "rate_limit_error",
 			},
-		})
-		return false
+		}}
 	}
-	return true
+	return nil
 }
 
-// proxyCompletions handles completions with pool-mode retry support.
-func proxyCompletions(c *gin.Context) {
-	isPool, _ := c.Get("isPool")
+// newStreamFailover returns mid-stream failover state when the request streams
+// and its pool has failover enabled, nil otherwise.
+func newStreamFailover(c *gin.Context, bodyBytes []byte, format instance.StreamFormat) *instance.StreamFailover {
+	pool := requestPool(c)
+	if pool == nil || pool.StreamFailover == store.StreamFailoverOff {
+		return nil
+	}
+	var payload struct {
+		Stream bool `json:"stream"`
+	}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil || !payload.Stream {
+		return nil
+	}
+	return instance.NewStreamFailover(pool.StreamFailover, format)
+}
+
+// upstreamCall performs the upstream request against a resolved account.
+// Cancelling ctx aborts it. The caller is responsible for closing resp.Body.
+type upstreamCall func(ctx context.Context, resolved *resolvedAccount) (*http.Response, error)
+
+// forwardFunc writes the upstream response to the client. It returns
+// *instance.StreamBrokenError when a stream breaks and fo allows failover.
+type forwardFunc func(resp *http.Response) error
+
+// proxyWithRetry runs call against a resolved account. In pool mode, transport
+// errors and retryable statuses are retried on a different account, as are
+// broken streams when fo is non-nil. Keys with a hedge policy race a second
+// account when the first is slow. The final response is handed to forward.
+func proxyWithRetry(c *gin.Context, label string, fo *instance.StreamFailover, call upstreamCall, forward forwardFunc) {
 	maxAttempts := 1
-	if isPool == true {
+	if c.GetBool("isPool") {
 		maxAttempts = 3
 	}
 
-	// Read body once for potential retries.
-	bodyBytes, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
-		return
+	// Once stream content reached the client, errors must be sent in-stream.
+	fail := func(perr *proxyError) {
+		if fo.Committed() {
+			fo.Abort(c.Writer, perr.message())
+			return
+		}
+		c.JSON(perr.Status, perr.Body)
 	}
 
 	exclude := make(map[string]bool)
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		resolved := resolveState(c, exclude)
-		if resolved == nil {
-			return // resolveState already wrote the error response
+		resolved, perr := pickAccount(c, exclude)
+		if perr != nil {
+			fail(perr)
+			return
 		}
 
 		// Check rate limit.
-		if !checkRateLimit(c, resolved.AccountID) {
+		if perr := checkRateLimit(c, resolved.AccountID); perr != nil {
+			fail(perr)
 			return
 		}
 
-		// Record the request.
+		// Record the request. A half-open account's probe slot is only taken
+		// now that the request is certain to go upstream.
 		instance.RecordRequest(resolved.AccountID, false, false)
-
-		resp, proxyErr := instance.DoCompletionsProxy(c, resolved.State, bodyBytes)
+		instance.AcquireBreaker(resolved.AccountID)
+
+		ctx, span := tracing.Start(c.Request.Context(), label+" attempt",
+			tracing.Int("copilot.attempt", attempt+1),
+			tracing.String("copilot.account_id", resolved.AccountID))
+		var resp *http.Response
+		var proxyErr error
+		if policy := hedgePolicy(c); policy != nil && !fo.Committed() {
+			resolved, resp, proxyErr = hedgedCall(ctx, c, policy, exclude, resolved, call)
+			span.SetAttributes(tracing.String("copilot.account_id", resolved.AccountID))
+		} else {
+			resp, proxyErr = call(ctx, resolved)
+		}
+		instance.RecordUpstreamResult(resolved.AccountID, resp, proxyErr)
 		if proxyErr != nil {
 			if resp != nil {
 				_ = resp.Body.Close()
 			}
 			instance.RecordRequest(resolved.AccountID, true, false)
+			span.RecordError(proxyErr)
+			span.End()
 			if attempt < maxAttempts-1 {
 				exclude[resolved.AccountID] = true
-				log.Printf("Completions proxy error for account %s, retrying: %v", resolved.AccountID, proxyErr)
+				instance.RecordRetry(c.GetString("poolID"), c.FullPath(), "error")
+				slog.WarnContext(ctx, "proxy error, retrying on another account", "endpoint", label, "account", resolved.AccountID, "err", proxyErr)
 				continue
 			}
-			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("proxy request failed: %v", proxyErr)})
+			fail(&proxyError{http.StatusBadGateway, gin.H{"error": fmt.Sprintf("proxy request failed: %v", proxyErr)}})
 			return
 		}
 
+		span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetError(resp.Status)
+		}
+
 		// Check if retryable.
 		if isRetryableStatus(resp.StatusCode) && attempt < maxAttempts-1 {
+			span.End()
 			is429 := resp.StatusCode == http.StatusTooManyRequests
 			instance.RecordRequest(resolved.AccountID, true, is429)
 			_ = resp.Body.Close()
 			exclude[resolved.AccountID] = true
-			log.Printf("Upstream returned %d for account %s, retrying with different account", resp.StatusCode, resolved.AccountID)
+			instance.RecordRetry(c.GetString("poolID"), c.FullPath(), "status")
+			slog.WarnContext(ctx, "upstream error status, retrying on another account", "endpoint", label, "account", resolved.AccountID, "status", resp.StatusCode)
 			continue
 		}
 
+		// A continuation that fails upfront cannot be forwarded as a fresh response.
+		if fo.Committed() && resp.StatusCode != http.StatusOK {
+			span.End()
+			_ = resp.Body.Close()
+			fail(&proxyError{resp.StatusCode, gin.H{"error": fmt.Sprintf("upstream returned %d while continuing stream", resp.StatusCode)}})
+			return
+		}
+
 		// Forward the response.
-		instance.ForwardCompletionsResponse(c, resp)
+		usage := instance.RequestUsageFrom(c)
+		usage.SetAccount(resolved.AccountID)
+		usage.WatchFirstByte(resp)
+		var broken *instance.StreamBrokenError
+		err := forward(resp)
+		if errors.As(err, &broken) {
+			span.RecordError(broken.Err)
+		}
+		span.End()
+		if broken != nil {
+			if c.Request.Context().Err() != nil {
+				return // the client went away; nothing left to fail over for
+			}
+			instance.RecordUpstreamResult(resolved.AccountID, nil, broken.Err)
+			instance.RecordRequest(resolved.AccountID, true, false)
+			if attempt < maxAttempts-1 && fo.CanResume() {
+				exclude[resolved.AccountID] = true
+				instance.RecordRetry(c.GetString("poolID"), c.FullPath(), "stream")
+				slog.WarnContext(ctx, "stream broke, failing over", "endpoint", label, "account", resolved.AccountID, "err", broken.Err)
+				continue
+			}
+			fo.Abort(c.Writer, broken.Error())
+		}
+		return
+	}
+}
+
+// proxyCompletions handles completions with pool-mode retry support.
+func proxyCompletions(c *gin.Context) {
+	// Read body once for potential retries.
+	bodyBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	setSessionKey(c, bodyBytes)
+	if !setRequestModel(c, bodyBytes, false) {
 		return
 	}
+
+	fo := newStreamFailover(c, bodyBytes, instance.StreamFormatOpenAI)
+	proxyWithRetry(c, "Completions", fo, func(ctx context.Context, resolved *resolvedAccount) (*http.Response, error) {
+		return instance.DoCompletionsProxy(ctx, resolved.State, fo.RequestBody(bodyBytes))
+	}, func(resp *http.Response) error {
+		return instance.ForwardCompletionsResponse(c, resp, fo)
+	})
 }
 
 func proxyModels(c *gin.Context) {
+	if c.GetBool("isPool") {
+		instance.PooledModelsHandler(c, requestPool(c))
+		return
+	}
 	resolved := resolveState(c, nil)
 	if resolved == nil {
 		return
@@ -214,113 +525,40 @@ func proxyModels(c *gin.Context) {
 }
 
 func proxyEmbeddings(c *gin.Context) {
-	isPool, _ := c.Get("isPool")
-	maxAttempts := 1
-	if isPool == true {
-		maxAttempts = 3
-	}
-
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
 		return
 	}
-
-	exclude := make(map[string]bool)
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		resolved := resolveState(c, exclude)
-		if resolved == nil {
-			return
-		}
-
-		if !checkRateLimit(c, resolved.AccountID) {
-			return
-		}
-
-		instance.RecordRequest(resolved.AccountID, false, false)
-
-		resp, proxyErr := instance.DoEmbeddingsProxy(resolved.State, bodyBytes)
-		if proxyErr != nil {
-			if resp != nil {
-				_ = resp.Body.Close()
-			}
-			instance.RecordRequest(resolved.AccountID, true, false)
-			if attempt < maxAttempts-1 {
-				exclude[resolved.AccountID] = true
-				log.Printf("Embeddings proxy error for account %s, retrying: %v", resolved.AccountID, proxyErr)
-				continue
-			}
-			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("proxy request failed: %v", proxyErr)})
-			return
-		}
-
-		if isRetryableStatus(resp.StatusCode) && attempt < maxAttempts-1 {
-			is429 := resp.StatusCode == http.StatusTooManyRequests
-			instance.RecordRequest(resolved.AccountID, true, is429)
-			_ = resp.Body.Close()
-			exclude[resolved.AccountID] = true
-			log.Printf("Upstream returned %d for account %s, retrying with different account", resp.StatusCode, resolved.AccountID)
-			continue
-		}
-
-		instance.ForwardEmbeddingsResponse(c, resp)
+	if !setRequestModel(c, bodyBytes, false) {
 		return
 	}
+
+	proxyWithRetry(c, "Embeddings", nil, func(ctx context.Context, resolved *resolvedAccount) (*http.Response, error) {
+		return instance.DoEmbeddingsProxy(ctx, resolved.State, bodyBytes)
+	}, func(resp *http.Response) error {
+		instance.ForwardEmbeddingsResponse(c, resp)
+		return nil
+	})
 }
 
 func proxyMessages(c *gin.Context) {
-	isPool, _ := c.Get("isPool")
-	maxAttempts := 1
-	if isPool == true {
-		maxAttempts = 3
-	}
-
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
 		return
 	}
-
-	exclude := make(map[string]bool)
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		resolved := resolveState(c, exclude)
-		if resolved == nil {
-			return
-		}
-
-		if !checkRateLimit(c, resolved.AccountID) {
-			return
-		}
-
-		instance.RecordRequest(resolved.AccountID, false, false)
-
-		resp, proxyErr := instance.DoMessagesProxy(c, resolved.State, bodyBytes)
-		if proxyErr != nil {
-			if resp != nil {
-				_ = resp.Body.Close()
-			}
-			instance.RecordRequest(resolved.AccountID, true, false)
-			if attempt < maxAttempts-1 {
-				exclude[resolved.AccountID] = true
-				log.Printf("Messages proxy error for account %s, retrying: %v", resolved.AccountID, proxyErr)
-				continue
-			}
-			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("proxy request failed: %v", proxyErr)})
-			return
-		}
-
-		if isRetryableStatus(resp.StatusCode) && attempt < maxAttempts-1 {
-			is429 := resp.StatusCode == http.StatusTooManyRequests
-			instance.RecordRequest(resolved.AccountID, true, is429)
-			_ = resp.Body.Close()
-			exclude[resolved.AccountID] = true
-			log.Printf("Upstream returned %d for account %s, retrying with different account", resp.StatusCode, resolved.AccountID)
-			continue
-		}
-
-		instance.ForwardMessagesResponse(c, resp, bodyBytes)
+	setSessionKey(c, bodyBytes)
+	if !setRequestModel(c, bodyBytes, true) {
 		return
 	}
+
+	fo := newStreamFailover(c, bodyBytes, instance.StreamFormatAnthropic)
+	proxyWithRetry(c, "Messages", fo, func(ctx context.Context, resolved *resolvedAccount) (*http.Response, error) {
+		return instance.DoMessagesProxy(ctx, resolved.State, fo.RequestBody(bodyBytes))
+	}, func(resp *http.Response) error {
+		return instance.ForwardMessagesResponse(c, resp, bodyBytes, fo)
+	})
 }
 
 func proxyCountTokens(c *gin.Context) {
@@ -332,56 +570,20 @@ func proxyCountTokens(c *gin.Context) {
 }
 
 func proxyResponses(c *gin.Context) {
-	isPool, _ := c.Get("isPool")
-	maxAttempts := 1
-	if isPool == true {
-		maxAttempts = 3
-	}
-
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
 		return
 	}
-
-	exclude := make(map[string]bool)
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		resolved := resolveState(c, exclude)
-		if resolved == nil {
-			return
-		}
-
-		if !checkRateLimit(c, resolved.AccountID) {
-			return
-		}
-
-		instance.RecordRequest(resolved.AccountID, false, false)
-
-		resp, proxyErr := instance.DoResponsesProxy(resolved.State, bodyBytes)
-		if proxyErr != nil {
-			if resp != nil {
-				_ = resp.Body.Close()
-			}
-			instance.RecordRequest(resolved.AccountID, true, false)
-			if attempt < maxAttempts-1 {
-				exclude[resolved.AccountID] = true
-				log.Printf("Responses proxy error for account %s, retrying: %v", resolved.AccountID, proxyErr)
-				continue
-			}
-			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("proxy request failed: %v", proxyErr)})
-			return
-		}
-
-		if isRetryableStatus(resp.StatusCode) && attempt < maxAttempts-1 {
-			is429 := resp.StatusCode == http.StatusTooManyRequests
-			instance.RecordRequest(resolved.AccountID, true, is429)
-			_ = resp.Body.Close()
-			exclude[resolved.AccountID] = true
-			log.Printf("Upstream returned %d for account %s, retrying with different account", resp.StatusCode, resolved.AccountID)
-			continue
-		}
-
-		instance.ForwardResponsesResponse(c, resp)
+	setSessionKey(c, bodyBytes)
+	if !setRequestModel(c, bodyBytes, false) {
 		return
 	}
+
+	proxyWithRetry(c, "Responses", nil, func(ctx context.Context, resolved *resolvedAccount) (*http.Response, error) {
+		return instance.DoResponsesProxy(ctx, resolved.State, bodyBytes)
+	}, func(resp *http.Response) error {
+		instance.ForwardResponsesResponse(c, resp)
+		return nil
+	})
 }
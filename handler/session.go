@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// sessionCookie carries the session token in cookie mode. It is HttpOnly,
+	// so the console reads the CSRF token from the login response instead.
+	sessionCookie = "copilot_session"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// sessionToken returns the console session token from the Authorization
+// header or, failing that, the session cookie.
+func sessionToken(c *gin.Context) (token string, fromCookie bool) {
+	if h := c.GetHeader("Authorization"); h != "" {
+		return strings.TrimPrefix(h, "Bearer "), false
+	}
+	if v, err := c.Cookie(sessionCookie); err == nil && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// validCSRF checks the CSRF header of a cookie-authenticated request. Safe
+// methods need none.
+func validCSRF(c *gin.Context, token string) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	got := c.GetHeader(csrfHeader)
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(store.CSRFToken(token))) == 1
+}
+
+// secureRequest reports whether the client reached us over HTTPS, directly or
+// through a proxy.
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https")
+}
+
+func setSessionCookie(c *gin.Context, token string, maxAge time.Duration) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/api",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   secureRequest(c),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// respondLogin answers a successful setup or login. In cookie mode the token
+// is set as a cookie and only the CSRF token is returned.
+func respondLogin(c *gin.Context, token string, useCookie bool) {
+	session := store.LookupSession(token)
+	resp := gin.H{"role": session.Role, "expiresAt": session.ExpiresAt}
+	if useCookie {
+		setSessionCookie(c, token, time.Until(session.CreatedAt.Add(store.SessionMaxLifetime)))
+		resp["csrfToken"] = store.CSRFToken(token)
+	} else {
+		resp["token"] = token
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// sessionView is a session as listed by the console API.
+type sessionView struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Role       string    `json:"role"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// --- Session handlers ---
+
+func handleLogout(c *gin.Context) {
+	store.RevokeToken(c.GetString(ctxAdminToken))
+	setSessionCookie(c, "", -time.Second)
+	recordAudit(c, "auth.logout", "user:"+c.GetString(ctxAdminUser), nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleListSessions lists the caller's sessions; admins may pass all=true to
+// list every user's.
+func handleListSessions(c *gin.Context) {
+	username := c.GetString(ctxAdminUser)
+	if c.Query("all") == "true" {
+		if !store.RoleAtLeast(c.GetString(ctxAdminRole), store.RoleAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "requires the admin role"})
+			return
+		}
+		username = ""
+	}
+	current := c.GetString(ctxAdminSession)
+	sessions := store.ListSessions(username)
+	out := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, sessionView{
+			ID:         s.ID,
+			Username:   s.Username,
+			Role:       s.Role,
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+			Current:    s.ID == current,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// handleRevokeOtherSessions ends all of the caller's sessions but this one.
+func handleRevokeOtherSessions(c *gin.Context) {
+	username := c.GetString(ctxAdminUser)
+	n := store.RevokeUserSessions(username, c.GetString(ctxAdminToken))
+	recordAudit(c, "session.revoke_others", "user:"+username, nil, gin.H{"revoked": n})
+	c.JSON(http.StatusOK, gin.H{"revoked": n})
+}
+
+// handleRevokeSession ends one session. Non-admins may only end their own.
+func handleRevokeSession(c *gin.Context) {
+	id := c.Param("id")
+	owner := c.GetString(ctxAdminUser)
+	if store.RoleAtLeast(c.GetString(ctxAdminRole), store.RoleAdmin) {
+		owner = ""
+	}
+	if !store.RevokeSession(id, owner) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	recordAudit(c, "session.revoke", "session:"+id, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
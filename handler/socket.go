@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unixConnKey marks requests that arrived over a Unix domain socket.
+type unixConnKey struct{}
+
+// UnixConnContext is an http.Server ConnContext hook that marks connections
+// accepted on a Unix domain socket, whose clients have no IP address.
+func UnixConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if _, ok := conn.(*net.UnixConn); ok {
+		return context.WithValue(ctx, unixConnKey{}, true)
+	}
+	return ctx
+}
+
+// viaUnixSocket reports whether the request arrived over a Unix socket. Such
+// clients are local and admitted by file permissions, so IP ACLs skip them.
+func viaUnixSocket(c *gin.Context) bool {
+	return c.Request.Context().Value(unixConnKey{}) != nil
+}
+
+// proxySocket and proxySocketAuth describe the proxy's Unix socket, see
+// SetProxySocket.
+var (
+	proxySocket     string
+	proxySocketAuth string
+)
+
+// SetProxySocket records the proxy's Unix socket path and, if auth is set,
+// the credentials that requests over it use when they carry no API key:
+// "pool:<id>" or "account:<id or name>". Whoever may open the socket is then
+// authenticated by the file's permissions alone.
+func SetProxySocket(path, auth string) error {
+	if auth != "" {
+		kind, ref, _ := strings.Cut(auth, ":")
+		if (kind != "pool" && kind != "account") || ref == "" {
+			return fmt.Errorf("invalid socket auth %q, want pool:<id> or account:<id or name>", auth)
+		}
+		if path == "" {
+			return fmt.Errorf("socket auth %q needs a proxy socket", auth)
+		}
+	}
+	proxySocket, proxySocketAuth = path, auth
+	return nil
+}
+
+// socketAPIKey returns the API key that a key-less request over the proxy
+// socket authenticates as, or "" if socket authentication is off.
+func socketAPIKey(c *gin.Context) string {
+	if proxySocketAuth == "" || !viaUnixSocket(c) {
+		return ""
+	}
+	kind, ref, _ := strings.Cut(proxySocketAuth, ":")
+	if kind == "pool" {
+		if pool, _ := store.GetPool(ref); pool != nil && len(pool.ApiKeys) > 0 {
+			return pool.ApiKeys[0]
+		}
+	} else if accounts, err := store.GetAccounts(); err == nil {
+		for _, a := range accounts {
+			if a.ID == ref || a.Name == ref {
+				return a.ApiKey
+			}
+		}
+	}
+	slog.WarnContext(c.Request.Context(), "socket authentication target not found", "auth", proxySocketAuth)
+	return ""
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"copilot-go/metrics"
+	"copilot-go/throttle"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	authFailures = metrics.NewCounterVec("copilot_auth_failures_total",
+		"Failed console logins and invalid proxy API keys.", "kind")
+	authThrottled = metrics.NewCounterVec("copilot_auth_throttled_total",
+		"Authentication attempts refused by brute-force throttling.", "kind")
+)
+
+// Brute-force throttles. Wrong passwords are counted per username and per
+// client IP; invalid API keys per client IP. The per-IP limits are looser
+// because many users may share an address.
+var (
+	loginByUser  = throttle.New(loginPolicy(1))
+	loginByIP    = throttle.New(loginPolicy(3))
+	apiKeyByIP   = throttle.New(apiKeyPolicy())
+	throttleKind = map[string]*throttle.Limiter{
+		"login-user": loginByUser,
+		"login-ip":   loginByIP,
+		"api-key-ip": apiKeyByIP,
+	}
+)
+
+// loginPolicy reads LOGIN_LOCKOUT_ATTEMPTS (default 10, 0 disables lockouts)
+// and LOGIN_LOCKOUT_DURATION (default 15m); scale multiplies the allowances.
+func loginPolicy(scale int) throttle.Policy {
+	return throttle.Policy{
+		FreeFailures: 3 * scale,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: envInt("LOGIN_LOCKOUT_ATTEMPTS", 10) * scale,
+		Lockout:      envDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		Window:       time.Hour,
+	}
+}
+
+// apiKeyPolicy reads API_KEY_LOCKOUT_ATTEMPTS (default 50, 0 disables
+// lockouts) and API_KEY_LOCKOUT_DURATION (default 15m).
+func apiKeyPolicy() throttle.Policy {
+	return throttle.Policy{
+		FreeFailures: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: envInt("API_KEY_LOCKOUT_ATTEMPTS", 50),
+		Lockout:      envDuration("API_KEY_LOCKOUT_DURATION", 15*time.Minute),
+		Window:       time.Hour,
+	}
+}
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header, rounding up.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// beginLogin reserves a login attempt for username and the client IP before
+// the password or second factor is checked, so parallel guesses cannot all get
+// past the throttle ahead of the first recorded failure. If either must wait,
+// it writes a 429 and returns false; otherwise the caller must call done once
+// the attempt is over.
+func beginLogin(c *gin.Context, username string) (done func(), ok bool) {
+	ip, user := c.ClientIP(), strings.ToLower(username)
+	wait, ok := loginByIP.Begin(ip)
+	if ok {
+		var userWait time.Duration
+		if userWait, ok = loginByUser.Begin(user); !ok {
+			loginByIP.End(ip)
+			wait = userWait
+		}
+	}
+	if ok {
+		return func() {
+			loginByIP.End(ip)
+			loginByUser.End(user)
+		}, true
+	}
+	authThrottled.Inc("login")
+	c.Header("Retry-After", retryAfterSeconds(wait))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      fmt.Sprintf("too many failed login attempts, try again in %s", wait.Round(time.Second)),
+		"retryAfter": int(math.Ceil(wait.Seconds())),
+	})
+	return nil, false
+}
+
+// loginFailed counts a wrong password or second factor.
+func loginFailed(c *gin.Context, username string) {
+	authFailures.Inc("login")
+	ip := c.ClientIP()
+	wait := max(loginByIP.Fail(ip), loginByUser.Fail(strings.ToLower(username)))
+	if wait > 0 {
+		slog.WarnContext(c.Request.Context(), "throttling console logins", "user", username, "ip", ip, "wait", wait.Round(time.Second))
+	}
+}
+
+// loginSucceeded clears the username's failures. The IP's are kept, so one
+// valid account cannot be used to reset guessing at others.
+func loginSucceeded(username string) {
+	loginByUser.Succeed(strings.ToLower(username))
+}
+
+// apiKeyThrottled writes a 429 and returns true if the client IP sent too many
+// invalid API keys. Every key is refused while blocked, so guessing gets no
+// answer either way.
+func apiKeyThrottled(c *gin.Context) bool {
+	wait, ok := apiKeyByIP.Check(c.ClientIP())
+	if ok {
+		return false
+	}
+	authThrottled.Inc("api_key")
+	c.Header("Retry-After", retryAfterSeconds(wait))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many invalid API keys, try again later"})
+	return true
+}
+
+// apiKeyFailed counts an invalid API key from the client IP.
+func apiKeyFailed(c *gin.Context) {
+	authFailures.Inc("api_key")
+	ip := c.ClientIP()
+	if wait := apiKeyByIP.Fail(ip); wait > 0 {
+		slog.WarnContext(c.Request.Context(), "throttling invalid API keys", "ip", ip, "wait", wait.Round(time.Second))
+	}
+}
+
+// --- Throttle handlers ---
+
+// handleGetThrottles lists recent failures and current blocks.
+func handleGetThrottles(c *gin.Context) {
+	out := gin.H{}
+	for kind, l := range throttleKind {
+		out[kind] = l.Snapshot()
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// handleResetThrottle lifts a block, e.g. for a user locked out by a typo.
+func handleResetThrottle(c *gin.Context) {
+	kind, key := c.Param("kind"), c.Param("key")
+	l, ok := throttleKind[kind]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be login-user, login-ip or api-key-ip"})
+		return
+	}
+	if kind == "login-user" {
+		key = strings.ToLower(key)
+	}
+	if !l.Reset(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no failures recorded for " + key})
+		return
+	}
+	recordAudit(c, "security.throttle_reset", kind+":"+key, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
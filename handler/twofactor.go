@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"copilot-go/store"
+	"copilot-go/totp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// totpIssuer labels the console in authenticator apps.
+const totpIssuer = "copilot-go"
+
+// enrollmentRoutes stay reachable for users who must enroll in 2FA first.
+var enrollmentRoutes = map[string]bool{
+	"GET /api/auth/check":        true,
+	"GET /api/auth/2fa":          true,
+	"POST /api/auth/2fa/enroll":  true,
+	"POST /api/auth/2fa/confirm": true,
+	"POST /api/auth/logout":      true,
+}
+
+// needsEnrollment reports whether the 2FA policy blocks username until they
+// enroll. Single sign-on users are exempt: their provider handles MFA.
+func needsEnrollment(username string) bool {
+	settings, err := store.GetSecuritySettings()
+	if err != nil || !settings.Require2FA {
+		return false
+	}
+	user, err := store.GetUser(username)
+	return err == nil && user != nil && !user.TwoFactor && user.Source != store.UserSourceOIDC
+}
+
+// twoFactorError maps 2FA store errors to responses.
+func twoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrInvalidCode):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, store.ErrTOTPEnabled), errors.Is(err, store.ErrTOTPNotEnabled), errors.Is(err, store.ErrTOTPNotEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		userError(c, err)
+	}
+}
+
+func bindCode(c *gin.Context) (string, bool) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return "", false
+	}
+	return body.Code, true
+}
+
+// --- Two-factor handlers ---
+
+// handleLoginTwoFactor completes a login that handleLogin answered with a
+// challenge, using a TOTP code or a recovery code.
+func handleLoginTwoFactor(c *gin.Context) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Challenge == "" || body.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "challenge and code are required"})
+		return
+	}
+
+	username := store.LoginChallengeUser(body.Challenge)
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": store.ErrChallenge.Error()})
+		return
+	}
+	c.Set(ctxAdminUser, username)
+	done, ok := beginLogin(c, username)
+	if !ok {
+		return
+	}
+	defer done()
+	username, cookie, err := store.CompleteLoginChallenge(body.Challenge, body.Code)
+	if errors.Is(err, store.ErrChallenge) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		loginFailed(c, username)
+		recordAudit(c, "auth.2fa_failed", "user:"+username, nil, nil)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+		return
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil || user == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
+		return
+	}
+	token, err := store.CreateSession(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	loginSucceeded(username)
+	c.Set(ctxAdminSession, store.SessionID(token))
+	recordAudit(c, "auth.login", "user:"+username, nil, nil)
+	respondLogin(c, token, cookie)
+}
+
+func handleGetTwoFactor(c *gin.Context) {
+	username := c.GetString(ctxAdminUser)
+	user, err := store.GetUser(username)
+	if err != nil || user == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+		return
+	}
+	settings, _ := store.GetSecuritySettings()
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":           user.TwoFactor,
+		"required":          settings.Require2FA,
+		"recoveryCodesLeft": store.RecoveryCodesLeft(username),
+	})
+}
+
+// handleBeginTwoFactor starts enrollment and returns the secret and the
+// otpauth:// URI to show as a QR code.
+func handleBeginTwoFactor(c *gin.Context) {
+	username := c.GetString(ctxAdminUser)
+	secret, err := store.BeginTOTPEnrollment(username)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, username, secret),
+	})
+}
+
+func handleConfirmTwoFactor(c *gin.Context) {
+	code, ok := bindCode(c)
+	if !ok {
+		return
+	}
+	username := c.GetString(ctxAdminUser)
+	codes, err := store.ConfirmTOTPEnrollment(username, code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	recordAudit(c, "auth.2fa_enable", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+func handleRegenerateRecoveryCodes(c *gin.Context) {
+	code, ok := bindCode(c)
+	if !ok {
+		return
+	}
+	username := c.GetString(ctxAdminUser)
+	codes, err := store.RegenerateRecoveryCodes(username, code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	recordAudit(c, "auth.2fa_recovery_codes", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// handleDisableTwoFactor turns off the caller's 2FA after checking a code.
+func handleDisableTwoFactor(c *gin.Context) {
+	code, ok := bindCode(c)
+	if !ok {
+		return
+	}
+	if settings, _ := store.GetSecuritySettings(); settings.Require2FA {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is required by policy"})
+		return
+	}
+	username := c.GetString(ctxAdminUser)
+	if _, err := store.VerifySecondFactor(username, code); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	if err := store.DisableTOTP(username); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	recordAudit(c, "auth.2fa_disable", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleResetUserTwoFactor removes another user's 2FA, e.g. after a lost
+// device, and signs them out.
+func handleResetUserTwoFactor(c *gin.Context) {
+	username := c.Param("username")
+	if username == c.GetString(ctxAdminUser) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "use DELETE /api/auth/2fa for your own user"})
+		return
+	}
+	if err := store.DisableTOTP(username); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	store.RevokeUserSessions(username, "")
+	recordAudit(c, "user.reset_2fa", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// --- Security policy handlers ---
+
+func handleGetSecurity(c *gin.Context) {
+	settings, err := store.GetSecuritySettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+func handleUpdateSecurity(c *gin.Context) {
+	var settings store.SecuritySettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	before, _ := store.GetSecuritySettings()
+	if err := store.UpdateSecuritySettings(settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, "security.update", "security", before, settings)
+	c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"copilot-go/store"
+	"copilot-go/throttle"
+	"copilot-go/totp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// consoleTest is a console API on a temporary data directory with totp.Now
+// pinned to now.
+type consoleTest struct {
+	t      *testing.T
+	router *gin.Engine
+	now    time.Time
+}
+
+func newConsoleTest(t *testing.T) *consoleTest {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	ct := &consoleTest{t: t, router: gin.New(), now: time.Unix(1_700_000_000, 0)}
+
+	oldDir, oldNow := store.AppDir, totp.Now
+	oldUser, oldIP := loginByUser, loginByIP
+	store.AppDir = t.TempDir()
+	totp.Now = func() time.Time { return ct.now }
+	loginByUser, loginByIP = throttle.New(loginPolicy(1)), throttle.New(loginPolicy(3))
+	t.Cleanup(func() {
+		store.AppDir, totp.Now = oldDir, oldNow
+		loginByUser, loginByIP = oldUser, oldIP
+	})
+	if err := store.EnsurePaths(); err != nil {
+		t.Fatal(err)
+	}
+	RegisterConsoleAPI(ct.router, 0)
+	return ct
+}
+
+// do sends a JSON request, with token as the bearer token if set, and
+// decodes the JSON response.
+func (ct *consoleTest) do(method, path, token string, body any) (int, map[string]any) {
+	ct.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			ct.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ct.router.ServeHTTP(w, req)
+	var resp map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func (ct *consoleTest) code(secret string) string {
+	ct.t.Helper()
+	code, err := totp.Code(secret, ct.now)
+	if err != nil {
+		ct.t.Fatal(err)
+	}
+	return code
+}
+
+// enroll creates admin "alice", enables 2FA through the API and returns the
+// secret and recovery codes. The clock is left past the confirmation step.
+func (ct *consoleTest) enroll() (string, []any) {
+	ct.t.Helper()
+	if status, resp := ct.do("POST", "/api/auth/setup", "", gin.H{"username": "alice", "password": "correct horse battery"}); status != http.StatusOK {
+		ct.t.Fatalf("setup: %d %v", status, resp)
+	}
+	status, resp := ct.do("POST", "/api/auth/login", "", gin.H{"username": "alice", "password": "correct horse battery"})
+	token, _ := resp["token"].(string)
+	if status != http.StatusOK || token == "" {
+		ct.t.Fatalf("login: %d %v", status, resp)
+	}
+
+	status, resp = ct.do("POST", "/api/auth/2fa/enroll", token, nil)
+	secret, _ := resp["secret"].(string)
+	if status != http.StatusOK || secret == "" {
+		ct.t.Fatalf("enroll: %d %v", status, resp)
+	}
+	status, resp = ct.do("POST", "/api/auth/2fa/confirm", token, gin.H{"code": ct.code(secret)})
+	recovery, _ := resp["recoveryCodes"].([]any)
+	if status != http.StatusOK || len(recovery) == 0 {
+		ct.t.Fatalf("confirm: %d %v", status, resp)
+	}
+	ct.now = ct.now.Add(totp.Period)
+	return secret, recovery
+}
+
+// challenge logs alice in with her password and returns the 2FA challenge.
+func (ct *consoleTest) challenge() string {
+	ct.t.Helper()
+	status, resp := ct.do("POST", "/api/auth/login", "", gin.H{"username": "alice", "password": "correct horse battery"})
+	challenge, _ := resp["challenge"].(string)
+	if status != http.StatusOK || resp["twoFactorRequired"] != true || challenge == "" {
+		ct.t.Fatalf("login with 2FA: %d %v", status, resp)
+	}
+	return challenge
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	ct := newConsoleTest(t)
+	secret, _ := ct.enroll()
+
+	challenge := ct.challenge()
+	status, resp := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": ct.code(secret)})
+	token, _ := resp["token"].(string)
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("second factor: %d %v", status, resp)
+	}
+	if status, resp := ct.do("GET", "/api/auth/2fa", token, nil); status != http.StatusOK || resp["enabled"] != true {
+		t.Fatalf("2FA status: %d %v", status, resp)
+	}
+
+	// The same code cannot complete another login.
+	challenge = ct.challenge()
+	if status, _ := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": ct.code(secret)}); status != http.StatusUnauthorized {
+		t.Fatalf("reused code: status %d, want 401", status)
+	}
+}
+
+func TestLoginTwoFactorRecoveryCode(t *testing.T) {
+	ct := newConsoleTest(t)
+	_, recovery := ct.enroll()
+	code := recovery[0].(string)
+
+	status, _ := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": ct.challenge(), "code": code})
+	if status != http.StatusOK {
+		t.Fatalf("recovery code: status %d, want 200", status)
+	}
+	status, _ = ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": ct.challenge(), "code": code})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("spent recovery code: status %d, want 401", status)
+	}
+}
+
+func TestLoginTwoFactorChallengeLimits(t *testing.T) {
+	ct := newConsoleTest(t)
+	secret, _ := ct.enroll()
+
+	// Expired after five minutes.
+	challenge := ct.challenge()
+	ct.now = ct.now.Add(5*time.Minute + time.Second)
+	status, resp := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": ct.code(secret)})
+	if status != http.StatusUnauthorized || resp["error"] != store.ErrChallenge.Error() {
+		t.Fatalf("expired challenge: %d %v", status, resp)
+	}
+
+	// Spent after five wrong codes. The login throttle is lifted between
+	// them so that only the challenge's own limit applies.
+	challenge = ct.challenge()
+	wrong, _ := totp.Code(secret, ct.now.Add(10*totp.Period))
+	for i := 0; i < 5; i++ {
+		if status, _ := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": wrong}); status != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want 401", i+1, status)
+		}
+		loginByUser.Reset("alice")
+	}
+	status, resp = ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": ct.code(secret)})
+	if status != http.StatusUnauthorized || resp["error"] != store.ErrChallenge.Error() {
+		t.Fatalf("challenge after five wrong codes: %d %v", status, resp)
+	}
+}
+
+func TestLoginTwoFactorThrottled(t *testing.T) {
+	ct := newConsoleTest(t)
+	secret, _ := ct.enroll()
+	challenge := ct.challenge()
+	wrong, _ := totp.Code(secret, ct.now.Add(10*totp.Period))
+	for i := 0; i < 4; i++ {
+		ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": wrong})
+	}
+
+	// Wrong codes count against alice, not just the address.
+	if _, ok := loginByUser.Check("alice"); ok {
+		t.Fatal("alice is not throttled after four wrong codes")
+	}
+	status, _ := ct.do("POST", "/api/auth/login/2fa", "", gin.H{"challenge": challenge, "code": ct.code(secret)})
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("second factor after four wrong codes: status %d, want 429", status)
+	}
+}
+
+func TestLoginParallelAttempts(t *testing.T) {
+	ct := newConsoleTest(t)
+	ct.enroll()
+
+	// Attempts in progress count against the throttle before they fail.
+	for i := 0; i < 3; i++ {
+		if _, ok := loginByUser.Begin("alice"); !ok {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	status, _ := ct.do("POST", "/api/auth/login", "", gin.H{"username": "alice", "password": "correct horse battery"})
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("login with three attempts in progress: status %d, want 429", status)
+	}
+	for i := 0; i < 3; i++ {
+		loginByUser.End("alice")
+	}
+	ct.challenge()
+}
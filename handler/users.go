@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hidesSecrets reports whether the console user may not see tokens and keys.
+func hidesSecrets(c *gin.Context) bool {
+	return !store.RoleAtLeast(c.GetString(ctxAdminRole), store.RoleOperator)
+}
+
+// accountView hides the account's GitHub token and API key from viewers.
+func accountView(c *gin.Context, a store.Account) store.Account {
+	if hidesSecrets(c) {
+		a.GithubToken = ""
+		a.ApiKey = store.MaskApiKey(a.ApiKey)
+	}
+	return a
+}
+
+// poolView masks the pool's API keys for viewers.
+func poolView(c *gin.Context, p store.Pool) store.Pool {
+	if !hidesSecrets(c) {
+		return p
+	}
+	keys := make([]string, len(p.ApiKeys))
+	for i, k := range p.ApiKeys {
+		keys[i] = store.MaskApiKey(k)
+	}
+	p.ApiKeys = keys
+	if p.Hedging != nil {
+		hedging := make(map[string]store.HedgePolicy, len(p.Hedging))
+		for k, policy := range p.Hedging {
+			hedging[store.MaskApiKey(k)] = policy
+		}
+		p.Hedging = hedging
+	}
+	if p.AllowedIPs != nil {
+		allowed := make(map[string][]string, len(p.AllowedIPs))
+		for k, list := range p.AllowedIPs {
+			allowed[store.MaskApiKey(k)] = list
+		}
+		p.AllowedIPs = allowed
+	}
+	return p
+}
+
+// proxyConfigView strips credentials from the proxy URL for viewers.
+func proxyConfigView(c *gin.Context, cfg store.ProxyConfig) store.ProxyConfig {
+	if hidesSecrets(c) {
+		cfg.ProxyURL = redactProxyURL(cfg.ProxyURL)
+	}
+	return cfg
+}
+
+// userError maps user store errors to responses.
+func userError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, store.ErrUserExists), errors.Is(err, store.ErrLastAdmin):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// --- User handlers ---
+
+func handleGetUsers(c *gin.Context) {
+	users, err := store.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func handleCreateUser(c *gin.Context) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Username == "" || body.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+	if body.Role == "" {
+		body.Role = store.RoleViewer
+	}
+	user, err := store.CreateUser(body.Username, body.Password, body.Role)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, "user.create", "user:"+user.Username, nil, user)
+	c.JSON(http.StatusCreated, user)
+}
+
+func handleUpdateUser(c *gin.Context) {
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || !store.ValidRole(body.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin, operator or viewer"})
+		return
+	}
+	username := c.Param("username")
+	before, _ := store.GetUser(username)
+	user, err := store.SetUserRole(username, body.Role)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, "user.update", "user:"+username, before, user)
+	c.JSON(http.StatusOK, user)
+}
+
+func handleDeleteUser(c *gin.Context) {
+	username := c.Param("username")
+	if username == c.GetString(ctxAdminUser) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete your own user"})
+		return
+	}
+	before, _ := store.GetUser(username)
+	if err := store.DeleteUser(username); err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, "user.delete", "user:"+username, before, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleResetUserPassword sets another user's password and signs them out.
+func handleResetUserPassword(c *gin.Context) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is required"})
+		return
+	}
+	username := c.Param("username")
+	if err := store.SetUserPassword(username, body.Password, ""); err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, "user.reset_password", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// handleChangePassword changes the caller's own password and ends their
+// other sessions.
+func handleChangePassword(c *gin.Context) {
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.CurrentPassword == "" || body.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "currentPassword and newPassword are required"})
+		return
+	}
+	username := c.GetString(ctxAdminUser)
+	if _, err := store.VerifyPassword(username, body.CurrentPassword); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "current password is incorrect"})
+		return
+	}
+	if err := store.SetUserPassword(username, body.NewPassword, c.GetString(ctxAdminToken)); err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, "auth.change_password", "user:"+username, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,383 @@
+package instance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-go/store"
+)
+
+const (
+	captureFlushInterval = time.Second
+	captureBuffer        = 256
+
+	defaultCaptureMaxBodyBytes  = 1 << 20
+	defaultCaptureRetentionDays = 3
+)
+
+// RedactedValue replaces masked values in captures.
+const RedactedValue = "[REDACTED]"
+
+// defaultRedactFields are masked wherever they appear in captured JSON bodies.
+var defaultRedactFields = []string{
+	"api_key", "apikey", "access_token", "refresh_token", "id_token",
+	"token", "password", "secret", "client_secret", "authorization",
+}
+
+// redactHeaders are masked in captured headers.
+var redactHeaders = map[string]bool{
+	"authorization":       true,
+	"x-api-key":           true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"proxy-authorization": true,
+}
+
+// secretPrefixes mark string values that are credentials regardless of field name.
+var secretPrefixes = []string{"sk-", "gho_", "ghu_", "ghp_", "ghs_", "github_pat_", "tid="}
+
+// CaptureConfig configures request/response capture.
+type CaptureConfig struct {
+	RedactFields []string // added to the default redacted JSON fields
+	MaxBodyBytes int      // per body; longer bodies are truncated
+	Retention    time.Duration
+}
+
+var (
+	captureMu     sync.RWMutex
+	captureCfg    *CaptureConfig
+	captureFields map[string]bool
+	captures      = make(chan store.Capture, captureBuffer)
+	captureStop   = make(chan chan struct{})
+)
+
+// CaptureConfigFromEnv reads CAPTURE_MAX_BODY_BYTES and CAPTURE_RETENTION_DAYS.
+func CaptureConfigFromEnv(redactFields []string) CaptureConfig {
+	return CaptureConfig{
+		RedactFields: redactFields,
+		MaxBodyBytes: envInt("CAPTURE_MAX_BODY_BYTES", defaultCaptureMaxBodyBytes),
+		Retention:    envDays("CAPTURE_RETENTION_DAYS", defaultCaptureRetentionDays),
+	}
+}
+
+// StartCapture enables request/response capture and starts the background
+// writer that persists captures and prunes expired ones.
+func StartCapture(cfg CaptureConfig) {
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultCaptureMaxBodyBytes
+	}
+	fields := make(map[string]bool)
+	for _, f := range append(defaultRedactFields, cfg.RedactFields...) {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+			fields[f] = true
+		}
+	}
+
+	captureMu.Lock()
+	captureCfg = &cfg
+	captureFields = fields
+	captureMu.Unlock()
+
+	go func() {
+		flush := time.NewTicker(captureFlushInterval)
+		defer flush.Stop()
+		prune := time.NewTicker(usageCompactInterval)
+		defer prune.Stop()
+
+		pruneCaptures(cfg.Retention)
+		var batch []store.Capture
+		persist := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := store.AppendCaptures(batch); err != nil {
+				slog.Error("failed to persist captures", "count", len(batch), "err", err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case c := <-captures:
+				batch = append(batch, c)
+			case <-flush.C:
+				persist()
+			case <-prune.C:
+				pruneCaptures(cfg.Retention)
+			case done := <-captureStop:
+				for len(captures) > 0 {
+					batch = append(batch, <-captures)
+				}
+				persist()
+				close(done)
+				return
+			}
+		}
+	}()
+	slog.Info("request capture enabled", "dir", store.CaptureDir(), "retention", cfg.Retention.String())
+}
+
+// StopCapture writes the queued captures, stops the writer and disables
+// capture, giving up on the flush when ctx ends.
+func StopCapture(ctx context.Context) {
+	captureMu.Lock()
+	enabled := captureCfg != nil
+	captureCfg = nil
+	captureMu.Unlock()
+	if enabled {
+		stopWriter(ctx, captureStop)
+	}
+}
+
+func pruneCaptures(retention time.Duration) {
+	if err := store.PruneCaptures(retention); err != nil {
+		slog.Error("failed to prune captures", "err", err)
+	}
+}
+
+// CaptureMaxBodyBytes returns the body size limit, or 0 when capture is off.
+func CaptureMaxBodyBytes() int {
+	captureMu.RLock()
+	defer captureMu.RUnlock()
+	if captureCfg == nil {
+		return 0
+	}
+	return captureCfg.MaxBodyBytes
+}
+
+// RecordCapture queues a capture for persistence, dropping it if the writer
+// falls behind.
+func RecordCapture(c store.Capture) {
+	select {
+	case captures <- c:
+	default:
+		slog.Warn("capture buffer full, dropping capture", "request_id", c.ID)
+	}
+}
+
+// CaptureMessage builds a redacted captured message. JSON bodies are kept as
+// JSON with sensitive fields masked; other bodies are kept as text.
+func CaptureMessage(header http.Header, body []byte, truncated bool) store.CapturedMessage {
+	msg := store.CapturedMessage{Headers: RedactHeaders(header), Truncated: truncated}
+	if len(body) == 0 {
+		return msg
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if !truncated && dec.Decode(&v) == nil {
+		captureMu.RLock()
+		fields := captureFields
+		captureMu.RUnlock()
+		if redacted, err := json.Marshal(redactValue(v, fields)); err == nil {
+			msg.Body = redacted
+			return msg
+		}
+	}
+	msg.Text = redactText(string(body))
+	return msg
+}
+
+// RedactHeaders flattens headers and masks credentials.
+func RedactHeaders(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if redactHeaders[strings.ToLower(k)] {
+			out[k] = RedactedValue
+			continue
+		}
+		out[k] = redactText(strings.Join(v, ", "))
+	}
+	return out
+}
+
+func redactValue(v interface{}, fields map[string]bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if fields[strings.ToLower(k)] {
+				if _, isString := child.(string); isString || child == nil {
+					val[k] = RedactedValue
+					continue
+				}
+			}
+			val[k] = redactValue(child, fields)
+		}
+		return val
+	case []interface{}:
+		for i, child := range val {
+			val[i] = redactValue(child, fields)
+		}
+		return val
+	case string:
+		if looksSecret(val) {
+			return RedactedValue
+		}
+	}
+	return v
+}
+
+func looksSecret(s string) bool {
+	for _, p := range secretPrefixes {
+		if strings.HasPrefix(s, p) && len(s) > len(p)+8 {
+			return true
+		}
+	}
+	return false
+}
+
+// redactText masks credential-looking words in free text such as SSE streams.
+func redactText(s string) string {
+	if !strings.ContainsAny(s, "_-=") {
+		return s
+	}
+	var b bytes.Buffer
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		word := s[start:end]
+		if looksSecret(word) {
+			b.WriteString(RedactedValue)
+		} else {
+			b.WriteString(word)
+		}
+		start = -1
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch == ' ' || ch == '"' || ch == '\n' || ch == '\t' || ch == ',' {
+			flush(i)
+			b.WriteByte(ch)
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	flush(len(s))
+	return b.String()
+}
+
+type captureRecorderKey struct{}
+
+// CaptureRecorder collects the upstream exchanges made while serving one
+// captured request. All methods are safe on a nil receiver.
+type CaptureRecorder struct {
+	mu        sync.Mutex
+	limit     int
+	exchanges []*upstreamCapture
+}
+
+// upstreamCapture is an in-progress UpstreamExchange whose response body is
+// copied as the handler reads it.
+type upstreamCapture struct {
+	mu            sync.Mutex
+	limit         int
+	ex            store.UpstreamExchange
+	reqHeader     http.Header
+	reqBody       []byte
+	respHeader    http.Header
+	respBody      bytes.Buffer
+	respTruncated bool
+}
+
+// WithCaptureRecorder returns ctx carrying a new recorder, or ctx and nil
+// when capture is off.
+func WithCaptureRecorder(ctx context.Context) (context.Context, *CaptureRecorder) {
+	limit := CaptureMaxBodyBytes()
+	if limit == 0 {
+		return ctx, nil
+	}
+	r := &CaptureRecorder{limit: limit}
+	return context.WithValue(ctx, captureRecorderKey{}, r), r
+}
+
+// captureUpstream starts recording an upstream request if ctx carries a recorder.
+func captureUpstream(ctx context.Context, accountID string, req *http.Request, body []byte) *upstreamCapture {
+	r, _ := ctx.Value(captureRecorderKey{}).(*CaptureRecorder)
+	if r == nil {
+		return nil
+	}
+	u := &upstreamCapture{
+		limit:     r.limit,
+		ex:        store.UpstreamExchange{AccountID: accountID, Method: req.Method, Path: req.URL.Path},
+		reqHeader: req.Header.Clone(),
+		reqBody:   body,
+	}
+	r.mu.Lock()
+	r.exchanges = append(r.exchanges, u)
+	r.mu.Unlock()
+	return u
+}
+
+// finish records the upstream result and tees the response body into the capture.
+func (u *upstreamCapture) finish(start time.Time, resp *http.Response, err error) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ex.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		u.ex.Error = err.Error()
+		return
+	}
+	u.ex.Status = resp.StatusCode
+	u.respHeader = resp.Header.Clone()
+	resp.Body = &captureBody{ReadCloser: resp.Body, u: u}
+}
+
+type captureBody struct {
+	io.ReadCloser
+	u *upstreamCapture
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.u.mu.Lock()
+		data := p[:n]
+		if room := b.u.limit - b.u.respBody.Len(); len(data) > room {
+			data = data[:max(room, 0)]
+			b.u.respTruncated = true
+		}
+		b.u.respBody.Write(data)
+		b.u.mu.Unlock()
+	}
+	return n, err
+}
+
+// Exchanges returns the redacted upstream exchanges recorded so far.
+func (r *CaptureRecorder) Exchanges() []store.UpstreamExchange {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]store.UpstreamExchange, 0, len(r.exchanges))
+	for _, u := range r.exchanges {
+		u.mu.Lock()
+		ex := u.ex
+		reqBody := u.reqBody
+		reqTruncated := len(reqBody) > u.limit
+		if reqTruncated {
+			reqBody = reqBody[:u.limit]
+		}
+		ex.Request = CaptureMessage(u.reqHeader, reqBody, reqTruncated)
+		ex.Response = CaptureMessage(u.respHeader, u.respBody.Bytes(), u.respTruncated)
+		u.mu.Unlock()
+		out = append(out, ex)
+	}
+	return out
+}
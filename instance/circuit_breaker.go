@@ -0,0 +1,412 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FailureClass groups upstream failures that share a cause and a recovery pattern.
+type FailureClass string
+
+const (
+	FailureAuth    FailureClass = "auth"    // 401/403, token refresh failures
+	FailureQuota   FailureClass = "quota"   // 429
+	FailureServer  FailureClass = "server"  // 5xx
+	FailureNetwork FailureClass = "network" // transport errors
+)
+
+// BreakerState is the state of an account's circuit breaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+const (
+	breakerBaseOpenDuration = 30 * time.Second
+	breakerMaxOpenDuration  = 10 * time.Minute
+	// breakerProbeTimeout frees the half-open probe slot if its request never reports back.
+	breakerProbeTimeout = 2 * time.Minute
+)
+
+// breakerThresholds is the number of consecutive failures of a class that trips the breaker.
+var breakerThresholds = map[FailureClass]int{
+	FailureAuth:    2,
+	FailureQuota:   3,
+	FailureServer:  5,
+	FailureNetwork: 3,
+}
+
+// circuitBreaker tracks the health of a single account.
+type circuitBreaker struct {
+	mu            sync.Mutex
+	state         BreakerState
+	failures      map[FailureClass]int // consecutive failures per class
+	trips         int                  // consecutive trips, drives exponential backoff
+	openedAt      time.Time
+	openUntil     time.Time
+	lastClass     FailureClass
+	lastError     string
+	probeInFlight bool
+	probeStarted  time.Time
+	probeTimer    *time.Timer
+}
+
+// CircuitBreakerSnapshot is a point-in-time view of an account's circuit breaker.
+type CircuitBreakerSnapshot struct {
+	State      BreakerState         `json:"state"`
+	Failures   map[FailureClass]int `json:"failures"`
+	Trips      int                  `json:"trips"`
+	OpenedAt   string               `json:"openedAt,omitempty"`  // RFC3339 or empty
+	OpenUntil  string               `json:"openUntil,omitempty"` // RFC3339 or empty
+	LastClass  FailureClass         `json:"lastClass,omitempty"`
+	LastError  string               `json:"lastError,omitempty"`
+	ProbeState string               `json:"probeState,omitempty"`
+}
+
+var (
+	breakers   = make(map[string]*circuitBreaker)
+	breakersMu sync.RWMutex
+)
+
+func getOrCreateBreaker(accountID string) *circuitBreaker {
+	breakersMu.RLock()
+	b, ok := breakers[accountID]
+	breakersMu.RUnlock()
+	if ok {
+		return b
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok = breakers[accountID]; ok {
+		return b
+	}
+	b = &circuitBreaker{state: BreakerClosed, failures: make(map[FailureClass]int)}
+	breakers[accountID] = b
+	return b
+}
+
+// ClassifyUpstreamResult maps an upstream response or transport error to a failure class.
+// Returns "" for outcomes that count as success.
+func ClassifyUpstreamResult(statusCode int, err error) FailureClass {
+	switch {
+	case err != nil:
+		if errors.Is(err, context.Canceled) {
+			// The downstream client went away; that says nothing about the account.
+			return ""
+		}
+		return FailureNetwork
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return FailureAuth
+	case statusCode == http.StatusTooManyRequests:
+		return FailureQuota
+	case statusCode >= 500:
+		return FailureServer
+	default:
+		return ""
+	}
+}
+
+// RecordUpstreamResult feeds the outcome of an upstream request into the account's
+// circuit breaker. resp may be nil when err is set.
+func RecordUpstreamResult(accountID string, resp *http.Response, err error) {
+	if accountID == "" {
+		return
+	}
+	statusCode := 0
+	var retryAfter time.Duration
+	if resp != nil {
+		statusCode = resp.StatusCode
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	class := ClassifyUpstreamResult(statusCode, err)
+	if class == "" {
+		if err == nil {
+			getOrCreateBreaker(accountID).recordSuccess(accountID)
+		} else {
+			ReleaseBreaker(accountID)
+		}
+		return
+	}
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	} else {
+		msg = "upstream returned " + strconv.Itoa(statusCode)
+	}
+	getOrCreateBreaker(accountID).recordFailure(accountID, class, msg, retryAfter)
+}
+
+// tripCircuitBreaker records a failure detected outside the request path
+// (e.g., token refresh) and opens the breaker immediately.
+func tripCircuitBreaker(accountID string, class FailureClass, msg string) {
+	b := getOrCreateBreaker(accountID)
+	b.mu.Lock()
+	b.failures[class] = breakerThresholds[class]
+	b.mu.Unlock()
+	b.recordFailure(accountID, class, msg, 0)
+}
+
+func (b *circuitBreaker) recordSuccess(accountID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerClosed {
+		slog.Info("circuit breaker closed", "account", accountID)
+	}
+	b.closeLocked()
+}
+
+func (b *circuitBreaker) closeLocked() {
+	b.state = BreakerClosed
+	b.failures = make(map[FailureClass]int)
+	b.trips = 0
+	b.openedAt = time.Time{}
+	b.openUntil = time.Time{}
+	b.probeInFlight = false
+	if b.probeTimer != nil {
+		b.probeTimer.Stop()
+		b.probeTimer = nil
+	}
+}
+
+func (b *circuitBreaker) recordFailure(accountID string, class FailureClass, msg string, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastClass = class
+	b.lastError = msg
+	for c := range b.failures {
+		if c != class {
+			b.failures[c] = 0
+		}
+	}
+	b.failures[class]++
+
+	// A failed half-open probe re-opens immediately; a Retry-After from upstream
+	// is an explicit instruction to back off. Otherwise wait for the threshold.
+	if b.state != BreakerHalfOpen && retryAfter <= 0 && b.failures[class] < breakerThresholds[class] {
+		return
+	}
+	if b.state == BreakerOpen && time.Now().Before(b.openUntil) {
+		return
+	}
+	b.openLocked(accountID, retryAfter)
+}
+
+func (b *circuitBreaker) openLocked(accountID string, retryAfter time.Duration) {
+	b.trips++
+	d := breakerBaseOpenDuration << (b.trips - 1)
+	if d <= 0 || d > breakerMaxOpenDuration {
+		d = breakerMaxOpenDuration
+	}
+	if retryAfter > d {
+		d = retryAfter
+	}
+
+	now := time.Now()
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.openUntil = now.Add(d)
+	b.probeInFlight = false
+	breakerTrips.Inc(accountID, string(b.lastClass))
+	slog.Warn("circuit breaker opened", "account", accountID, "duration", d.Round(time.Second), "class", b.lastClass, "err", b.lastError)
+
+	if b.probeTimer != nil {
+		b.probeTimer.Stop()
+	}
+	b.probeTimer = time.AfterFunc(d, func() { probeAccount(accountID) })
+}
+
+// available reports whether the breaker admits a request without changing state.
+func (b *circuitBreaker) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return !now.Before(b.openUntil)
+	case BreakerHalfOpen:
+		return !b.probeInFlight || now.Sub(b.probeStarted) > breakerProbeTimeout
+	default:
+		return true
+	}
+}
+
+// acquire admits a request, turning it into the half-open probe when the
+// open period has elapsed.
+func (b *circuitBreaker) acquire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && !now.Before(b.openUntil) {
+		b.state = BreakerHalfOpen
+	}
+	if b.state == BreakerHalfOpen {
+		b.probeInFlight = true
+		b.probeStarted = now
+	}
+}
+
+// breakerAvailable reports whether the account's breaker admits traffic.
+func breakerAvailable(accountID string, now time.Time) bool {
+	breakersMu.RLock()
+	b, ok := breakers[accountID]
+	breakersMu.RUnlock()
+	return !ok || b.available(now)
+}
+
+// release frees the half-open probe slot without a verdict on the account.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probeInFlight = false
+	}
+}
+
+// AcquireBreaker marks the request about to be sent to the account as the
+// half-open probe if needed. Call it right before the upstream request; the
+// request must then report through RecordUpstreamResult or ReleaseBreaker.
+func AcquireBreaker(accountID string) {
+	breakersMu.RLock()
+	b, ok := breakers[accountID]
+	breakersMu.RUnlock()
+	if ok {
+		b.acquire(time.Now())
+	}
+}
+
+// ReleaseBreaker frees the probe slot of an acquired request that ended
+// without telling anything about the account, such as a cancelled hedge.
+func ReleaseBreaker(accountID string) {
+	breakersMu.RLock()
+	b, ok := breakers[accountID]
+	breakersMu.RUnlock()
+	if ok {
+		b.release()
+	}
+}
+
+// probeAccount actively checks an account whose open period has elapsed:
+// auth failures get a token refresh first, then a cheap models request decides
+// whether the breaker closes or re-opens.
+func probeAccount(accountID string) {
+	b := getOrCreateBreaker(accountID)
+	b.mu.Lock()
+	if b.state != BreakerOpen || b.probeInFlight {
+		b.mu.Unlock()
+		return
+	}
+	b.state = BreakerHalfOpen
+	b.probeInFlight = true
+	b.probeStarted = time.Now()
+	class := b.lastClass
+	b.mu.Unlock()
+
+	mu.RLock()
+	inst, ok := instances[accountID]
+	mu.RUnlock()
+	if !ok || inst.Status == "stopped" {
+		b.mu.Lock()
+		b.probeInFlight = false
+		b.mu.Unlock()
+		return
+	}
+
+	var err error
+	if class == FailureAuth {
+		err = refreshCopilotToken(inst.State)
+	}
+	if err == nil {
+		err = fetchModels(inst.State)
+	}
+	if err != nil {
+		slog.Warn("circuit breaker probe failed", "account", accountID, "err", err)
+		b.recordFailure(accountID, class, err.Error(), 0)
+		return
+	}
+
+	slog.Info("circuit breaker probe succeeded", "account", accountID)
+	b.recordSuccess(accountID)
+	markInstanceRecovered(inst)
+}
+
+// ResetCircuitBreaker force-closes an account's circuit breaker.
+func ResetCircuitBreaker(accountID string) {
+	getOrCreateBreaker(accountID).recordSuccess(accountID)
+}
+
+func (b *circuitBreaker) snapshot() CircuitBreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snap := CircuitBreakerSnapshot{
+		State:     b.state,
+		Failures:  make(map[FailureClass]int, len(b.failures)),
+		Trips:     b.trips,
+		LastClass: b.lastClass,
+		LastError: b.lastError,
+	}
+	for c, n := range b.failures {
+		if n > 0 {
+			snap.Failures[c] = n
+		}
+	}
+	if !b.openedAt.IsZero() {
+		snap.OpenedAt = b.openedAt.Format(time.RFC3339)
+	}
+	if !b.openUntil.IsZero() {
+		snap.OpenUntil = b.openUntil.Format(time.RFC3339)
+	}
+	if b.state == BreakerHalfOpen && b.probeInFlight {
+		snap.ProbeState = "in-flight"
+	}
+	return snap
+}
+
+// GetCircuitBreakerSnapshot returns the circuit breaker state for a single account.
+func GetCircuitBreakerSnapshot(accountID string) CircuitBreakerSnapshot {
+	breakersMu.RLock()
+	b, ok := breakers[accountID]
+	breakersMu.RUnlock()
+	if !ok {
+		return CircuitBreakerSnapshot{State: BreakerClosed, Failures: map[FailureClass]int{}}
+	}
+	return b.snapshot()
+}
+
+// GetAllCircuitBreakerSnapshots returns circuit breaker state for all tracked accounts.
+func GetAllCircuitBreakerSnapshots() map[string]CircuitBreakerSnapshot {
+	breakersMu.RLock()
+	defer breakersMu.RUnlock()
+
+	result := make(map[string]CircuitBreakerSnapshot, len(breakers))
+	for id, b := range breakers {
+		result[id] = b.snapshot()
+	}
+	return result
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"copilot-go/anthropic"
+	"copilot-go/store"
+)
+
+// StreamFormat is the SSE dialect written to the client.
+type StreamFormat string
+
+const (
+	StreamFormatOpenAI    StreamFormat = "openai"
+	StreamFormatAnthropic StreamFormat = "anthropic"
+)
+
+// StreamBrokenError reports that the upstream SSE stream failed after the
+// response had started.
+type StreamBrokenError struct {
+	Err error
+}
+
+func (e *StreamBrokenError) Error() string {
+	return fmt.Sprintf("upstream stream broke: %v", e.Err)
+}
+
+func (e *StreamBrokenError) Unwrap() error {
+	return e.Err
+}
+
+// StreamFailover tracks one streaming request across upstream attempts when
+// mid-stream failover is enabled on the pool. Output is held back until the
+// first content event, so a stream that breaks before then can be replayed
+// on another account without the client noticing. A nil *StreamFailover
+// disables failover and writes straight through.
+type StreamFailover struct {
+	mode      string
+	format    StreamFormat
+	committed bool
+	toolUse   bool
+	partial   strings.Builder
+	pending   [][]byte
+
+	// anthropicState is shared by attempts once output is committed, so a
+	// continuation extends the open content block instead of starting a new message.
+	anthropicState *anthropic.AnthropicStreamState
+}
+
+// NewStreamFailover returns failover state for a streaming request, or nil when
+// mode does not enable failover.
+func NewStreamFailover(mode string, format StreamFormat) *StreamFailover {
+	if mode != store.StreamFailoverRetry && mode != store.StreamFailoverContinue {
+		return nil
+	}
+	return &StreamFailover{mode: mode, format: format}
+}
+
+// Committed reports whether content has reached the client.
+func (f *StreamFailover) Committed() bool {
+	return f != nil && f.committed
+}
+
+// CanResume reports whether another attempt may take over the stream: always
+// before content was sent, and in "continue" mode for text-only partial output.
+func (f *StreamFailover) CanResume() bool {
+	if f == nil {
+		return false
+	}
+	if !f.committed {
+		return true
+	}
+	return f.mode == store.StreamFailoverContinue && !f.toolUse && strings.TrimSpace(f.partial.String()) != ""
+}
+
+// RequestBody returns the body for the next attempt. When continuing committed
+// output, the partial assistant text is appended as a prefill message.
+func (f *StreamFailover) RequestBody(body []byte) []byte {
+	if !f.Committed() {
+		return body
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return body
+	}
+	messages, _ := payload["messages"].([]interface{})
+	// Trailing whitespace in a final assistant message is rejected upstream.
+	messages = append(messages, map[string]interface{}{
+		"role":    "assistant",
+		"content": strings.TrimRight(f.partial.String(), " \t\r\n"),
+	})
+	payload["messages"] = messages
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// streamState returns the Anthropic translation state for the current attempt.
+// Uncommitted attempts start fresh since their buffered preamble is discarded.
+func (f *StreamFailover) streamState() *anthropic.AnthropicStreamState {
+	if f == nil {
+		return anthropic.NewStreamState()
+	}
+	if !f.committed || f.anthropicState == nil {
+		f.anthropicState = anthropic.NewStreamState()
+	}
+	return f.anthropicState
+}
+
+// write sends data to the client, buffering it until the first content write.
+func (f *StreamFailover) write(w io.Writer, data []byte, content bool) error {
+	if f == nil {
+		_, err := w.Write(data)
+		return err
+	}
+	if !f.committed && !content {
+		f.pending = append(f.pending, append([]byte(nil), data...))
+		return nil
+	}
+	if err := f.flushPending(w); err != nil {
+		return err
+	}
+	f.committed = true
+	_, err := w.Write(data)
+	return err
+}
+
+func (f *StreamFailover) flushPending(w io.Writer) error {
+	if f == nil {
+		return nil
+	}
+	for _, p := range f.pending {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	f.pending = nil
+	return nil
+}
+
+// observeText records assistant text streamed to the client.
+func (f *StreamFailover) observeText(text string) {
+	if f != nil {
+		f.partial.WriteString(text)
+	}
+}
+
+// observeToolUse marks the output as containing a tool call, which cannot be continued.
+func (f *StreamFailover) observeToolUse() {
+	if f != nil {
+		f.toolUse = true
+	}
+}
+
+// Abort ends the stream with an error event in the client's SSE dialect,
+// flushing any held-back preamble first.
+func (f *StreamFailover) Abort(w io.Writer, message string) {
+	if f == nil {
+		return
+	}
+	_ = f.flushPending(w)
+	if f.format == StreamFormatAnthropic {
+		_ = writeSSE(w, "error", map[string]interface{}{
+			"type": "error",
+			"error": map[string]string{
+				"type":    "stream_error",
+				"message": message,
+			},
+		})
+	} else {
+		data, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]string{
+				"type":    "stream_error",
+				"message": message,
+			},
+		})
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -2,10 +2,12 @@ package instance
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"strings"
@@ -13,19 +15,22 @@ import (
 	"copilot-go/anthropic"
 	"copilot-go/config"
 	"copilot-go/store"
+	"copilot-go/tracing"
 
 	"github.com/gin-gonic/gin"
 )
 
 // DoCompletionsProxy performs the upstream request for completions and returns the raw response.
 // The caller is responsible for closing resp.Body.
-func DoCompletionsProxy(_ *gin.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
+func DoCompletionsProxy(ctx context.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
 	bodyBytes, extraHeaders, hasVision := normalizeCompletionsPayload(state, bodyBytes)
-	return ProxyRequestWithBytes(state, "POST", "/chat/completions", bodyBytes, extraHeaders, hasVision)
+	return ProxyRequestWithBytesCtx(ctx, state, "POST", "/chat/completions", bodyBytes, extraHeaders, hasVision)
 }
 
 // ForwardCompletionsResponse writes the upstream response to the client.
-func ForwardCompletionsResponse(c *gin.Context, resp *http.Response) {
+// With a non-nil fo, a broken stream is returned as *StreamBrokenError for the
+// caller to fail over instead of being cut short.
+func ForwardCompletionsResponse(c *gin.Context, resp *http.Response, fo *StreamFailover) error {
 	defer func() { _ = resp.Body.Close() }()
 
 	contentType := resp.Header.Get("Content-Type")
@@ -38,11 +43,15 @@ func ForwardCompletionsResponse(c *gin.Context, resp *http.Response) {
 		c.Header("X-Accel-Buffering", "no")
 		c.Status(resp.StatusCode)
 
+		var streamErr error
+		usage := RequestUsageFrom(c)
 		reader := bufio.NewReaderSize(resp.Body, 10*1024*1024)
 		c.Stream(func(w io.Writer) bool {
 			line, err := reader.ReadBytes('\n')
-			if len(line) > 0 {
-				if _, writeErr := w.Write(line); writeErr != nil {
+			usage.observeSSELine(line)
+			// A partial line from a broken stream is dropped when failing over.
+			if len(line) > 0 && (err == nil || err == io.EOF || fo == nil) {
+				if writeErr := fo.write(w, line, completionsLineHasContent(line, fo)); writeErr != nil {
 					return false
 				}
 				if flusher, ok := w.(http.Flusher); ok {
@@ -51,20 +60,59 @@ func ForwardCompletionsResponse(c *gin.Context, resp *http.Response) {
 			}
 			if err != nil {
 				if err != io.EOF {
-					log.Printf("Stream read error: %v", err)
+					slog.WarnContext(c.Request.Context(), "stream read error", "err", err)
+					if fo != nil {
+						streamErr = &StreamBrokenError{Err: err}
+						return false
+					}
 				}
+				_ = fo.flushPending(w)
 				return false
 			}
 			return true
 		})
-	} else {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read response"})
-			return
+		return streamErr
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read response"})
+		return nil
+	}
+	RequestUsageFrom(c).observeBody(body)
+	c.Data(resp.StatusCode, "application/json", body)
+	return nil
+}
+
+// completionsLineHasContent reports whether an OpenAI SSE line carries
+// assistant output, recording it for failover. Always false without failover.
+func completionsLineHasContent(line []byte, fo *StreamFailover) bool {
+	if fo == nil {
+		return false
+	}
+	data, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "data: ")
+	if !ok || data == "[DONE]" {
+		return false
+	}
+	var chunk anthropic.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return false
+	}
+	content := false
+	for _, choice := range chunk.Choices {
+		if choice.Delta == nil {
+			continue
+		}
+		if choice.Delta.Content != "" {
+			fo.observeText(choice.Delta.Content)
+			content = true
+		}
+		if len(choice.Delta.ToolCalls) > 0 {
+			fo.observeToolUse()
+			content = true
 		}
-		c.Data(resp.StatusCode, "application/json", body)
 	}
+	return content
 }
 
 // ModelsHandler returns cached models with display ID mapping.
@@ -95,14 +143,36 @@ func ModelsHandler(c *gin.Context, state *config.State) {
 			Version:      m.Version,
 			Vendor:       m.Vendor,
 			Capabilities: m.Capabilities,
+			Billing:      m.Billing,
 		}
 	}
 
 	c.JSON(http.StatusOK, mapped)
 }
 
+// PooledModelsHandler returns the union of models across pool accounts with
+// display ID mapping and per-model availability counts.
+func PooledModelsHandler(c *gin.Context, pool *store.Pool) {
+	models, err := GetPooledModels(pool)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := make([]PooledModelEntry, len(models))
+	for i, m := range models {
+		m.ID = store.ToDisplayID(m.ID)
+		data[i] = m
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
+
 // DoEmbeddingsProxy performs the upstream request for embeddings.
-func DoEmbeddingsProxy(state *config.State, bodyBytes []byte) (*http.Response, error) {
+func DoEmbeddingsProxy(ctx context.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
 	var payload map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &payload); err == nil {
 		if model, ok := payload["model"].(string); ok {
@@ -111,7 +181,7 @@ func DoEmbeddingsProxy(state *config.State, bodyBytes []byte) (*http.Response, e
 		}
 	}
 
-	return ProxyRequestWithBytes(state, "POST", "/embeddings", bodyBytes, nil, false)
+	return ProxyRequestWithBytesCtx(ctx, state, "POST", "/embeddings", bodyBytes, nil, false)
 }
 
 // ForwardEmbeddingsResponse writes the upstream embeddings response to the client.
@@ -123,12 +193,13 @@ func ForwardEmbeddingsResponse(c *gin.Context, resp *http.Response) {
 		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read response"})
 		return
 	}
+	RequestUsageFrom(c).observeBody(body)
 	c.Data(resp.StatusCode, "application/json", body)
 }
 
 // DoMessagesProxy performs the upstream request for Anthropic messages.
 // Returns the raw response. bodyBytes is the original Anthropic payload.
-func DoMessagesProxy(c *gin.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
+func DoMessagesProxy(ctx context.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
 	var anthropicPayload anthropic.AnthropicMessagesPayload
 	if err := json.Unmarshal(bodyBytes, &anthropicPayload); err != nil {
 		return nil, fmt.Errorf("invalid request: %v", err)
@@ -143,7 +214,13 @@ func DoMessagesProxy(c *gin.Context, state *config.State, bodyBytes []byte) (*ht
 	}
 
 	hasVision := checkVisionContent(anthropicPayload)
+	_, span := tracing.Start(ctx, "anthropic.translate_request",
+		tracing.String("gen_ai.request.model", anthropicPayload.Model),
+		tracing.Int("anthropic.messages", len(anthropicPayload.Messages)),
+		tracing.Int("anthropic.tools", len(anthropicPayload.Tools)),
+		tracing.Bool("anthropic.stream", anthropicPayload.Stream))
 	openaiPayload := anthropic.TranslateToOpenAI(anthropicPayload)
+	span.End()
 
 	openaiBytes, err := json.Marshal(openaiPayload)
 	if err != nil {
@@ -153,25 +230,26 @@ func DoMessagesProxy(c *gin.Context, state *config.State, bodyBytes []byte) (*ht
 	extraHeaders := make(http.Header)
 	extraHeaders.Set("X-Initiator", initiatorFromMessages(openaiPayload.Messages))
 
-	return ProxyRequestWithBytesCtx(c.Request.Context(), state, "POST", "/chat/completions", openaiBytes, extraHeaders, hasVision)
+	return ProxyRequestWithBytesCtx(ctx, state, "POST", "/chat/completions", openaiBytes, extraHeaders, hasVision)
 }
 
 // ForwardMessagesResponse writes the upstream response to the client in Anthropic format.
 // originalBody is the original Anthropic request (used to determine stream mode).
-func ForwardMessagesResponse(c *gin.Context, resp *http.Response, originalBody []byte) {
+// With a non-nil fo, a broken stream is returned as *StreamBrokenError.
+func ForwardMessagesResponse(c *gin.Context, resp *http.Response, originalBody []byte, fo *StreamFailover) error {
 	defer func() { _ = resp.Body.Close() }()
 
 	var anthropicPayload anthropic.AnthropicMessagesPayload
 	if err := json.Unmarshal(originalBody, &anthropicPayload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
-		return
+		return nil
 	}
 
 	if anthropicPayload.Stream {
-		handleAnthropicStream(c, resp)
-	} else {
-		handleAnthropicNonStream(c, resp)
+		return handleAnthropicStream(c, resp, fo)
 	}
+	handleAnthropicNonStream(c, resp)
+	return nil
 }
 
 func handleAnthropicNonStream(c *gin.Context, resp *http.Response) {
@@ -185,6 +263,7 @@ func handleAnthropicNonStream(c *gin.Context, resp *http.Response) {
 		c.Data(resp.StatusCode, "application/json", body)
 		return
 	}
+	RequestUsageFrom(c).observeBody(body)
 
 	var openaiResp anthropic.ChatCompletionResponse
 	if err := json.Unmarshal(body, &openaiResp); err != nil {
@@ -192,17 +271,24 @@ func handleAnthropicNonStream(c *gin.Context, resp *http.Response) {
 		return
 	}
 
+	_, span := tracing.Start(responseContext(resp), "anthropic.translate_response")
 	anthropicResp := anthropic.TranslateToAnthropic(openaiResp)
+	span.SetAttributes(
+		tracing.String("gen_ai.response.model", anthropicResp.Model),
+		tracing.String("gen_ai.response.finish_reasons", anthropicResp.StopReason),
+		tracing.Int("gen_ai.usage.input_tokens", anthropicResp.Usage.InputTokens),
+		tracing.Int("gen_ai.usage.output_tokens", anthropicResp.Usage.OutputTokens))
+	span.End()
 	c.JSON(http.StatusOK, anthropicResp)
 }
 
-func handleAnthropicStream(c *gin.Context, resp *http.Response) {
+func handleAnthropicStream(c *gin.Context, resp *http.Response, fo *StreamFailover) error {
 	// If upstream returned an error, translate it properly instead of trying to SSE-parse
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("[Stream] Upstream returned status %d: %s", resp.StatusCode, string(body))
+		slog.WarnContext(c.Request.Context(), "upstream returned error status for stream", "status", resp.StatusCode, "body", string(body))
 		c.Data(resp.StatusCode, "application/json", body)
-		return
+		return nil
 	}
 
 	c.Header("Content-Type", "text/event-stream")
@@ -216,18 +302,34 @@ func handleAnthropicStream(c *gin.Context, resp *http.Response) {
 	flusher, hasFlusher := w.(http.Flusher)
 	clientGone := c.Request.Context().Done()
 
-	state := anthropic.NewStreamState()
+	state := fo.streamState()
+	usage := RequestUsageFrom(c)
+
+	_, span := tracing.Start(responseContext(resp), "anthropic.translate_stream")
+	var eventCount int
+	var stopReason string
+	defer func() {
+		span.SetAttributes(
+			tracing.String("gen_ai.response.model", state.Model),
+			tracing.String("gen_ai.response.finish_reasons", stopReason),
+			tracing.Int("gen_ai.usage.input_tokens", state.InputTokens),
+			tracing.Int("gen_ai.usage.output_tokens", state.OutputTokens),
+			tracing.Int("anthropic.events", eventCount))
+		span.End()
+	}()
 	scanner := bufio.NewScanner(resp.Body)
 	scanner.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
 
 	for scanner.Scan() {
 		select {
 		case <-clientGone:
-			log.Printf("[Stream] Client disconnected, stopping stream")
-			return
+			slog.DebugContext(c.Request.Context(), "client disconnected, stopping stream")
+			span.AddEvent("client_disconnected")
+			return nil
 		default:
 		}
 
+		usage.observeSSELine(scanner.Bytes())
 		line := scanner.Text()
 		if !strings.HasPrefix(line, "data: ") {
 			continue
@@ -235,27 +337,33 @@ func handleAnthropicStream(c *gin.Context, resp *http.Response) {
 
 		data := strings.TrimPrefix(line, "data: ")
 		if data == "[DONE]" {
-			if err := writeSSE(w, "message_stop", map[string]string{"type": "message_stop"}); err != nil {
-				log.Printf("[Stream] Write error on message_stop: %v", err)
-				return
+			if err := writeStreamEvent(w, fo, "message_stop", map[string]string{"type": "message_stop"}); err != nil {
+				slog.DebugContext(c.Request.Context(), "stream write error on message_stop", "err", err)
+				return nil
 			}
 			if hasFlusher {
 				flusher.Flush()
 			}
-			return
+			return nil
 		}
 
 		var chunk anthropic.ChatCompletionResponse
 		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
-			log.Printf("[Stream] Failed to parse SSE chunk: %v", err)
+			slog.WarnContext(c.Request.Context(), "failed to parse SSE chunk", "err", err)
 			continue
 		}
 
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				stopReason = anthropic.MapOpenAIStopReasonToAnthropic(*choice.FinishReason)
+			}
+		}
 		events := anthropic.TranslateChunkToAnthropicEvents(chunk, state)
+		eventCount += len(events)
 		for _, event := range events {
-			if err := writeSSE(w, event.Event, event.Data); err != nil {
-				log.Printf("[Stream] Write error: %v", err)
-				return
+			if err := writeStreamEvent(w, fo, event.Event, event.Data); err != nil {
+				slog.DebugContext(c.Request.Context(), "stream write error", "err", err)
+				return nil
 			}
 		}
 		if hasFlusher {
@@ -264,7 +372,11 @@ func handleAnthropicStream(c *gin.Context, resp *http.Response) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("[Stream] Scanner error: %v", err)
+		slog.WarnContext(c.Request.Context(), "upstream stream error", "err", err)
+		span.RecordError(err)
+		if fo != nil {
+			return &StreamBrokenError{Err: err}
+		}
 		_ = writeSSE(w, "error", map[string]interface{}{
 			"type": "error",
 			"error": map[string]string{
@@ -273,12 +385,51 @@ func handleAnthropicStream(c *gin.Context, resp *http.Response) {
 			},
 		})
 	} else {
-		log.Printf("[Stream] Upstream closed without [DONE], sending message_stop")
-		_ = writeSSE(w, "message_stop", map[string]string{"type": "message_stop"})
+		slog.WarnContext(c.Request.Context(), "upstream closed stream without [DONE], sending message_stop")
+		_ = writeStreamEvent(w, fo, "message_stop", map[string]string{"type": "message_stop"})
 	}
 	if hasFlusher {
 		flusher.Flush()
 	}
+	return nil
+}
+
+// responseContext returns the context of the upstream request behind resp, so
+// spans started from it nest under the attempt that produced the response.
+func responseContext(resp *http.Response) context.Context {
+	if resp.Request != nil {
+		return resp.Request.Context()
+	}
+	return context.Background()
+}
+
+// writeStreamEvent writes an Anthropic SSE event through the failover buffer.
+// Content block events commit the stream; message_start and ping are held back.
+func writeStreamEvent(w io.Writer, fo *StreamFailover, event string, data interface{}) error {
+	if fo == nil {
+		return writeSSE(w, event, data)
+	}
+	content := false
+	switch event {
+	case "content_block_start":
+		content = true
+		if start, ok := data.(anthropic.ContentBlockStartEvent); ok && start.ContentBlock.Type == "tool_use" {
+			fo.observeToolUse()
+		}
+	case "content_block_delta":
+		content = true
+		if delta, ok := data.(anthropic.ContentBlockDeltaEvent); ok && delta.Delta.Type == "text_delta" {
+			fo.observeText(delta.Delta.Text)
+		}
+	case "content_block_stop", "message_delta", "message_stop":
+		content = true
+	}
+
+	var buf bytes.Buffer
+	if err := writeSSE(&buf, event, data); err != nil {
+		return err
+	}
+	return fo.write(w, buf.Bytes(), content)
 }
 
 func normalizeCompletionsPayload(state *config.State, bodyBytes []byte) ([]byte, http.Header, bool) {
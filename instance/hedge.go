@@ -0,0 +1,123 @@
+package instance
+
+import (
+	"sync"
+)
+
+// defaultHedgesPerMinute caps hedges per API key when the policy sets no cap.
+const defaultHedgesPerMinute = 10
+
+// hedgeCounters accumulates hedging outcomes for one pool.
+type hedgeCounters struct {
+	eligible  int64 // requests made with a hedging key
+	hedged    int64 // requests that sent a hedge
+	hedgeWins int64 // hedges that answered first
+	wasted    int64 // upstream requests cancelled after losing the race
+	capped    int64 // hedges skipped because the per-key cap was reached
+}
+
+// HedgeStats is a point-in-time view of a pool's hedging since startup.
+type HedgeStats struct {
+	Eligible  int64   `json:"eligible"`
+	Hedged    int64   `json:"hedged"`
+	HedgeWins int64   `json:"hedgeWins"`
+	Wasted    int64   `json:"wasted"`
+	Capped    int64   `json:"capped"`
+	HedgeRate float64 `json:"hedgeRate"` // hedged / eligible, 0..1
+}
+
+type hedgeBucket struct {
+	bucket *TokenBucket
+	rpm    int
+}
+
+var (
+	hedgeMu      sync.Mutex
+	hedgeStats   = make(map[string]*hedgeCounters)
+	hedgeBuckets = make(map[string]*hedgeBucket) // keyed by pool ID + "/" + API key
+)
+
+func hedgeCountersLocked(poolID string) *hedgeCounters {
+	hc, ok := hedgeStats[poolID]
+	if !ok {
+		hc = &hedgeCounters{}
+		hedgeStats[poolID] = hc
+	}
+	return hc
+}
+
+// RecordHedgeEligible counts a request made with a key that has a hedge policy.
+func RecordHedgeEligible(poolID string) {
+	hedgeMu.Lock()
+	defer hedgeMu.Unlock()
+	hedgeCountersLocked(poolID).eligible++
+}
+
+// AllowHedge consumes one hedge from the key's per-minute cap. perMinute <= 0
+// uses the default cap.
+func AllowHedge(poolID, apiKey string, perMinute int) bool {
+	if perMinute <= 0 {
+		perMinute = defaultHedgesPerMinute
+	}
+
+	hedgeMu.Lock()
+	defer hedgeMu.Unlock()
+
+	key := poolID + "/" + apiKey
+	hb, ok := hedgeBuckets[key]
+	if !ok || hb.rpm != perMinute {
+		hb = &hedgeBucket{bucket: NewTokenBucket(perMinute), rpm: perMinute}
+		hedgeBuckets[key] = hb
+	}
+	if allowed, _ := hb.bucket.Allow(); !allowed {
+		hedgeCountersLocked(poolID).capped++
+		return false
+	}
+	return true
+}
+
+// RecordHedgeSent counts a hedge request sent to accountID.
+func RecordHedgeSent(poolID, accountID string) {
+	hedgeMu.Lock()
+	hedgeCountersLocked(poolID).hedged++
+	hedgeMu.Unlock()
+	recordHedgeUsage(accountID, false)
+}
+
+// RecordHedgeWin counts a hedge that answered before the original request.
+func RecordHedgeWin(poolID string) {
+	hedgeMu.Lock()
+	defer hedgeMu.Unlock()
+	hedgeCountersLocked(poolID).hedgeWins++
+}
+
+// RecordWastedRequest counts an upstream request on accountID that was
+// cancelled after losing a hedge race.
+func RecordWastedRequest(poolID, accountID string) {
+	hedgeMu.Lock()
+	hedgeCountersLocked(poolID).wasted++
+	hedgeMu.Unlock()
+	recordHedgeUsage(accountID, true)
+}
+
+// GetHedgeStats returns hedging stats for every pool that used hedging.
+func GetHedgeStats() map[string]HedgeStats {
+	hedgeMu.Lock()
+	defer hedgeMu.Unlock()
+
+	result := make(map[string]HedgeStats, len(hedgeStats))
+	for poolID, hc := range hedgeStats {
+		stats := HedgeStats{
+			Eligible:  hc.eligible,
+			Hedged:    hc.hedged,
+			HedgeWins: hc.hedgeWins,
+			Wasted:    hc.wasted,
+			Capped:    hc.capped,
+		}
+		if hc.eligible > 0 {
+			stats.HedgeRate = float64(hc.hedged) / float64(hc.eligible)
+		}
+		result[poolID] = stats
+	}
+	return result
+}
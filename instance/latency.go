@@ -0,0 +1,168 @@
+package instance
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// latencyEWMAAlpha weights the newest sample in the moving averages.
+const latencyEWMAAlpha = 0.2
+
+// latencyFailureTTFTMs stands in for the TTFT of an account that has only
+// failed so far, so that it ranks behind every account that has answered.
+const latencyFailureTTFTMs = 60_000.0
+
+// accountLatency keeps exponentially weighted moving averages of upstream
+// time-to-first-token and error rate for one account.
+type accountLatency struct {
+	mu        sync.Mutex
+	ttftMs    float64
+	errorRate float64
+	samples   int64
+	lastAt    time.Time
+}
+
+// LatencySnapshot is a point-in-time view of an account's latency stats.
+type LatencySnapshot struct {
+	TTFTMs    float64 `json:"ttftMs"`    // EWMA time to first byte of the upstream body
+	ErrorRate float64 `json:"errorRate"` // EWMA of failed requests, 0..1
+	Samples   int64   `json:"samples"`
+	LastAt    string  `json:"lastAt,omitempty"` // RFC3339 or empty
+}
+
+var (
+	latencyMap   = make(map[string]*accountLatency)
+	latencyMapMu sync.RWMutex
+)
+
+func getOrCreateLatency(accountID string) *accountLatency {
+	latencyMapMu.RLock()
+	l, ok := latencyMap[accountID]
+	latencyMapMu.RUnlock()
+	if ok {
+		return l
+	}
+
+	latencyMapMu.Lock()
+	defer latencyMapMu.Unlock()
+	if l, ok = latencyMap[accountID]; ok {
+		return l
+	}
+	l = &accountLatency{}
+	latencyMap[accountID] = l
+	return l
+}
+
+func (l *accountLatency) observe(ttft time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errSample := 0.0
+	if failed {
+		errSample = 1.0
+	}
+	if l.samples == 0 {
+		l.errorRate = errSample
+	} else {
+		l.errorRate += latencyEWMAAlpha * (errSample - l.errorRate)
+	}
+	// Failures carry no meaningful TTFT; only the error rate moves.
+	if !failed {
+		ms := float64(ttft) / float64(time.Millisecond)
+		if l.ttftMs == 0 {
+			l.ttftMs = ms
+		} else {
+			l.ttftMs += latencyEWMAAlpha * (ms - l.ttftMs)
+		}
+	}
+	l.samples++
+	l.lastAt = time.Now()
+}
+
+// score ranks accounts for the latency strategy; lower is better.
+// Unmeasured accounts score 0 so they get sampled; accounts that have only
+// failed score as if they took latencyFailureTTFTMs.
+func (l *accountLatency) score() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 {
+		return 0
+	}
+	ttft := l.ttftMs
+	if ttft == 0 {
+		ttft = latencyFailureTTFTMs
+	}
+	return ttft * (1 + 4*l.errorRate)
+}
+
+func (l *accountLatency) snapshot() *LatencySnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap := &LatencySnapshot{TTFTMs: l.ttftMs, ErrorRate: l.errorRate, Samples: l.samples}
+	if !l.lastAt.IsZero() {
+		snap.LastAt = l.lastAt.Format(time.RFC3339)
+	}
+	return snap
+}
+
+// GetLatencySnapshot returns latency stats for an account, or nil if none were recorded.
+func GetLatencySnapshot(accountID string) *LatencySnapshot {
+	latencyMapMu.RLock()
+	l, ok := latencyMap[accountID]
+	latencyMapMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return l.snapshot()
+}
+
+// observeUpstream records the outcome of an upstream call made at start.
+// Successful responses are measured when the first body byte arrives.
+func observeUpstream(ctx context.Context, accountID string, start time.Time, resp *http.Response, err error) {
+	if accountID == "" {
+		return
+	}
+	if err != nil {
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			getOrCreateLatency(accountID).observe(0, true)
+		}
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		getOrCreateLatency(accountID).observe(time.Since(start), true)
+		return
+	}
+	resp.Body = &firstByteReader{ReadCloser: resp.Body, onFirst: func() {
+		getOrCreateLatency(accountID).observe(time.Since(start), false)
+	}}
+}
+
+// firstByteReader invokes onFirst once, when the first byte (or EOF) is read.
+type firstByteReader struct {
+	io.ReadCloser
+	onFirst func()
+	once    sync.Once
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 || err == io.EOF {
+		r.once.Do(r.onFirst)
+	}
+	return n, err
+}
+
+// latencyScore returns the latency strategy score for an account.
+func latencyScore(accountID string) float64 {
+	latencyMapMu.RLock()
+	l, ok := latencyMap[accountID]
+	latencyMapMu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return l.score()
+}
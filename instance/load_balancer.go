@@ -1,51 +1,212 @@
 package instance
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"copilot-go/anthropic"
+	"copilot-go/config"
 	"copilot-go/store"
 )
 
 var rrIndex atomic.Int64
 
-// SelectAccount picks an account using the specified strategy.
-// exclude contains account IDs to skip (e.g., on retry).
-func SelectAccount(strategy string, exclude map[string]bool) (*store.Account, error) {
+// Smooth weighted round-robin state, keyed by pool ID + "/" + account ID.
+var (
+	swrrMu      sync.Mutex
+	swrrCurrent = make(map[string]int)
+)
+
+// SelectOptions describes a pool account selection.
+type SelectOptions struct {
+	// Pool supplies the member accounts, strategy and sticky settings.
+	Pool *store.Pool
+	// Exclude contains account IDs to skip (e.g., on retry).
+	Exclude map[string]bool
+	// SessionKey identifies the conversation for sticky routing. Empty disables pinning.
+	SessionKey string
+	// Model is the Copilot model ID the request targets. When set, only
+	// accounts whose cached model list includes it are considered.
+	Model string
+}
+
+// ModelUnavailableError is returned by SelectAccount when accounts are running
+// but none of them offers the requested model.
+type ModelUnavailableError struct {
+	Model string
+}
+
+func (e *ModelUnavailableError) Error() string {
+	return fmt.Sprintf("no running account offers model %q", e.Model)
+}
+
+// SelectAccount picks an account from the pool using its configured strategy.
+func SelectAccount(opts SelectOptions) (*store.Account, error) {
+	pool := opts.Pool
 	accounts, err := store.GetEnabledAccounts()
 	if err != nil {
 		return nil, err
 	}
 
-	// Filter out excluded and non-running accounts
+	// Filter out excluded, non-running and model-incompatible accounts
 	var available []store.Account
+	running, offering := 0, 0
+	now := time.Now()
 	mu.RLock()
 	for _, a := range accounts {
-		if exclude != nil && exclude[a.ID] {
+		if !pool.HasMember(a.ID) {
 			continue
 		}
-		if inst, ok := instances[a.ID]; ok && inst.Status == "running" {
-			available = append(available, a)
+		inst, ok := instances[a.ID]
+		if !ok || inst.Status != "running" {
+			continue
+		}
+		running++
+		if opts.Model != "" && !instanceOffersModel(inst, opts.Model) {
+			continue
+		}
+		offering++
+		if opts.Exclude != nil && opts.Exclude[a.ID] {
+			continue
 		}
+		if !breakerAvailable(a.ID, now) {
+			continue
+		}
+		available = append(available, a)
 	}
 	mu.RUnlock()
 
 	if len(available) == 0 {
+		// Only report the model as unavailable when exclusions (retries) or
+		// open circuit breakers are not the reason nothing is left.
+		if running > 0 && offering == 0 {
+			return nil, &ModelUnavailableError{Model: opts.Model}
+		}
 		return nil, nil
 	}
 
-	switch strategy {
+	sticky := (pool.Sticky || pool.Strategy == "sticky") && opts.SessionKey != ""
+	ttl := time.Duration(pool.StickyTTLMinutes) * time.Minute
+	if ttl <= 0 {
+		ttl = defaultStickyTTL
+	}
+	sessionKey := pool.ID + "/" + opts.SessionKey
+	if sticky {
+		if pinned := lookupStickyAccount(pool.ID, sessionKey, available, ttl); pinned != nil {
+			return pinned, nil
+		}
+	}
+
+	var selected *store.Account
+	switch pool.Strategy {
 	case "priority":
-		return selectByPriority(available), nil
+		selected = selectByPriority(available)
 	case "least-used":
-		return selectLeastUsed(available), nil
+		selected = selectLeastUsed(available)
 	case "smart":
-		return selectSmart(available), nil
-	default: // round-robin
-		return selectRoundRobin(available), nil
+		selected = selectSmart(available)
+	case "quota-aware":
+		selected = selectQuotaAware(available, opts.Model)
+	case "weighted":
+		selected = selectWeighted(pool.ID, available)
+	case "latency":
+		selected = selectByLatency(available)
+	default: // round-robin, sticky
+		selected = selectRoundRobin(available)
+	}
+	if selected == nil {
+		return nil, nil
+	}
+
+	if sticky {
+		pinStickySession(sessionKey, selected.ID, ttl)
+	}
+	return selected, nil
+}
+
+// instanceOffersModel reports whether the instance's cached model list includes
+// modelID. Instances without a cached list are assumed to offer every model.
+func instanceOffersModel(inst *ProxyInstance, modelID string) bool {
+	inst.State.RLock()
+	models := inst.State.Models
+	inst.State.RUnlock()
+	if models == nil || len(models.Data) == 0 {
+		return true
+	}
+	for _, m := range models.Data {
+		if m.ID == modelID {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveRequestModel extracts the Copilot model ID targeted by a request body.
+// anthropicFormat applies the same normalization as the Anthropic translation.
+func ResolveRequestModel(bodyBytes []byte, anthropicFormat bool) string {
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil || payload.Model == "" {
+		return ""
+	}
+	model := store.ToCopilotID(payload.Model)
+	if anthropicFormat {
+		model = anthropic.NormalizeAnthropicModel(model)
+	}
+	return model
+}
+
+// PooledModelEntry is a model entry annotated with how many pool accounts offer it.
+type PooledModelEntry struct {
+	config.ModelEntry
+	AvailableAccounts int `json:"available_accounts"`
+}
+
+// GetPooledModels returns the union of cached models across the pool's enabled,
+// running member accounts, with per-model availability counts. Models outside
+// the pool's allowlist are omitted.
+func GetPooledModels(pool *store.Pool) ([]PooledModelEntry, error) {
+	accounts, err := store.GetEnabledAccounts()
+	if err != nil {
+		return nil, err
 	}
+
+	index := make(map[string]int)
+	var result []PooledModelEntry
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, a := range accounts {
+		if !pool.HasMember(a.ID) {
+			continue
+		}
+		inst, ok := instances[a.ID]
+		if !ok || inst.Status != "running" {
+			continue
+		}
+		inst.State.RLock()
+		models := inst.State.Models
+		inst.State.RUnlock()
+		if models == nil {
+			continue
+		}
+		for _, m := range models.Data {
+			if !pool.AllowsModel(store.ToDisplayID(m.ID), m.ID) {
+				continue
+			}
+			if i, ok := index[m.ID]; ok {
+				result[i].AvailableAccounts++
+				continue
+			}
+			index[m.ID] = len(result)
+			result = append(result, PooledModelEntry{ModelEntry: m, AvailableAccounts: 1})
+		}
+	}
+	return result, nil
 }
 
 func selectRoundRobin(accounts []store.Account) *store.Account {
@@ -65,6 +226,48 @@ func selectByPriority(accounts []store.Account) *store.Account {
 	return &best
 }
 
+// selectWeighted spreads requests proportionally to Priority using smooth
+// weighted round-robin. Accounts with Priority <= 0 get weight 1.
+func selectWeighted(poolID string, accounts []store.Account) *store.Account {
+	swrrMu.Lock()
+	defer swrrMu.Unlock()
+
+	total := 0
+	best := -1
+	bestKey := ""
+	for i, a := range accounts {
+		weight := a.Priority
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		key := poolID + "/" + a.ID
+		swrrCurrent[key] += weight
+		if best < 0 || swrrCurrent[key] > swrrCurrent[bestKey] {
+			best = i
+			bestKey = key
+		}
+	}
+	swrrCurrent[bestKey] -= total
+	return &accounts[best]
+}
+
+// selectByLatency picks the account with the lowest EWMA time-to-first-token,
+// penalized by its error rate. Unmeasured accounts are tried first.
+func selectByLatency(accounts []store.Account) *store.Account {
+	best := &accounts[0]
+	bestScore := latencyScore(accounts[0].ID)
+
+	for i := 1; i < len(accounts); i++ {
+		score := latencyScore(accounts[i].ID)
+		if score < bestScore {
+			bestScore = score
+			best = &accounts[i]
+		}
+	}
+	return best
+}
+
 // selectLeastUsed picks the account with the fewest requests in the current window.
 func selectLeastUsed(accounts []store.Account) *store.Account {
 	best := &accounts[0]
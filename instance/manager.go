@@ -6,16 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"sync"
 	"time"
 
 	"copilot-go/config"
 	"copilot-go/copilot"
+	"copilot-go/logging"
 	"copilot-go/store"
+	"copilot-go/tracing"
 )
 
 type ProxyInstance struct {
@@ -24,6 +27,15 @@ type ProxyInstance struct {
 	Status   string // "running", "stopped", "error"
 	Error    string
 	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+// halt signals the instance's background goroutines to exit. Safe to call repeatedly.
+func (inst *ProxyInstance) halt() {
+	if inst.stopChan == nil {
+		return
+	}
+	inst.stopOnce.Do(func() { close(inst.stopChan) })
 }
 
 type CopilotUser struct {
@@ -38,11 +50,14 @@ func StartInstance(account store.Account) error {
 			mu.Unlock()
 			return nil
 		}
+		// An instance in "error" may still have a token refresh loop running.
+		inst.halt()
 	}
 	mu.Unlock()
 
 	state := config.NewState()
 	state.Lock()
+	state.AccountID = account.ID
 	state.GithubToken = account.GithubToken
 	state.AccountType = account.AccountType
 	state.Unlock()
@@ -68,7 +83,7 @@ func StartInstance(account store.Account) error {
 
 	// Get models
 	if err := fetchModels(state); err != nil {
-		log.Printf("Warning: failed to fetch models for account %s: %v", account.Name, err)
+		slog.Warn("failed to fetch models", "account", account.Name, "err", err)
 	}
 
 	stopChan := make(chan struct{})
@@ -83,10 +98,11 @@ func StartInstance(account store.Account) error {
 	instances[account.ID] = inst
 	mu.Unlock()
 
-	// Start background token refresh
+	// Start background token refresh and quota polling
 	go tokenRefreshLoop(inst)
+	go quotaPollLoop(inst)
 
-	log.Printf("Instance started for account: %s", account.Name)
+	slog.Info("instance started", "account", account.Name)
 	return nil
 }
 
@@ -97,12 +113,25 @@ func StopInstance(accountID string) {
 		mu.Unlock()
 		return
 	}
-	if inst.Status == "running" {
-		close(inst.stopChan)
-	}
+	inst.halt()
 	inst.Status = "stopped"
 	mu.Unlock()
-	log.Printf("Instance stopped for account: %s", inst.Account.Name)
+	slog.Info("instance stopped", "account", inst.Account.Name)
+}
+
+// StopAllInstances stops every running instance and its background loops.
+func StopAllInstances() {
+	mu.RLock()
+	var ids []string
+	for id, inst := range instances {
+		if inst.Status != "stopped" {
+			ids = append(ids, id)
+		}
+	}
+	mu.RUnlock()
+	for _, id := range ids {
+		StopInstance(id)
+	}
 }
 
 func GetInstanceStatus(accountID string) string {
@@ -189,7 +218,9 @@ func GetUser(accountID string) (*CopilotUser, error) {
 func tokenRefreshLoop(inst *ProxyInstance) {
 	const fallbackInterval = 25 * time.Minute
 	const minInterval = 30 * time.Second
+	const maxFailureBackoff = 15 * time.Minute
 
+	failureBackoff := time.Duration(0)
 	for {
 		// Calculate next refresh time based on token expiry.
 		sleepDur := fallbackInterval
@@ -211,6 +242,10 @@ func tokenRefreshLoop(inst *ProxyInstance) {
 			}
 		}
 
+		if failureBackoff > 0 {
+			sleepDur = failureBackoff
+		}
+
 		if sleepDur > 0 {
 			timer := time.NewTimer(sleepDur)
 			select {
@@ -229,14 +264,41 @@ func tokenRefreshLoop(inst *ProxyInstance) {
 		}
 
 		if err := refreshCopilotTokenWithRetry(inst.State, 3); err != nil {
-			log.Printf("Token refresh failed for %s: %v", inst.Account.Name, err)
+			slog.Error("token refresh failed", "account", inst.Account.Name, "err", err)
+			tokenRefreshFailures.Inc(inst.Account.ID)
 			mu.Lock()
-			inst.Status = "error"
-			inst.Error = err.Error()
+			if inst.Status != "stopped" {
+				inst.Status = "error"
+				inst.Error = err.Error()
+			}
 			mu.Unlock()
+			tripCircuitBreaker(inst.Account.ID, FailureAuth, err.Error())
+
+			// Back off instead of hammering GitHub with an expired token.
+			if failureBackoff == 0 {
+				failureBackoff = time.Minute
+			} else if failureBackoff *= 2; failureBackoff > maxFailureBackoff {
+				failureBackoff = maxFailureBackoff
+			}
 			continue
 		}
 
+		if failureBackoff > 0 {
+			failureBackoff = 0
+			ResetCircuitBreaker(inst.Account.ID)
+			markInstanceRecovered(inst)
+		}
+	}
+}
+
+// markInstanceRecovered puts an instance that errored back into rotation.
+func markInstanceRecovered(inst *ProxyInstance) {
+	mu.Lock()
+	defer mu.Unlock()
+	if inst.Status == "error" {
+		inst.Status = "running"
+		inst.Error = ""
+		slog.Info("instance recovered", "account", inst.Account.Name)
 	}
 }
 
@@ -272,7 +334,7 @@ func refreshCopilotToken(state *config.State) error {
 
 	if tokenResp.ExpiresAt > 0 {
 		expiresIn := time.Until(time.Unix(tokenResp.ExpiresAt, 0))
-		log.Printf("Copilot token refreshed, expires in %v", expiresIn.Round(time.Second))
+		slog.Info("copilot token refreshed", "expiresIn", expiresIn.Round(time.Second))
 	}
 	return nil
 }
@@ -285,14 +347,14 @@ func refreshCopilotTokenWithRetry(state *config.State, maxRetries int) error {
 		if attempt > 0 {
 			// Exponential backoff: 2s, 8s, 18s (2 * attempt^2)
 			backoff := time.Duration(2*math.Pow(float64(attempt), 2)) * time.Second
-			log.Printf("Token refresh retry %d/%d after %v", attempt, maxRetries, backoff)
+			slog.Warn("retrying token refresh", "attempt", attempt, "maxRetries", maxRetries, "backoff", backoff)
 			time.Sleep(backoff)
 		}
 		lastErr = refreshCopilotToken(state)
 		if lastErr == nil {
 			return nil
 		}
-		log.Printf("Token refresh attempt %d failed: %v", attempt+1, lastErr)
+		slog.Warn("token refresh failed", "attempt", attempt+1, "err", lastErr)
 	}
 	return fmt.Errorf("token refresh failed after %d attempts: %w", maxRetries+1, lastErr)
 }
@@ -423,12 +485,26 @@ func ProxyRequestWithBytes(state *config.State, method, path string, bodyBytes [
 func ProxyRequestWithBytesCtx(ctx context.Context, state *config.State, method, path string, bodyBytes []byte, extraHeaders http.Header, hasVision bool) (*http.Response, error) {
 	state.RLock()
 	baseURL := config.CopilotBaseURL(state.AccountType)
+	accountID := state.AccountID
 	state.RUnlock()
 
 	url := baseURL + path
 
+	// The span is kept out of the request context so spans started from
+	// resp.Request (stream translation) are children of the caller's span.
+	_, span := tracing.StartWithKind(ctx, tracing.KindClient, "copilot "+method+" "+path,
+		tracing.String("http.request.method", method),
+		tracing.String("url.path", path),
+		tracing.String("copilot.account_id", accountID),
+		tracing.Int("http.request.body.size", len(bodyBytes)))
+	defer span.End()
+	if trace := tracing.ClientTrace(span); trace != nil {
+		ctx = httptrace.WithClientTrace(ctx, trace)
+	}
+
 	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(bodyBytes))
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
 
@@ -438,6 +514,23 @@ func ProxyRequestWithBytesCtx(ctx context.Context, state *config.State, method,
 	for k, v := range extraHeaders {
 		req.Header[k] = v
 	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
 
-	return getStreamingClient().Do(req)
+	upstream := captureUpstream(ctx, accountID, req, bodyBytes)
+	start := time.Now()
+	resp, err := getStreamingClient().Do(req)
+	upstream.finish(start, resp, err)
+	observeUpstream(ctx, accountID, start, resp, err)
+	observeUpstreamMetrics(accountID, path, start, resp, err)
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetError(resp.Status)
+		}
+	}
+	return resp, err
 }
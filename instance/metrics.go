@@ -0,0 +1,160 @@
+package instance
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"copilot-go/config"
+	"copilot-go/metrics"
+	"copilot-go/store"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("copilot_requests_total",
+		"Proxied requests by account, pool, model, endpoint and response status.",
+		"account", "pool", "model", "endpoint", "status")
+	requestDuration = metrics.NewHistogramVec("copilot_request_duration_seconds",
+		"End-to-end duration of proxied requests.", nil,
+		"account", "pool", "model", "endpoint")
+	requestTTFT = metrics.NewHistogramVec("copilot_request_ttft_seconds",
+		"Time from request arrival to the first upstream response byte.", nil,
+		"account", "pool", "model", "endpoint")
+	tokensTotal = metrics.NewCounterVec("copilot_tokens_total",
+		"Tokens reported by upstream usage, by type (input, output, cached).",
+		"account", "pool", "model", "type")
+	upstreamDuration = metrics.NewHistogramVec("copilot_upstream_request_duration_seconds",
+		"Time until upstream Copilot response headers, by status (\"error\" for transport failures).", nil,
+		"account", "path", "status")
+	rateLimitRejections = metrics.NewCounterVec("copilot_rate_limit_rejections_total",
+		"Requests rejected by the local rate limiter, by scope (global or account).",
+		"pool", "account", "scope")
+	retriesTotal = metrics.NewCounterVec("copilot_retries_total",
+		"Pool requests retried on another account, by reason (error, status, stream).",
+		"pool", "endpoint", "reason")
+	breakerTrips = metrics.NewCounterVec("copilot_circuit_breaker_trips_total",
+		"Times an account's circuit breaker opened, by failure class.",
+		"account", "class")
+	tokenRefreshFailures = metrics.NewCounterVec("copilot_token_refresh_failures_total",
+		"Failed Copilot token refreshes.",
+		"account")
+)
+
+func init() {
+	metrics.NewGaugeFunc("copilot_circuit_breaker_state",
+		"Circuit breaker state per account; 1 for the current state, 0 otherwise.",
+		breakerStateSamples, "account", "state")
+	metrics.NewGaugeFunc("copilot_instance_status",
+		"Instance status per account; 1 for the current status, 0 otherwise.",
+		instanceStatusSamples, "account", "name", "status")
+	metrics.NewGaugeFunc("copilot_token_expires_at_seconds",
+		"Unix time at which the account's Copilot token expires.",
+		tokenExpirySamples, "account")
+}
+
+// otherModel is the model label of requests for models outside the cached
+// model lists.
+const otherModel = "other"
+
+// modelLabel returns model if it is in the cached model list of the pool that
+// served the request, or of the account for requests outside a pool, and
+// otherModel if not. The model comes from the client's request body, so using
+// it unchecked would let any API key holder create unbounded series.
+func modelLabel(poolID, accountID, model string) string {
+	if model == "" {
+		return ""
+	}
+	var models []config.ModelEntry
+	if poolID != "" {
+		if pool, _ := store.GetPool(poolID); pool != nil {
+			pooled, _ := GetPooledModels(pool)
+			for _, m := range pooled {
+				models = append(models, m.ModelEntry)
+			}
+		}
+	} else if state := GetInstanceState(accountID); state != nil {
+		state.RLock()
+		if state.Models != nil {
+			models = state.Models.Data
+		}
+		state.RUnlock()
+	}
+	for _, m := range models {
+		if m.ID == model || store.ToDisplayID(m.ID) == model {
+			return model
+		}
+	}
+	return otherModel
+}
+
+// observeRequestMetrics records a finished proxied request.
+func observeRequestMetrics(ev store.UsageEvent) {
+	ev.Model = modelLabel(ev.PoolID, ev.AccountID, ev.Model)
+	requestsTotal.Inc(ev.AccountID, ev.PoolID, ev.Model, ev.Endpoint, strconv.Itoa(ev.Status))
+	requestDuration.Observe(float64(ev.DurationMs)/1000, ev.AccountID, ev.PoolID, ev.Model, ev.Endpoint)
+	if ev.TTFTMs > 0 {
+		requestTTFT.Observe(float64(ev.TTFTMs)/1000, ev.AccountID, ev.PoolID, ev.Model, ev.Endpoint)
+	}
+	tokensTotal.Add(float64(ev.InputTokens), ev.AccountID, ev.PoolID, ev.Model, "input")
+	tokensTotal.Add(float64(ev.OutputTokens), ev.AccountID, ev.PoolID, ev.Model, "output")
+	tokensTotal.Add(float64(ev.CachedTokens), ev.AccountID, ev.PoolID, ev.Model, "cached")
+}
+
+// observeUpstreamMetrics records the header latency of an upstream call.
+func observeUpstreamMetrics(accountID, path string, start time.Time, resp *http.Response, err error) {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamDuration.Observe(time.Since(start).Seconds(), accountID, path, status)
+}
+
+// RecordRetry counts a pool request retried on another account.
+func RecordRetry(poolID, endpoint, reason string) {
+	retriesTotal.Inc(poolID, endpoint, reason)
+}
+
+func breakerStateSamples() []metrics.Sample {
+	var samples []metrics.Sample
+	for id, snap := range GetAllCircuitBreakerSnapshots() {
+		for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+			v := 0.0
+			if snap.State == state {
+				v = 1
+			}
+			samples = append(samples, metrics.Sample{Labels: []string{id, string(state)}, Value: v})
+		}
+	}
+	return samples
+}
+
+func instanceStatusSamples() []metrics.Sample {
+	mu.RLock()
+	defer mu.RUnlock()
+	var samples []metrics.Sample
+	for id, inst := range instances {
+		for _, status := range []string{"running", "error", "stopped"} {
+			v := 0.0
+			if inst.Status == status {
+				v = 1
+			}
+			samples = append(samples, metrics.Sample{Labels: []string{id, inst.Account.Name, status}, Value: v})
+		}
+	}
+	return samples
+}
+
+func tokenExpirySamples() []metrics.Sample {
+	mu.RLock()
+	defer mu.RUnlock()
+	var samples []metrics.Sample
+	for id, inst := range instances {
+		inst.State.RLock()
+		expiresAt := inst.State.TokenExpiresAt
+		inst.State.RUnlock()
+		if expiresAt > 0 {
+			samples = append(samples, metrics.Sample{Labels: []string{id}, Value: float64(expiresAt)})
+		}
+	}
+	return samples
+}
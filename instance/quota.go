@@ -0,0 +1,292 @@
+package instance
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"copilot-go/config"
+	"copilot-go/store"
+)
+
+const (
+	quotaPollInterval = 5 * time.Minute
+	// quotaWarnPercent is the pool-wide premium quota percentage below which the console warns.
+	quotaWarnPercent = 10.0
+)
+
+// QuotaDetail is one entry of the Copilot quota_snapshots object.
+type QuotaDetail struct {
+	Entitlement      float64 `json:"entitlement"`
+	Remaining        float64 `json:"remaining"`
+	PercentRemaining float64 `json:"percent_remaining"`
+	Unlimited        bool    `json:"unlimited"`
+	OveragePermitted bool    `json:"overage_permitted"`
+}
+
+// AccountQuota is the cached quota state of an account, polled from copilot_internal/user.
+type AccountQuota struct {
+	Plan                string       `json:"plan,omitempty"`
+	PremiumInteractions *QuotaDetail `json:"premiumInteractions,omitempty"`
+	Chat                *QuotaDetail `json:"chat,omitempty"`
+	Completions         *QuotaDetail `json:"completions,omitempty"`
+	ResetDate           string       `json:"resetDate,omitempty"`
+	FetchedAt           string       `json:"fetchedAt,omitempty"` // RFC3339
+	Error               string       `json:"error,omitempty"`
+}
+
+// copilotUserResponse is the subset of copilot_internal/user used for quota tracking.
+type copilotUserResponse struct {
+	CopilotPlan    string `json:"copilot_plan"`
+	QuotaResetDate string `json:"quota_reset_date"`
+	QuotaSnapshots struct {
+		PremiumInteractions *QuotaDetail `json:"premium_interactions"`
+		Chat                *QuotaDetail `json:"chat"`
+		Completions         *QuotaDetail `json:"completions"`
+	} `json:"quota_snapshots"`
+}
+
+var (
+	quotaMu    sync.RWMutex
+	quotaCache = make(map[string]*AccountQuota)
+)
+
+// FetchCopilotUsage fetches usage/quota data for a running account from the
+// GitHub Copilot API and refreshes the cached quota as a side effect.
+func FetchCopilotUsage(accountID string) (interface{}, error) {
+	state := GetInstanceState(accountID)
+	if state == nil {
+		return nil, fmt.Errorf("instance not running")
+	}
+
+	body, err := fetchCopilotUser(state)
+	if err != nil {
+		return nil, err
+	}
+	storeQuota(accountID, body, nil)
+
+	var usage interface{}
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func fetchCopilotUser(state *config.State) ([]byte, error) {
+	req, err := http.NewRequest("GET", config.GithubCopilotUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range config.GithubHeaders(state) {
+		req.Header[k] = v
+	}
+
+	resp, err := getDefaultClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("copilot user API returned status %d", resp.StatusCode)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// storeQuota parses a copilot_internal/user body into the quota cache.
+// On fetch error the previous snapshot is kept and only the error is recorded.
+func storeQuota(accountID string, body []byte, fetchErr error) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	if fetchErr != nil {
+		q, ok := quotaCache[accountID]
+		if !ok {
+			q = &AccountQuota{}
+			quotaCache[accountID] = q
+		}
+		q.Error = fetchErr.Error()
+		return
+	}
+
+	var parsed copilotUserResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		quotaCache[accountID] = &AccountQuota{Error: fmt.Sprintf("failed to parse quota: %v", err)}
+		return
+	}
+	quotaCache[accountID] = &AccountQuota{
+		Plan:                parsed.CopilotPlan,
+		PremiumInteractions: parsed.QuotaSnapshots.PremiumInteractions,
+		Chat:                parsed.QuotaSnapshots.Chat,
+		Completions:         parsed.QuotaSnapshots.Completions,
+		ResetDate:           parsed.QuotaResetDate,
+		FetchedAt:           time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// quotaPollLoop refreshes the cached quota for a running instance until it stops.
+func quotaPollLoop(inst *ProxyInstance) {
+	ticker := time.NewTicker(quotaPollInterval)
+	defer ticker.Stop()
+
+	for {
+		body, err := fetchCopilotUser(inst.State)
+		if err != nil {
+			slog.Warn("quota poll failed", "account", inst.Account.Name, "err", err)
+		}
+		storeQuota(inst.Account.ID, body, err)
+
+		select {
+		case <-inst.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetAccountQuota returns the cached quota for an account, or nil if none was fetched yet.
+func GetAccountQuota(accountID string) *AccountQuota {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+	q, ok := quotaCache[accountID]
+	if !ok {
+		return nil
+	}
+	cp := *q
+	return &cp
+}
+
+// premiumRemaining returns the remaining premium interactions for an account.
+// known is false when no quota has been fetched yet.
+func premiumRemaining(accountID string) (remaining float64, known bool) {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+	q, ok := quotaCache[accountID]
+	if !ok || q.PremiumInteractions == nil {
+		return 0, false
+	}
+	if q.PremiumInteractions.Unlimited {
+		return math.Inf(1), true
+	}
+	return q.PremiumInteractions.Remaining, true
+}
+
+// PoolQuotaSummary aggregates premium quota across enabled accounts.
+type PoolQuotaSummary struct {
+	PremiumEntitlement float64 `json:"premiumEntitlement"`
+	PremiumRemaining   float64 `json:"premiumRemaining"`
+	PercentRemaining   float64 `json:"percentRemaining"`
+	UnlimitedAccounts  int     `json:"unlimitedAccounts"`
+	ExhaustedAccounts  int     `json:"exhaustedAccounts"`
+	UnknownAccounts    int     `json:"unknownAccounts"`
+	Warning            bool    `json:"warning"`
+	WarningMessage     string  `json:"warningMessage,omitempty"`
+}
+
+// GetPoolQuotaSummary sums cached premium quota over the given accounts and
+// flags the pool when it is close to exhaustion.
+func GetPoolQuotaSummary(accountIDs []string) PoolQuotaSummary {
+	quotaMu.RLock()
+	defer quotaMu.RUnlock()
+
+	var sum PoolQuotaSummary
+	for _, id := range accountIDs {
+		q, ok := quotaCache[id]
+		if !ok || q.PremiumInteractions == nil {
+			sum.UnknownAccounts++
+			continue
+		}
+		p := q.PremiumInteractions
+		if p.Unlimited {
+			sum.UnlimitedAccounts++
+			continue
+		}
+		sum.PremiumEntitlement += p.Entitlement
+		sum.PremiumRemaining += p.Remaining
+		if p.Remaining <= 0 {
+			sum.ExhaustedAccounts++
+		}
+	}
+
+	if sum.PremiumEntitlement > 0 {
+		sum.PercentRemaining = sum.PremiumRemaining / sum.PremiumEntitlement * 100
+	}
+	if sum.UnlimitedAccounts == 0 && sum.PremiumEntitlement > 0 && sum.PercentRemaining < quotaWarnPercent {
+		sum.Warning = true
+		sum.WarningMessage = fmt.Sprintf("pool premium quota is at %.1f%% (%.0f of %.0f remaining)",
+			sum.PercentRemaining, sum.PremiumRemaining, sum.PremiumEntitlement)
+	}
+	return sum
+}
+
+// isPremiumModel reports whether any running account marks modelID as premium.
+// Must be called with mu held.
+func isPremiumModel(modelID string) (premium bool, multiplier float64) {
+	for _, inst := range instances {
+		if inst.Status != "running" {
+			continue
+		}
+		inst.State.RLock()
+		models := inst.State.Models
+		inst.State.RUnlock()
+		if models == nil {
+			continue
+		}
+		for _, m := range models.Data {
+			if m.ID == modelID && m.Billing != nil {
+				return m.Billing.IsPremium, m.Billing.Multiplier
+			}
+		}
+	}
+	return false, 0
+}
+
+// selectQuotaAware sends premium-model requests to the account with the most
+// remaining premium quota, skipping exhausted accounts. Free models go to the
+// least-used account. Returns nil when every account is exhausted.
+func selectQuotaAware(accounts []store.Account, modelID string) *store.Account {
+	mu.RLock()
+	premium, multiplier := isPremiumModel(modelID)
+	mu.RUnlock()
+	if modelID == "" || !premium {
+		return selectLeastUsed(accounts)
+	}
+	if multiplier <= 0 {
+		multiplier = 1
+	}
+
+	var best, unknown []store.Account
+	bestRemaining := -1.0
+	for _, a := range accounts {
+		remaining, known := premiumRemaining(a.ID)
+		switch {
+		case !known:
+			unknown = append(unknown, a)
+		case remaining < multiplier:
+			// Exhausted for this model.
+		case remaining > bestRemaining:
+			bestRemaining = remaining
+			best = []store.Account{a}
+		case remaining == bestRemaining:
+			best = append(best, a)
+		}
+	}
+
+	switch {
+	case len(best) > 0:
+		return selectLeastUsed(best)
+	case len(unknown) > 0:
+		return selectLeastUsed(unknown)
+	default:
+		return nil
+	}
+}
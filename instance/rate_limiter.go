@@ -4,8 +4,11 @@ import (
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"copilot-go/store"
 )
 
 // TokenBucket implements a token-bucket rate limiter.
@@ -48,16 +51,27 @@ func (tb *TokenBucket) Allow() (bool, float64) {
 	return false, math.Ceil(waitSeconds)
 }
 
-// RateLimiterManager manages global and per-account rate limiters.
+// Exhausted reports whether the bucket currently has no token available,
+// without consuming one.
+func (tb *TokenBucket) Exhausted() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	elapsed := time.Since(tb.lastRefill).Seconds()
+	return math.Min(tb.maxTokens, tb.tokens+elapsed*tb.refillRate) < 1.0
+}
+
+// RateLimiterManager manages global and per-pool, per-account rate limiters.
 type RateLimiterManager struct {
 	mu              sync.RWMutex
-	globalLimiter   *TokenBucket // nil if disabled
-	accountLimiters map[string]*TokenBucket
-	perAccountRPM   int // from PoolConfig, 0 = disabled
+	globalLimiter   *TokenBucket            // nil if disabled
+	accountLimiters map[string]*TokenBucket // keyed by poolID + "/" + accountID
+	poolRPM         map[string]int          // per-account RPM by pool ID, 0 = disabled
 }
 
 var rateLimiter = &RateLimiterManager{
 	accountLimiters: make(map[string]*TokenBucket),
+	poolRPM:         make(map[string]int),
 }
 
 // InitRateLimiter initializes the global rate limiter from environment variables.
@@ -75,34 +89,67 @@ func InitRateLimiter() {
 	rateLimiter.mu.Unlock()
 }
 
-// SetPerAccountRPM updates the per-account rate limit. Called when pool config changes.
-func SetPerAccountRPM(rpm int) {
+// SetGlobalRPM replaces the global rate limit; 0 disables it.
+func SetGlobalRPM(rpm int) {
+	rateLimiter.mu.Lock()
+	defer rateLimiter.mu.Unlock()
+	if rpm > 0 {
+		rateLimiter.globalLimiter = NewTokenBucket(rpm)
+	} else {
+		rateLimiter.globalLimiter = nil
+	}
+}
+
+// SetPoolRPM updates a pool's per-account rate limit. Called when pool config changes.
+func SetPoolRPM(poolID string, rpm int) {
 	rateLimiter.mu.Lock()
 	defer rateLimiter.mu.Unlock()
-	rateLimiter.perAccountRPM = rpm
-	// Reset existing per-account limiters so they pick up the new rate.
-	rateLimiter.accountLimiters = make(map[string]*TokenBucket)
+	if rpm > 0 {
+		rateLimiter.poolRPM[poolID] = rpm
+	} else {
+		delete(rateLimiter.poolRPM, poolID)
+	}
+	// Reset the pool's limiters so they pick up the new rate.
+	prefix := poolID + "/"
+	for key := range rateLimiter.accountLimiters {
+		if strings.HasPrefix(key, prefix) {
+			delete(rateLimiter.accountLimiters, key)
+		}
+	}
+}
+
+// limiterPoolID maps requests made with an individual account key (no pool)
+// onto the default pool's limits.
+func limiterPoolID(poolID string) string {
+	if poolID == "" {
+		return store.DefaultPoolID
+	}
+	return poolID
 }
 
-// CheckRateLimit checks both global and per-account rate limits.
+// CheckRateLimit checks both global and per-account rate limits for a pool.
 // Returns (allowed, retryAfterSeconds).
-func CheckRateLimit(accountID string) (bool, float64) {
+func CheckRateLimit(poolID, accountID string) (bool, float64) {
+	poolID = limiterPoolID(poolID)
+
 	rateLimiter.mu.RLock()
 	globalLim := rateLimiter.globalLimiter
-	perRPM := rateLimiter.perAccountRPM
+	perRPM := rateLimiter.poolRPM[poolID]
 	rateLimiter.mu.RUnlock()
 
 	// Check global limit first.
 	if globalLim != nil {
 		if ok, retryAfter := globalLim.Allow(); !ok {
+			rateLimitRejections.Inc(poolID, accountID, "global")
 			return false, retryAfter
 		}
 	}
 
 	// Check per-account limit.
 	if perRPM > 0 && accountID != "" {
-		lim := getOrCreateAccountLimiter(accountID, perRPM)
+		lim := getOrCreateAccountLimiter(poolID+"/"+accountID, perRPM)
 		if ok, retryAfter := lim.Allow(); !ok {
+			rateLimitRejections.Inc(poolID, accountID, "account")
 			return false, retryAfter
 		}
 	}
@@ -110,9 +157,18 @@ func CheckRateLimit(accountID string) (bool, float64) {
 	return true, 0
 }
 
-func getOrCreateAccountLimiter(accountID string, rpm int) *TokenBucket {
+// IsRateLimited reports whether the pool's per-account limiter for accountID is
+// currently exhausted. It does not consume a token.
+func IsRateLimited(poolID, accountID string) bool {
+	rateLimiter.mu.RLock()
+	lim, ok := rateLimiter.accountLimiters[limiterPoolID(poolID)+"/"+accountID]
+	rateLimiter.mu.RUnlock()
+	return ok && lim.Exhausted()
+}
+
+func getOrCreateAccountLimiter(key string, rpm int) *TokenBucket {
 	rateLimiter.mu.RLock()
-	lim, ok := rateLimiter.accountLimiters[accountID]
+	lim, ok := rateLimiter.accountLimiters[key]
 	rateLimiter.mu.RUnlock()
 	if ok {
 		return lim
@@ -120,10 +176,10 @@ func getOrCreateAccountLimiter(accountID string, rpm int) *TokenBucket {
 
 	rateLimiter.mu.Lock()
 	defer rateLimiter.mu.Unlock()
-	if lim, ok = rateLimiter.accountLimiters[accountID]; ok {
+	if lim, ok = rateLimiter.accountLimiters[key]; ok {
 		return lim
 	}
 	lim = NewTokenBucket(rpm)
-	rateLimiter.accountLimiters[accountID] = lim
+	rateLimiter.accountLimiters[key] = lim
 	return lim
 }
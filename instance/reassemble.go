@@ -0,0 +1,301 @@
+package instance
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// sseEvent is one server-sent event: its optional event name and data payload.
+type sseEvent struct {
+	name string
+	data string
+}
+
+func parseSSE(text string) []sseEvent {
+	var events []sseEvent
+	var cur sseEvent
+	var data []string
+	dispatch := func() {
+		if len(data) > 0 {
+			cur.data = strings.Join(data, "\n")
+			events = append(events, cur)
+		}
+		cur, data = sseEvent{}, nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+			dispatch()
+		case strings.HasPrefix(line, "event:"):
+			cur.name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	dispatch()
+	return events
+}
+
+// ReassembleStream rebuilds the final response object from a captured SSE
+// stream in Anthropic Messages, Chat Completions or Responses format. It
+// returns false if text is not a recognizable stream.
+func ReassembleStream(text string) (json.RawMessage, bool) {
+	var payloads []map[string]interface{}
+	for _, ev := range parseSSE(text) {
+		if ev.data == "[DONE]" {
+			continue
+		}
+		var p map[string]interface{}
+		if json.Unmarshal([]byte(ev.data), &p) == nil {
+			payloads = append(payloads, p)
+		}
+	}
+	if len(payloads) == 0 {
+		return nil, false
+	}
+
+	var out interface{}
+	switch typ, _ := payloads[0]["type"].(string); {
+	case typ == "message_start" || typ == "ping" || typ == "error":
+		out = reassembleAnthropic(payloads)
+	case strings.HasPrefix(typ, "response."):
+		out = reassembleResponses(payloads)
+	case payloads[0]["choices"] != nil || payloads[0]["object"] == "chat.completion.chunk":
+		out = reassembleChatCompletions(payloads)
+	default:
+		return nil, false
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// reassembleAnthropic folds Anthropic stream events into a Messages response.
+func reassembleAnthropic(events []map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{}
+	blocks := map[int]map[string]interface{}{}
+	partialJSON := map[int]string{}
+
+	for _, ev := range events {
+		idx := jsonInt(ev["index"])
+		switch ev["type"] {
+		case "message_start":
+			if m, ok := ev["message"].(map[string]interface{}); ok {
+				msg = m
+			}
+		case "content_block_start":
+			if b, ok := ev["content_block"].(map[string]interface{}); ok {
+				blocks[idx] = b
+			}
+		case "content_block_delta":
+			b := blocks[idx]
+			delta, _ := ev["delta"].(map[string]interface{})
+			if b == nil || delta == nil {
+				continue
+			}
+			switch delta["type"] {
+			case "text_delta":
+				b["text"] = jsonString(b["text"]) + jsonString(delta["text"])
+			case "thinking_delta":
+				b["thinking"] = jsonString(b["thinking"]) + jsonString(delta["thinking"])
+			case "signature_delta":
+				b["signature"] = jsonString(b["signature"]) + jsonString(delta["signature"])
+			case "input_json_delta":
+				partialJSON[idx] += jsonString(delta["partial_json"])
+			}
+		case "content_block_stop":
+			if raw, ok := partialJSON[idx]; ok && blocks[idx] != nil {
+				var input interface{}
+				if json.Unmarshal([]byte(raw), &input) == nil {
+					blocks[idx]["input"] = input
+				} else {
+					blocks[idx]["input"] = raw
+				}
+			}
+		case "message_delta":
+			if delta, ok := ev["delta"].(map[string]interface{}); ok {
+				for k, v := range delta {
+					msg[k] = v
+				}
+			}
+			if usage, ok := ev["usage"].(map[string]interface{}); ok {
+				merged, _ := msg["usage"].(map[string]interface{})
+				if merged == nil {
+					merged = map[string]interface{}{}
+				}
+				for k, v := range usage {
+					merged[k] = v
+				}
+				msg["usage"] = merged
+			}
+		case "error":
+			msg["error"] = ev["error"]
+		}
+	}
+
+	indexes := make([]int, 0, len(blocks))
+	for i := range blocks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	content := make([]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		content = append(content, blocks[i])
+	}
+	msg["content"] = content
+	return msg
+}
+
+// reassembleChatCompletions folds Chat Completions chunks into a chat.completion.
+func reassembleChatCompletions(chunks []map[string]interface{}) map[string]interface{} {
+	type toolCall struct {
+		ID, Type, Name string
+		Arguments      strings.Builder
+	}
+	type choice struct {
+		Role         string
+		Content      strings.Builder
+		ToolCalls    map[int]*toolCall
+		FinishReason interface{}
+	}
+	out := map[string]interface{}{"object": "chat.completion"}
+	choices := map[int]*choice{}
+
+	for _, chunk := range chunks {
+		for _, k := range []string{"id", "model", "created", "system_fingerprint"} {
+			if v, ok := chunk[k]; ok && v != nil && v != "" {
+				out[k] = v
+			}
+		}
+		if usage, ok := chunk["usage"]; ok && usage != nil {
+			out["usage"] = usage
+		}
+		list, _ := chunk["choices"].([]interface{})
+		for _, raw := range list {
+			c, _ := raw.(map[string]interface{})
+			if c == nil {
+				continue
+			}
+			idx := jsonInt(c["index"])
+			ch := choices[idx]
+			if ch == nil {
+				ch = &choice{ToolCalls: map[int]*toolCall{}}
+				choices[idx] = ch
+			}
+			if fr, ok := c["finish_reason"]; ok && fr != nil {
+				ch.FinishReason = fr
+			}
+			delta, _ := c["delta"].(map[string]interface{})
+			if delta == nil {
+				continue
+			}
+			if role := jsonString(delta["role"]); role != "" {
+				ch.Role = role
+			}
+			ch.Content.WriteString(jsonString(delta["content"]))
+			calls, _ := delta["tool_calls"].([]interface{})
+			for _, rawCall := range calls {
+				tc, _ := rawCall.(map[string]interface{})
+				if tc == nil {
+					continue
+				}
+				ti := jsonInt(tc["index"])
+				call := ch.ToolCalls[ti]
+				if call == nil {
+					call = &toolCall{}
+					ch.ToolCalls[ti] = call
+				}
+				if id := jsonString(tc["id"]); id != "" {
+					call.ID = id
+				}
+				if typ := jsonString(tc["type"]); typ != "" {
+					call.Type = typ
+				}
+				if fn, ok := tc["function"].(map[string]interface{}); ok {
+					if name := jsonString(fn["name"]); name != "" {
+						call.Name = name
+					}
+					call.Arguments.WriteString(jsonString(fn["arguments"]))
+				}
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(choices))
+	for i := range choices {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	outChoices := make([]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		ch := choices[i]
+		role := ch.Role
+		if role == "" {
+			role = "assistant"
+		}
+		message := map[string]interface{}{"role": role, "content": ch.Content.String()}
+		if len(ch.ToolCalls) > 0 {
+			tis := make([]int, 0, len(ch.ToolCalls))
+			for ti := range ch.ToolCalls {
+				tis = append(tis, ti)
+			}
+			sort.Ints(tis)
+			calls := make([]interface{}, 0, len(tis))
+			for _, ti := range tis {
+				tc := ch.ToolCalls[ti]
+				typ := tc.Type
+				if typ == "" {
+					typ = "function"
+				}
+				calls = append(calls, map[string]interface{}{
+					"id":   tc.ID,
+					"type": typ,
+					"function": map[string]interface{}{
+						"name":      tc.Name,
+						"arguments": tc.Arguments.String(),
+					},
+				})
+			}
+			message["tool_calls"] = calls
+		}
+		outChoices = append(outChoices, map[string]interface{}{
+			"index":         i,
+			"message":       message,
+			"finish_reason": ch.FinishReason,
+		})
+	}
+	out["choices"] = outChoices
+	return out
+}
+
+// reassembleResponses returns the final response object of a Responses API
+// stream: the terminal event's response, or the last one seen.
+func reassembleResponses(events []map[string]interface{}) interface{} {
+	var last interface{}
+	for _, ev := range events {
+		resp, ok := ev["response"]
+		if !ok {
+			continue
+		}
+		last = resp
+		switch ev["type"] {
+		case "response.completed", "response.incomplete", "response.failed":
+			return resp
+		}
+	}
+	return last
+}
+
+func jsonString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func jsonInt(v interface{}) int {
+	f, _ := v.(float64)
+	return int(f)
+}
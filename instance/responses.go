@@ -2,9 +2,10 @@ package instance
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 
@@ -15,7 +16,7 @@ import (
 )
 
 // DoResponsesProxy forwards requests directly to GitHub Copilot /responses endpoint.
-func DoResponsesProxy(state *config.State, bodyBytes []byte) (*http.Response, error) {
+func DoResponsesProxy(ctx context.Context, state *config.State, bodyBytes []byte) (*http.Response, error) {
 	// Convert model ID
 	var payload map[string]interface{}
 	if err := json.Unmarshal(bodyBytes, &payload); err == nil {
@@ -28,7 +29,7 @@ func DoResponsesProxy(state *config.State, bodyBytes []byte) (*http.Response, er
 	extraHeaders := make(http.Header)
 	extraHeaders.Set("X-Initiator", "user")
 
-	return ProxyRequestWithBytes(state, "POST", "/responses", bodyBytes, extraHeaders, false)
+	return ProxyRequestWithBytesCtx(ctx, state, "POST", "/responses", bodyBytes, extraHeaders, false)
 }
 
 // ForwardResponsesResponse forwards the upstream response directly to client.
@@ -52,9 +53,11 @@ func forwardResponsesStream(c *gin.Context, resp *http.Response) {
 	c.Header("X-Accel-Buffering", "no")
 	c.Status(resp.StatusCode)
 
+	usage := RequestUsageFrom(c)
 	reader := bufio.NewReaderSize(resp.Body, 10*1024*1024)
 	c.Stream(func(w io.Writer) bool {
 		line, err := reader.ReadBytes('\n')
+		usage.observeSSELine(line)
 		if len(line) > 0 {if _, writeErr := w.Write(line); writeErr != nil {
 				return false
 			}
@@ -64,7 +67,7 @@ func forwardResponsesStream(c *gin.Context, resp *http.Response) {
 		}
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Responses stream read error: %v", err)
+				slog.WarnContext(c.Request.Context(), "responses stream read error", "err", err)
 			}
 			return false
 		}
@@ -78,6 +81,7 @@ func forwardResponsesNonStream(c *gin.Context, resp *http.Response) {
 		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to read response"})
 		return
 	}
+	RequestUsageFrom(c).observeBody(body)
 
 	// Try to filter out empty reasoning items for better client compatibility
 	var respData map[string]interface{}
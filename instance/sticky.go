@@ -0,0 +1,164 @@
+package instance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"copilot-go/store"
+)
+
+const (
+	defaultStickyTTL = 30 * time.Minute
+	// stickyPenaltyWindow is how long after a 429 a pinned account is skipped.
+	stickyPenaltyWindow = 1 * time.Minute
+	stickySweepInterval = 1 * time.Minute
+)
+
+// stickySession pins a conversation to an account until it expires.
+type stickySession struct {
+	AccountID string
+	ExpiresAt time.Time
+}
+
+var (
+	stickyMu        sync.Mutex
+	stickySessions  = make(map[string]*stickySession)
+	stickyLastSweep time.Time
+)
+
+// lookupStickyAccount returns the pinned account for sessionKey if it is still
+// usable, refreshing the session TTL. Returns nil when the session is unknown,
+// expired, or its account is stopped, excluded, rate-limited or recently 429'd.
+func lookupStickyAccount(poolID, sessionKey string, available []store.Account, ttl time.Duration) *store.Account {
+	now := time.Now()
+
+	stickyMu.Lock()
+	session, ok := stickySessions[sessionKey]
+	if ok && now.After(session.ExpiresAt) {
+		delete(stickySessions, sessionKey)
+		ok = false
+	}
+	stickyMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	for i := range available {
+		if available[i].ID != session.AccountID {
+			continue
+		}
+		if IsRateLimited(poolID, session.AccountID) {
+			return nil
+		}
+		if last429 := GetLast429Time(session.AccountID); !last429.IsZero() && now.Sub(last429) < stickyPenaltyWindow {
+			return nil
+		}
+		stickyMu.Lock()
+		session.ExpiresAt = now.Add(ttl)
+		stickyMu.Unlock()
+		return &available[i]
+	}
+	return nil
+}
+
+// pinStickySession (re)binds sessionKey to accountID for ttl.
+func pinStickySession(sessionKey, accountID string, ttl time.Duration) {
+	now := time.Now()
+
+	stickyMu.Lock()
+	defer stickyMu.Unlock()
+
+	stickySessions[sessionKey] = &stickySession{AccountID: accountID, ExpiresAt: now.Add(ttl)}
+
+	if now.Sub(stickyLastSweep) >= stickySweepInterval {
+		stickyLastSweep = now
+		for k, s := range stickySessions {
+			if now.After(s.ExpiresAt) {
+				delete(stickySessions, k)
+			}
+		}
+	}
+}
+
+// ClearStickySessions drops all sticky session bindings.
+func ClearStickySessions() {
+	stickyMu.Lock()
+	stickySessions = make(map[string]*stickySession)
+	stickyMu.Unlock()
+}
+
+// DeriveSessionKey identifies the conversation a request belongs to.
+// In order of preference: the X-Session-Id header, Anthropic metadata.user_id,
+// OpenAI user, or a hash of the system prompt plus the first user message.
+// Returns "" when the request carries nothing usable.
+func DeriveSessionKey(header http.Header, bodyBytes []byte) string {
+	if id := header.Get("X-Session-Id"); id != "" {
+		return "hdr:" + id
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(bodyBytes, &payload); err != nil {
+		return ""
+	}
+
+	if metadata, ok := payload["metadata"].(map[string]interface{}); ok {
+		if userID, _ := metadata["user_id"].(string); userID != "" {
+			return "meta:" + userID
+		}
+	}
+	if user, _ := payload["user"].(string); user != "" {
+		return "user:" + user
+	}
+
+	// Anthropic: top-level system + messages.
+	// OpenAI chat: system/developer messages + messages.
+	// Responses API: instructions + input.
+	var system []interface{}
+	var firstUser interface{}
+	if s, ok := payload["system"]; ok {
+		system = append(system, s)
+	}
+	if s, ok := payload["instructions"]; ok {
+		system = append(system, s)
+	}
+	if messages, ok := payload["messages"].([]interface{}); ok {
+		for _, raw := range messages {
+			msg, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch role, _ := msg["role"].(string); role {
+			case "system", "developer":
+				system = append(system, msg["content"])
+			case "user":
+				if firstUser == nil {
+					firstUser = msg["content"]
+				}
+			}
+		}
+	}
+	if firstUser == nil {
+		switch input := payload["input"].(type) {
+		case string:
+			firstUser = input
+		case []interface{}:
+			if len(input) > 0 {
+				firstUser = input[0]
+			}
+		}
+	}
+	if firstUser == nil {
+		return ""
+	}
+
+	data, err := json.Marshal([]interface{}{system, firstUser})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "hash:" + hex.EncodeToString(sum[:16])
+}
@@ -19,6 +19,8 @@ type AccountUsage struct {
 	mu      sync.Mutex
 	records []usageRecord
 	last429 time.Time
+	hedges  []time.Time // hedge requests sent to this account
+	wasted  []time.Time // requests cancelled after losing a hedge race
 }
 
 // AccountUsageSnapshot is a point-in-time view of an account's usage stats.
@@ -27,6 +29,10 @@ type AccountUsageSnapshot struct {
 	FailedRequests int64  `json:"failedRequests"`
 	Last429At      string `json:"last429At,omitempty"` // RFC3339 or empty
 	WindowSeconds  int    `json:"windowSeconds"`
+	HedgedRequests int64  `json:"hedgedRequests"`
+	WastedRequests int64  `json:"wastedRequests"`
+
+	Latency *LatencySnapshot `json:"latency,omitempty"`
 }
 
 var (
@@ -70,13 +76,33 @@ func RecordRequest(accountID string, failed bool, is429 bool) {
 	u.trimLocked(now)
 }
 
+// recordHedgeUsage records a hedge request or, with wasted set, a request
+// cancelled after losing a hedge race.
+func recordHedgeUsage(accountID string, wasted bool) {
+	u := getOrCreateUsage(accountID)
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if wasted {
+		u.wasted = append(u.wasted, now)
+	} else {
+		u.hedges = append(u.hedges, now)
+	}
+	u.trimLocked(now)
+}
+
 // GetUsageSnapshot returns current usage stats for a single account.
 func GetUsageSnapshot(accountID string) AccountUsageSnapshot {
 	usageMapMu.RLock()
 	u, ok := usageMap[accountID]
 	usageMapMu.RUnlock()
 	if !ok {
-		return AccountUsageSnapshot{WindowSeconds: int(usageWindowDuration.Seconds())}
+		return AccountUsageSnapshot{
+			WindowSeconds: int(usageWindowDuration.Seconds()),
+			Latency:       GetLatencySnapshot(accountID),
+		}
 	}
 
 	u.mu.Lock()
@@ -95,6 +121,9 @@ func GetUsageSnapshot(accountID string) AccountUsageSnapshot {
 		TotalRequests:  total,
 		FailedRequests: failed,
 		WindowSeconds:  int(usageWindowDuration.Seconds()),
+		HedgedRequests: int64(len(u.hedges)),
+		WastedRequests: int64(len(u.wasted)),
+		Latency:        GetLatencySnapshot(accountID),
 	}
 	if !u.last429.IsZero() {
 		snap.Last429At = u.last429.Format(time.RFC3339)
@@ -123,6 +152,9 @@ func GetAllUsageSnapshots() map[string]AccountUsageSnapshot {
 			TotalRequests:  total,
 			FailedRequests: failed,
 			WindowSeconds:  int(usageWindowDuration.Seconds()),
+			HedgedRequests: int64(len(u.hedges)),
+			WastedRequests: int64(len(u.wasted)),
+			Latency:        GetLatencySnapshot(id),
 		}
 		if !u.last429.IsZero() {
 			snap.Last429At = u.last429.Format(time.RFC3339)
@@ -173,4 +205,15 @@ func (u *AccountUsage) trimLocked(now time.Time) {
 	if i > 0 {
 		u.records = u.records[i:]
 	}
+	u.hedges = trimTimes(u.hedges, cutoff)
+	u.wasted = trimTimes(u.wasted, cutoff)
+}
+
+// trimTimes drops timestamps before cutoff from an ordered slice.
+func trimTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
 }
@@ -0,0 +1,283 @@
+package instance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"copilot-go/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	usageFlushInterval   = time.Second
+	usageCompactInterval = time.Hour
+	usageEventBuffer     = 4096
+
+	defaultUsageRawRetentionDays    = 7
+	defaultUsageRollupRetentionDays = 365
+
+	requestUsageKey = "requestUsage"
+)
+
+var (
+	usageEvents  = make(chan store.UsageEvent, usageEventBuffer)
+	usageStop    = make(chan chan struct{})
+	usageStarted atomic.Bool
+)
+
+// StartUsageHistory starts the background writer that persists usage events
+// and periodically compacts old history. Retention is read from
+// USAGE_RAW_RETENTION_DAYS and USAGE_ROLLUP_RETENTION_DAYS.
+func StartUsageHistory() {
+	rawRetention := envDays("USAGE_RAW_RETENTION_DAYS", defaultUsageRawRetentionDays)
+	rollupRetention := envDays("USAGE_ROLLUP_RETENTION_DAYS", defaultUsageRollupRetentionDays)
+
+	usageStarted.Store(true)
+	go func() {
+		flush := time.NewTicker(usageFlushInterval)
+		defer flush.Stop()
+		compact := time.NewTicker(usageCompactInterval)
+		defer compact.Stop()
+
+		compactUsage(rawRetention, rollupRetention)
+		var batch []store.UsageEvent
+		persist := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := store.AppendUsageEvents(batch); err != nil {
+				slog.Error("failed to persist usage events", "events", len(batch), "err", err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case ev := <-usageEvents:
+				batch = append(batch, ev)
+			case <-flush.C:
+				persist()
+			case <-compact.C:
+				compactUsage(rawRetention, rollupRetention)
+			case done := <-usageStop:
+				for len(usageEvents) > 0 {
+					batch = append(batch, <-usageEvents)
+				}
+				persist()
+				close(done)
+				return
+			}
+		}
+	}()
+}
+
+// StopUsageHistory writes the queued usage events and stops the writer,
+// giving up when ctx ends. Events recorded afterwards are not persisted.
+func StopUsageHistory(ctx context.Context) {
+	if usageStarted.Swap(false) {
+		stopWriter(ctx, usageStop)
+	}
+}
+
+// stopWriter asks a background writer loop to flush and exit, and waits for
+// it to finish or for ctx to end.
+func stopWriter(ctx context.Context, stop chan<- chan struct{}) {
+	done := make(chan struct{})
+	select {
+	case stop <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func compactUsage(rawRetention, rollupRetention time.Duration) {
+	if err := store.CompactUsageHistory(rawRetention, rollupRetention); err != nil {
+		slog.Error("failed to compact usage history", "err", err)
+	}
+}
+
+func envDays(name string, def int) time.Duration {
+	return time.Duration(envInt(name, def)) * 24 * time.Hour
+}
+
+// envInt reads a positive integer from the environment, or returns def.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// RecordUsageEvent queues an event for persistence. Events are dropped rather
+// than blocking the request when the writer falls behind.
+func RecordUsageEvent(ev store.UsageEvent) {
+	observeRequestMetrics(ev)
+	select {
+	case usageEvents <- ev:
+	default:
+		slog.Warn("usage event buffer full, dropping event", "endpoint", ev.Endpoint, "account", ev.AccountID)
+	}
+}
+
+// RequestUsage collects usage data for one proxied request as it is served.
+// All methods are safe on a nil receiver.
+type RequestUsage struct {
+	mu           sync.Mutex
+	start        time.Time
+	firstByte    time.Time
+	accountID    string
+	inputTokens  int
+	outputTokens int
+	cachedTokens int
+}
+
+// BeginRequestUsage attaches a usage collector to the request.
+func BeginRequestUsage(c *gin.Context) *RequestUsage {
+	u := &RequestUsage{start: time.Now()}
+	c.Set(requestUsageKey, u)
+	return u
+}
+
+// RequestUsageFrom returns the request's usage collector, or nil.
+func RequestUsageFrom(c *gin.Context) *RequestUsage {
+	if v, ok := c.Get(requestUsageKey); ok {
+		return v.(*RequestUsage)
+	}
+	return nil
+}
+
+// SetAccount records the account that served the request.
+func (u *RequestUsage) SetAccount(accountID string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	u.accountID = accountID
+	u.mu.Unlock()
+}
+
+// AccountID returns the account recorded through SetAccount, or "".
+func (u *RequestUsage) AccountID() string {
+	if u == nil {
+		return ""
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.accountID
+}
+
+// WatchFirstByte records time-to-first-token when resp's body is first read.
+func (u *RequestUsage) WatchFirstByte(resp *http.Response) {
+	if u == nil || resp == nil {
+		return
+	}
+	resp.Body = &firstByteReader{ReadCloser: resp.Body, onFirst: func() {
+		u.mu.Lock()
+		if u.firstByte.IsZero() {
+			u.firstByte = time.Now()
+		}
+		u.mu.Unlock()
+	}}
+}
+
+// usageFields covers both the Chat Completions and Responses API usage objects.
+type usageFields struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	InputTokens         int `json:"input_tokens"`
+	OutputTokens        int `json:"output_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// observeBody records token usage from a JSON response body or stream chunk.
+func (u *RequestUsage) observeBody(data []byte) {
+	if u == nil || !bytes.Contains(data, []byte(`"usage"`)) {
+		return
+	}
+	var payload struct {
+		Usage    *usageFields `json:"usage"`
+		Response *struct {
+			Usage *usageFields `json:"usage"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return
+	}
+	usage := payload.Usage
+	if usage == nil && payload.Response != nil {
+		usage = payload.Response.Usage
+	}
+	if usage == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.inputTokens = usage.PromptTokens + usage.InputTokens
+	u.outputTokens = usage.CompletionTokens + usage.OutputTokens
+	u.cachedTokens = 0
+	if usage.PromptTokensDetails != nil {
+		u.cachedTokens = usage.PromptTokensDetails.CachedTokens
+	}
+	if usage.InputTokensDetails != nil {
+		u.cachedTokens = usage.InputTokensDetails.CachedTokens
+	}
+}
+
+// observeSSELine records token usage carried by an SSE data line.
+func (u *RequestUsage) observeSSELine(line []byte) {
+	if u == nil {
+		return
+	}
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data: "))
+	if !ok {
+		return
+	}
+	u.observeBody(data)
+}
+
+// Event builds the usage event for the finished request. accountID is used
+// when no upstream account was recorded through SetAccount.
+func (u *RequestUsage) Event(endpoint string, status int, accountID, poolID, apiKey, model string) store.UsageEvent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	ev := store.UsageEvent{
+		Time:         u.start.UTC(),
+		AccountID:    u.accountID,
+		PoolID:       poolID,
+		ApiKey:       store.MaskApiKey(apiKey),
+		Model:        store.ToDisplayID(model),
+		Endpoint:     endpoint,
+		Status:       status,
+		InputTokens:  u.inputTokens,
+		OutputTokens: u.outputTokens,
+		CachedTokens: u.cachedTokens,
+		DurationMs:   now.Sub(u.start).Milliseconds(),
+	}
+	if ev.AccountID == "" {
+		ev.AccountID = accountID
+	}
+	if !u.firstByte.IsZero() {
+		ev.TTFTMs = u.firstByte.Sub(u.start).Milliseconds()
+	}
+	return ev
+}
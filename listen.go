@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// listenSpec is where one engine listens: a TCP address, a Unix socket, or
+// both. TLS applies to the TCP listener only.
+type listenSpec struct {
+	name    string
+	handler http.Handler
+	addr    string // "" = no TCP listener
+	socket  string // "" = no Unix socket
+	tls     *tls.Config
+}
+
+// socketOptions are the permissions given to created Unix sockets.
+type socketOptions struct {
+	mode  os.FileMode
+	group string
+}
+
+// parseSocketOptions parses -socket-mode (octal) and -socket-group.
+func parseSocketOptions(mode, group string) (socketOptions, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return socketOptions{}, fmt.Errorf("invalid -socket-mode %q, want octal permissions such as 0660", mode)
+	}
+	return socketOptions{mode: os.FileMode(m), group: group}, nil
+}
+
+// listenUnix creates a Unix socket at path with the given permissions. A
+// stale socket left by a previous run is replaced; one that still accepts
+// connections is an error.
+func listenUnix(path string, opts socketOptions) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// Create the socket owner-only so nobody can connect before the mode and
+	// group are applied: with socket auth, connecting alone grants access.
+	var ln net.Listener
+	err := withUmask(0177, func() (err error) {
+		ln, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, opts.mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if opts.group != "" {
+		gid, err := lookupGroup(opts.group)
+		if err == nil {
+			err = os.Chown(path, -1, gid)
+		}
+		if err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("set socket group: %w", err)
+		}
+	}
+	return ln, nil
+}
+
+// lookupGroup resolves a group name or numeric ID.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// boundListener is an open listener and the configuration key it was opened
+// for, "tcp:<addr>" or "unix:<path>", under which it is handed to a restarted
+// process.
+type boundListener struct {
+	key string
+	net.Listener
+}
+
+// listen opens the spec's listeners, reusing inherited ones with a matching
+// key. Nothing is served yet, so a port in use fails startup before any
+// listener accepts requests.
+func (s listenSpec) listen(opts socketOptions, inherited map[string]net.Listener) ([]boundListener, error) {
+	var lns []boundListener
+	fail := func(err error) ([]boundListener, error) {
+		for _, l := range lns {
+			_ = l.Close()
+		}
+		return nil, err
+	}
+	if s.addr != "" {
+		key := "tcp:" + s.addr
+		ln, ok := inherited[key]
+		if !ok {
+			var err error
+			if ln, err = net.Listen("tcp", s.addr); err != nil {
+				return fail(err)
+			}
+		}
+		delete(inherited, key)
+		lns = append(lns, boundListener{key, ln})
+	}
+	if s.socket != "" {
+		key := "unix:" + s.socket
+		ln, ok := inherited[key]
+		if !ok {
+			var err error
+			if ln, err = listenUnix(s.socket, opts); err != nil {
+				return fail(err)
+			}
+		}
+		delete(inherited, key)
+		lns = append(lns, boundListener{key, ln})
+	}
+	return lns, nil
+}
@@ -2,34 +2,213 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
-	"sync"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"copilot-go/audit"
 	"copilot-go/config"
 	"copilot-go/handler"
 	"copilot-go/instance"
+	"copilot-go/logging"
+	"copilot-go/metrics"
+	"copilot-go/netacl"
+	"copilot-go/oidc"
 	"copilot-go/store"
+	"copilot-go/tlsutil"
+	"copilot-go/tracing"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	webPort := flag.Int("web-port", 3000, "Web console port")
-	proxyPort := flag.Int("proxy-port", 4141, "Proxy server port")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	webPort := flag.Int("web-port", 3000, "Web console port (0 = only the -web-socket)")
+	proxyPort := flag.Int("proxy-port", 4141, "Proxy server port (0 = only the -proxy-socket)")
+	configPath := flag.String("config", os.Getenv("COPILOT_GO_CONFIG"), "YAML or TOML file declaring ports, data directory, proxy URL, accounts, pools and model mappings")
+	dataDir := flag.String("data-dir", "", "Data directory (default $COPILOT_GO_DATA_DIR, then ~/.local/share/copilot-api)")
+	gitops := flag.Bool("gitops", os.Getenv("COPILOT_GO_GITOPS") == "true", "The -config file owns accounts, pools, keys and model mappings: the console is read-only for them and file changes are applied while running")
+	checkOnly := flag.Bool("check-config", false, "Validate the configuration, print what it would change in the data directory and exit")
+	webBind := flag.String("web-bind", os.Getenv("WEB_BIND"), "Address the web console listens on (default all interfaces)")
+	proxyBind := flag.String("proxy-bind", os.Getenv("PROXY_BIND"), "Address the proxy listens on (default all interfaces)")
+	webAllow := flag.String("web-allow", os.Getenv("WEB_ALLOW"), "Comma-separated IPs/CIDRs allowed to reach the web console (default any)")
+	webDeny := flag.String("web-deny", os.Getenv("WEB_DENY"), "Comma-separated IPs/CIDRs denied from the web console")
+	proxyAllow := flag.String("proxy-allow", os.Getenv("PROXY_ALLOW"), "Comma-separated IPs/CIDRs allowed to reach the proxy (default any)")
+	proxyDeny := flag.String("proxy-deny", os.Getenv("PROXY_DENY"), "Comma-separated IPs/CIDRs denied from the proxy")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma-separated IPs/CIDRs of reverse proxies whose X-Forwarded-For is trusted (default none)")
+	webSocket := flag.String("web-socket", os.Getenv("WEB_SOCKET"), "Also serve the web console on this Unix socket path")
+	proxySocket := flag.String("proxy-socket", os.Getenv("PROXY_SOCKET"), "Also serve the proxy on this Unix socket path")
+	socketMode := flag.String("socket-mode", envOr("SOCKET_MODE", "0660"), "Permissions of the Unix sockets (octal)")
+	socketGroup := flag.String("socket-group", os.Getenv("SOCKET_GROUP"), "Group owning the Unix sockets (name or GID)")
+	proxySocketAuth := flag.String("proxy-socket-auth", os.Getenv("PROXY_SOCKET_AUTH"), "Authenticate key-less requests on the proxy socket as pool:<id> or account:<id|name>")
+	tlsCert := flag.String("tls-cert", os.Getenv("TLS_CERT_FILE"), "PEM certificate for HTTPS, reloaded when the file changes")
+	tlsKey := flag.String("tls-key", os.Getenv("TLS_KEY_FILE"), "PEM private key for -tls-cert")
+	tlsSelfSigned := flag.Bool("tls-self-signed", os.Getenv("TLS_SELF_SIGNED") == "true", "Serve HTTPS with a self-signed certificate generated in the data directory if -tls-cert is not set")
+	tlsListeners := flag.String("tls-listeners", envOr("TLS_LISTENERS", "web,proxy"), "Listeners that serve HTTPS when a certificate is configured: web, proxy or web,proxy")
+	proxyClientCA := flag.String("proxy-client-ca", os.Getenv("PROXY_CLIENT_CA"), "PEM CA bundle for verifying proxy client certificates (enables mTLS)")
+	proxyClientAuth := flag.String("proxy-client-auth", envOr("PROXY_CLIENT_AUTH", "optional"), "With -proxy-client-ca: optional or require a client certificate")
+	shutdownTimeout := flag.Duration("shutdown-timeout", envDurationOr("SHUTDOWN_TIMEOUT", 30*time.Second), "How long to wait for in-flight requests and streams on shutdown")
+	gracefulRestart := flag.Bool("graceful-restart", os.Getenv("GRACEFUL_RESTART") == "true", "On SIGHUP, re-execute the binary and hand it the listeners (Unix only)")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
 	autoStart := flag.Bool("auto-start", true, "Auto-start enabled accounts")
+	metricsPort := flag.Int("metrics-port", 0, "Serve Prometheus /metrics on a separate port (0 = on the web console port)")
+	metricsToken := flag.String("metrics-token", os.Getenv("METRICS_TOKEN"), "Bearer token required to scrape /metrics (default $METRICS_TOKEN)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector URL for tracing (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	logFormat := flag.String("log-format", envOr("LOG_FORMAT", "text"), "Log format: text or json")
+	logLevel := flag.String("log-level", envOr("LOG_LEVEL", "info"), "Log level: debug, info, warn or error")
+	capture := flag.Bool("capture", os.Getenv("CAPTURE") == "true", "Capture redacted requests and responses to the data directory")
+	captureRedact := flag.String("capture-redact", os.Getenv("CAPTURE_REDACT_FIELDS"), "Extra comma-separated JSON fields to redact in captures")
+	auditSyslog := flag.String("audit-syslog", os.Getenv("AUDIT_SYSLOG"), "Forward the audit log to syslog: local, udp://host:port, tcp://host:port or unix:///path")
+	auditWebhook := flag.String("audit-webhook", os.Getenv("AUDIT_WEBHOOK_URL"), "Forward the audit log to this URL as JSON POSTs (signed with $AUDIT_WEBHOOK_SECRET if set)")
+	oidcIssuer := flag.String("oidc-issuer", os.Getenv("OIDC_ISSUER"), "OpenID Connect issuer URL for console single sign-on")
+	oidcClientID := flag.String("oidc-client-id", os.Getenv("OIDC_CLIENT_ID"), "OpenID Connect client ID (secret from $OIDC_CLIENT_SECRET)")
+	oidcRoleMap := flag.String("oidc-role-map", os.Getenv("OIDC_ROLE_MAP"), "Map provider groups to console roles: group=role,group=role")
 	flag.Parse()
 
-	if !*verbose {
+	if *verbose {
+		*logLevel = "debug"
+	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
+	if err := logging.Setup(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	// Declarative configuration; flags given on the command line win
+	fileCfg, err := loadConfig(*configPath, webPort, proxyPort, dataDir)
+	if err != nil {
+		if *checkOnly {
+			printConfigError(err)
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+	if *gitops && *configPath == "" {
+		log.Fatal("-gitops needs a -config file")
+	}
+	if *dataDir != "" {
+		store.AppDir = *dataDir
+	}
+	if *checkOnly {
+		os.Exit(checkConfig(fileCfg, *gitops))
+	}
+
+	// Network access control
+	webACL, err := parseACL(*webAllow, *webDeny)
+	if err != nil {
+		log.Fatalf("Invalid web console ACL: %v", err)
+	}
+	proxyACL, err := parseACL(*proxyAllow, *proxyDeny)
+	if err != nil {
+		log.Fatalf("Invalid proxy ACL: %v", err)
+	}
+	trusted, err := netacl.ParseString(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	handler.SetProxyBind(*proxyBind)
+	sockOpts, err := parseSocketOptions(*socketMode, *socketGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := handler.SetProxySocket(*proxySocket, *proxySocketAuth); err != nil {
+		log.Fatalf("Invalid -proxy-socket-auth: %v", err)
+	}
 
 	// Ensure data directories exist
 	if err := store.EnsurePaths(); err != nil {
 		log.Fatalf("Failed to initialize data paths: %v", err)
 	}
 
+	// HTTPS and client certificates
+	var selfSignedCert string
+	if *tlsCert == "" && *tlsSelfSigned {
+		if *tlsCert, *tlsKey, err = tlsutil.EnsureSelfSigned(store.TLSDir()); err != nil {
+			log.Fatalf("Failed to create self-signed certificate: %v", err)
+		}
+		selfSignedCert = *tlsCert
+	}
+	webTLS, proxyTLS, err := listenerTLS(*tlsCert, *tlsKey, *tlsListeners, tlsutil.Options{
+		ClientCAFile: *proxyClientCA,
+		ClientAuth:   tlsutil.ClientAuth(*proxyClientAuth),
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if proxyTLS != nil {
+		handler.SetProxyTLS(true, selfSignedCert)
+	}
+
+	// Forward the audit trail of console actions
+	auditCfg := audit.ConfigFromEnv()
+	auditCfg.Syslog, auditCfg.Webhook = *auditSyslog, *auditWebhook
+	if err := audit.Init(auditCfg); err != nil {
+		log.Fatalf("Failed to initialize audit forwarding: %v", err)
+	}
+
+	// Console single sign-on
+	oidcCfg, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid single sign-on configuration: %v", err)
+	}
+	oidcCfg.Issuer, oidcCfg.ClientID = *oidcIssuer, *oidcClientID
+	roleMap, err := oidc.ParseRoleMap(*oidcRoleMap)
+	if err != nil {
+		log.Fatalf("Invalid -oidc-role-map: %v", err)
+	}
+	oidcCfg.RoleMap = roleMap
+	for group, role := range roleMap {
+		if !store.ValidRole(role) {
+			log.Fatalf("Invalid -oidc-role-map: group %q maps to unknown role %q", group, role)
+		}
+	}
+	if oidcCfg.DefaultRole != "" && !store.ValidRole(oidcCfg.DefaultRole) {
+		log.Fatalf("Invalid OIDC_DEFAULT_ROLE %q", oidcCfg.DefaultRole)
+	}
+	if err := oidc.Init(oidcCfg); err != nil {
+		log.Fatalf("Failed to initialize single sign-on: %v", err)
+	}
+	if oidcCfg.Issuer != "" {
+		log.Printf("Console single sign-on via %s", oidcCfg.Issuer)
+	}
+
+	// Export traces when a collector is configured
+	traceCfg := tracing.ConfigFromEnv()
+	if *otlpEndpoint != "" {
+		traceCfg.Endpoint = *otlpEndpoint
+	}
+	tracing.Init(traceCfg)
+
+	// Persist per-request usage history
+	instance.StartUsageHistory()
+
+	// Capture redacted request/response pairs for debugging and replay
+	if *capture {
+		var fields []string
+		if *captureRedact != "" {
+			fields = strings.Split(*captureRedact, ",")
+		}
+		instance.StartCapture(instance.CaptureConfigFromEnv(fields))
+	}
+
+	// Write the declared objects; in GitOps mode also remove undeclared ones
+	if _, err := applyConfig(fileCfg, *gitops); err != nil {
+		log.Fatalf("Failed to apply configuration: %v", err)
+	}
+	if *gitops {
+		handler.SetGitOps(*configPath, fileCfg.ProxyURL != nil)
+		log.Printf("GitOps mode: accounts, pools and model mappings are managed by %s", *configPath)
+	}
+
 	// Load proxy config and apply to HTTP clients
 	if proxyCfg, err := store.GetProxyConfig(); err == nil && proxyCfg.ProxyURL != "" {
 		config.SetProxyURL(proxyCfg.ProxyURL)
@@ -53,42 +232,151 @@ func main() {
 		}
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// Web Console
+	webEngine := newEngine(*verbose, trusted)
+	if !webACL.Empty() {
+		log.Printf("Web Console ACL: %s", webACL)
+		webEngine.Use(handler.IPFilter(webACL))
+	}
+	if *metricsPort == 0 {
+		webEngine.GET("/metrics", gin.WrapH(metrics.Handler(*metricsToken)))
+	}
+	handler.RegisterConsoleAPI(webEngine, *proxyPort)
 
-	// Start Web Console
-	go func() {
-		defer wg.Done()
-		webEngine := gin.New()
-		if *verbose {
-			webEngine.Use(gin.Logger())
-		}
-		webEngine.Use(gin.Recovery())
+	// Proxy
+	proxyEngine := newEngine(*verbose, trusted)
+	if !proxyACL.Empty() {
+		log.Printf("Proxy ACL: %s", proxyACL)
+		proxyEngine.Use(handler.IPFilter(proxyACL))
+	}
+	handler.RegisterProxy(proxyEngine)
+	if fileCfg.RateLimitRPM != nil {
+		instance.SetGlobalRPM(*fileCfg.RateLimitRPM)
+	}
 
-		handler.RegisterConsoleAPI(webEngine, *proxyPort)
+	specs := []listenSpec{
+		{name: "Web Console", handler: webEngine.Handler(), socket: *webSocket, tls: webTLS},
+		{name: "Proxy", handler: proxyEngine.Handler(), socket: *proxySocket, tls: proxyTLS},
+	}
+	if *webPort != 0 {
+		specs[0].addr = net.JoinHostPort(*webBind, strconv.Itoa(*webPort))
+	}
+	if *proxyPort != 0 {
+		specs[1].addr = net.JoinHostPort(*proxyBind, strconv.Itoa(*proxyPort))
+	}
 
-		log.Printf("Web Console listening on :%d", *webPort)
-		if err := webEngine.Run(fmt.Sprintf(":%d", *webPort)); err != nil {
-			log.Fatalf("Web Console failed: %v", err)
-		}
-	}()
-
-	// Start Proxy
-	go func() {
-		defer wg.Done()
-		proxyEngine := gin.New()
-		if *verbose {
-			proxyEngine.Use(gin.Logger())
+	// Metrics on a separate port, bound and filtered like the web console
+	if *metricsPort != 0 {
+		metricsEngine := newEngine(*verbose, trusted)
+		if !webACL.Empty() {
+			metricsEngine.Use(handler.IPFilter(webACL))
 		}
-		proxyEngine.Use(gin.Recovery())
+		metricsEngine.GET("/metrics", gin.WrapH(metrics.Handler(*metricsToken)))
+		specs = append(specs, listenSpec{
+			name:    "Metrics",
+			handler: metricsEngine.Handler(),
+			addr:    net.JoinHostPort(*webBind, strconv.Itoa(*metricsPort)),
+		})
+	}
 
-		handler.RegisterProxy(proxyEngine)
+	inherited, err := inheritedListeners()
+	if err != nil {
+		log.Fatalf("Failed to inherit listeners: %v", err)
+	}
+	serveErrs := make(chan error, 1)
+	servers, err := startServers(specs, sockOpts, inherited, serveErrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notifyReady()
+
+	var watcher *configWatcher
+	if *gitops {
+		watcher = newConfigWatcher(fileCfg, *autoStart, *webPort, *proxyPort, *dataDir)
+		watcher.start()
+	}
 
-		log.Printf("Proxy listening on :%d", *proxyPort)
-		if err := proxyEngine.Run(fmt.Sprintf(":%d", *proxyPort)); err != nil {
-			log.Fatalf("Proxy failed: %v", err)
+	// Drain and exit on SIGINT or SIGTERM or when a listener fails; hand over
+	// and drain on SIGHUP
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	if *gracefulRestart && restartSignal != nil {
+		signal.Notify(sigs, restartSignal)
+	}
+	exitCode := 0
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == restartSignal {
+				// The new process applies the configuration from here on.
+				watcher.stop()
+				if err := handoff(servers); err != nil {
+					slog.Error("Graceful restart failed, still serving", "err", err)
+					watcher.start()
+					continue
+				}
+				slog.Info("Handed listeners to the new process, draining")
+			} else {
+				slog.Info("Received signal, draining requests", "signal", sig.String(), "timeout", *shutdownTimeout)
+			}
+		case err := <-serveErrs:
+			slog.Error("Listener failed, draining requests", "err", err, "timeout", *shutdownTimeout)
+			exitCode = 1
 		}
-	}()
+		break wait
+	}
+	signal.Stop(sigs)
+	watcher.stop()
+	shutdown(servers, *shutdownTimeout)
+	slog.Info("Shutdown complete")
+	os.Exit(exitCode)
+}
+
+// newEngine returns a gin engine with the middleware both listeners share.
+func newEngine(verbose bool, trusted netacl.List) *gin.Engine {
+	engine := gin.New()
+	if verbose {
+		engine.Use(gin.Logger())
+	}
+	engine.Use(gin.Recovery())
+	setTrustedProxies(engine, trusted)
+	return engine
+}
+
+// parseACL parses comma-separated allow and deny lists.
+func parseACL(allow, deny string) (netacl.ACL, error) {
+	var acl netacl.ACL
+	var err error
+	if acl.Allow, err = netacl.ParseString(allow); err != nil {
+		return acl, err
+	}
+	acl.Deny, err = netacl.ParseString(deny)
+	return acl, err
+}
 
-	wg.Wait()
+// setTrustedProxies makes the engine honor X-Forwarded-For only from the
+// given proxies; with none, the client is always the direct peer.
+func setTrustedProxies(engine *gin.Engine, trusted netacl.List) {
+	var list []string
+	for _, p := range trusted {
+		list = append(list, p.String())
+	}
+	if err := engine.SetTrustedProxies(list); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+}
+
+func envDurationOr(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
 }
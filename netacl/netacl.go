@@ -0,0 +1,95 @@
+// Package netacl matches client addresses against CIDR allow and deny lists.
+package netacl
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// List is a set of networks. Single addresses are stored as /32 or /128.
+type List []netip.Prefix
+
+// Parse parses addresses and CIDR ranges such as "10.0.0.0/8", "::1" or
+// "192.168.1.10".
+func Parse(entries []string) (List, error) {
+	var l List
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", e)
+			}
+			l = append(l, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q", e)
+		}
+		a = a.Unmap()
+		l = append(l, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return l, nil
+}
+
+// ParseString parses a comma-separated list, as given on the command line.
+func ParseString(s string) (List, error) {
+	return Parse(strings.Split(s, ","))
+}
+
+// Contains reports whether ip is in any of the networks.
+func (l List) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range l {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL admits addresses in Allow, or any address if Allow is empty, unless
+// they are also in Deny.
+type ACL struct {
+	Allow List
+	Deny  List
+}
+
+// Empty reports whether the ACL admits everything.
+func (a ACL) Empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+// Permits reports whether the ACL admits ip, given as a string such as the
+// result of gin's ClientIP. Unparseable addresses are only admitted by an
+// empty ACL.
+func (a ACL) Permits(ip string) bool {
+	if a.Empty() {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	if a.Deny.Contains(addr) {
+		return false
+	}
+	return len(a.Allow) == 0 || a.Allow.Contains(addr)
+}
+
+// String renders the ACL for logs.
+func (a ACL) String() string {
+	join := func(l List) string {
+		s := make([]string, len(l))
+		for i, p := range l {
+			s[i] = p.String()
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("allow=[%s] deny=[%s]", join(a.Allow), join(a.Deny))
+}
@@ -0,0 +1,281 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 for crypto.Hash
+	_ "crypto/sha512" // register SHA-384/512 for crypto.Hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clockSkew        = 2 * time.Minute
+	jwksRefreshDelay = time.Minute // minimum time between JWKS fetches for unknown key IDs
+)
+
+// jwk is one key of a JSON Web Key Set. Only RSA and EC signing keys are
+// used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the provider's signing keys, refetching them when a token
+// names a key it has not seen, as happens after key rotation.
+type keySet struct {
+	uri     string
+	getJSON func(ctx context.Context, u string, v any) error
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newKeySet(uri string, getJSON func(ctx context.Context, u string, v any) error) *keySet {
+	return &keySet{uri: uri, getJSON: getJSON}
+}
+
+// key returns the public key for kid. An empty kid matches the only key of
+// a single-key set. With refresh, cached keys are refetched first unless
+// they were fetched less than jwksRefreshDelay ago; this handles providers
+// that rotate a key without changing its ID.
+func (ks *keySet) key(ctx context.Context, kid string, refresh bool) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	stale := ks.keys == nil || time.Since(ks.fetchedAt) >= jwksRefreshDelay
+	if k, ok := ks.lookup(kid); ok && !(refresh && stale) {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := ks.getJSON(ctx, ks.uri, &set); err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	ks.keys = make(map[string]crypto.PublicKey)
+	ks.fetchedAt = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			ks.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := ks.lookup(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if k, ok := ks.keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// algHashes lists the accepted signature algorithms. Symmetric and "none"
+// algorithms are deliberately absent.
+var algHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks the ID token's signature and its iss, aud, azp, exp, iat and
+// nonce claims, and returns the claims.
+func (p *provider) verify(ctx context.Context, meta *discovery, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header: %w", err)
+	}
+	hash, ok := algHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+
+	p.mu.Lock()
+	keys := p.keys
+	p.mu.Unlock()
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	pub, err := keys.key(ctx, header.Kid, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, pub, hash, digest, sig); err != nil {
+		pub, kerr := keys.key(ctx, header.Kid, true)
+		if kerr != nil || verifySignature(header.Alg, pub, hash, digest, sig) != nil {
+			return nil, err
+		}
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != meta.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q does not match %q", iss, meta.Issuer)
+	}
+	aud := audiences(claims["aud"])
+	if !containsString(aud, p.cfg.ClientID) {
+		return nil, errors.New("ID token is not intended for this client")
+	}
+	if azp, _ := claims["azp"].(string); len(aud) > 1 && azp != p.cfg.ClientID {
+		return nil, errors.New("ID token authorized party does not match this client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("ID token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, errors.New("ID token was issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	invalid := errors.New("invalid ID token signature")
+	switch alg[:2] {
+	case "RS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return invalid
+		}
+	case "PS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(k, hash, digest, sig, nil) != nil {
+			return invalid
+		}
+	case "ES":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return invalid
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	default:
+		return invalid
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audiences normalizes the aud claim, which may be a string or an array.
+func audiences(v any) []string {
+	switch a := v.(type) {
+	case string:
+		return []string{a}
+	case []any:
+		out := make([]string, 0, len(a))
+		for _, s := range a {
+			if str, ok := s.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+// Package oidc signs console users in through an OpenID Connect provider
+// using the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pendingTTL      = 10 * time.Minute // time allowed at the provider's login page
+	discoveryMaxAge = time.Hour
+)
+
+var (
+	ErrDisabled = errors.New("single sign-on is not configured")
+	ErrState    = errors.New("login state expired or not found")
+)
+
+// Config describes the provider and how its claims map to console users.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients, which rely on PKCE alone
+	Scopes       []string
+	// RedirectURL is the callback registered with the provider. Empty means
+	// derive it from the request that starts the login.
+	RedirectURL string
+	// UsernameClaim names the claim used to name the console user, falling
+	// back to a verified email and then sub. Users are identified by the
+	// issuer and sub, never by this name.
+	UsernameClaim string
+	GroupsClaim   string
+	// RoleMap maps group names to console roles. A user gets the highest
+	// role among their groups, or DefaultRole if none match; an empty
+	// DefaultRole denies them.
+	RoleMap     map[string]string
+	DefaultRole string
+}
+
+// ConfigFromEnv reads OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET,
+// OIDC_SCOPES, OIDC_REDIRECT_URL, OIDC_USERNAME_CLAIM, OIDC_GROUPS_CLAIM,
+// OIDC_ROLE_MAP and OIDC_DEFAULT_ROLE. A malformed OIDC_ROLE_MAP is an error.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Issuer:        os.Getenv("OIDC_ISSUER"),
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:        strings.Fields(strings.ReplaceAll(envOr("OIDC_SCOPES", "openid profile email groups"), ",", " ")),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		UsernameClaim: envOr("OIDC_USERNAME_CLAIM", "preferred_username"),
+		GroupsClaim:   envOr("OIDC_GROUPS_CLAIM", "groups"),
+		DefaultRole:   os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	roleMap, err := ParseRoleMap(os.Getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return cfg, fmt.Errorf("OIDC_ROLE_MAP: %w", err)
+	}
+	cfg.RoleMap = roleMap
+	return cfg, nil
+}
+
+// ParseRoleMap parses "group=role,group=role".
+func ParseRoleMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, want group=role", pair)
+		}
+		m[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+	return m, nil
+}
+
+// Identity is a verified user as reported by the provider. Issuer and
+// Subject identify them; Username is only a name to show.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// discovery is the subset of the provider metadata we use.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a login waiting for the provider to redirect back.
+type pendingLogin struct {
+	verifier    string
+	nonce       string
+	redirectURL string
+	expiresAt   time.Time
+}
+
+type provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu      sync.Mutex
+	meta    *discovery
+	metaAt  time.Time
+	keys    *keySet
+	pending map[string]*pendingLogin
+}
+
+var (
+	current   *provider
+	currentMu sync.RWMutex
+)
+
+// Init enables single sign-on with cfg. An empty issuer disables it. The
+// provider is contacted on the first login, not here, so an unreachable
+// provider does not block startup.
+func Init(cfg Config) error {
+	if cfg.Issuer == "" {
+		currentMu.Lock()
+		current = nil
+		currentMu.Unlock()
+		return nil
+	}
+	if cfg.ClientID == "" {
+		return errors.New("OIDC client ID is required")
+	}
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid OIDC issuer %q", cfg.Issuer)
+	}
+	if !containsString(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	currentMu.Lock()
+	current = &provider{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 15 * time.Second},
+		pending: make(map[string]*pendingLogin),
+	}
+	currentMu.Unlock()
+	return nil
+}
+
+// Enabled reports whether single sign-on is configured.
+func Enabled() bool {
+	return get() != nil
+}
+
+// Settings returns the active configuration.
+func Settings() (Config, bool) {
+	p := get()
+	if p == nil {
+		return Config{}, false
+	}
+	return p.cfg, true
+}
+
+func get() *provider {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return current
+}
+
+// Begin starts a login and returns the provider URL to send the browser to
+// and the state that the callback must present. redirectURL is used when
+// the configuration does not set one.
+func Begin(ctx context.Context, redirectURL string) (authURL, state string, err error) {
+	p := get()
+	if p == nil {
+		return "", "", ErrDisabled
+	}
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if p.cfg.RedirectURL != "" {
+		redirectURL = p.cfg.RedirectURL
+	}
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	p.mu.Lock()
+	now := time.Now()
+	for k, pl := range p.pending {
+		if now.After(pl.expiresAt) {
+			delete(p.pending, k)
+		}
+	}
+	p.pending[state] = &pendingLogin{verifier: verifier, nonce: nonce, redirectURL: redirectURL, expiresAt: now.Add(pendingTTL)}
+	p.mu.Unlock()
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", redirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Finish exchanges the authorization code from the callback for tokens and
+// returns the identity from the verified ID token.
+func Finish(ctx context.Context, state, code string) (*Identity, error) {
+	p := get()
+	if p == nil {
+		return nil, ErrDisabled
+	}
+	p.mu.Lock()
+	pl, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pl.expiresAt) {
+		return nil, ErrState
+	}
+
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, err := p.exchange(ctx, meta, code, pl)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.verify(ctx, meta, rawIDToken, pl.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return p.identity(claims)
+}
+
+// discover fetches and caches the provider metadata.
+func (p *provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.metaAt) < discoveryMaxAge {
+		return p.meta, nil
+	}
+
+	var meta discovery
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &meta); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: provider metadata is incomplete")
+	}
+	if p.meta == nil || p.meta.JWKSURI != meta.JWKSURI {
+		p.keys = newKeySet(meta.JWKSURI, p.getJSON)
+	}
+	p.meta, p.metaAt = &meta, time.Now()
+	return p.meta, nil
+}
+
+// exchange redeems the authorization code and returns the raw ID token.
+func (p *provider) exchange(ctx context.Context, meta *discovery, code string, pl *pendingLogin) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", pl.redirectURL)
+	form.Set("code_verifier", pl.verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OIDC token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.Unmarshal(body, &tok)
+	if resp.StatusCode != http.StatusOK {
+		if tok.Error != "" {
+			return "", fmt.Errorf("OIDC token exchange: %s %s", tok.Error, tok.ErrorDescription)
+		}
+		return "", fmt.Errorf("OIDC token exchange: status %d", resp.StatusCode)
+	}
+	if tok.IDToken == "" {
+		return "", errors.New("OIDC token exchange: no id_token in response")
+	}
+	return tok.IDToken, nil
+}
+
+// identity extracts the subject, username, email and groups from verified
+// claims. An email is only used as the username once the provider has
+// verified it.
+func (p *provider) identity(claims map[string]any) (*Identity, error) {
+	id := &Identity{}
+	id.Issuer, _ = claims["iss"].(string)
+	id.Subject, _ = claims["sub"].(string)
+	if id.Subject == "" {
+		return nil, errors.New("ID token has no sub claim")
+	}
+	if verified, _ := claims["email_verified"].(bool); verified {
+		id.Email, _ = claims["email"].(string)
+	}
+	id.Username, _ = claims[p.cfg.UsernameClaim].(string)
+	if p.cfg.UsernameClaim == "email" {
+		id.Username = id.Email
+	}
+	for _, v := range []string{id.Email, id.Subject} {
+		if id.Username == "" {
+			id.Username = v
+		}
+	}
+	switch g := claims[p.cfg.GroupsClaim].(type) {
+	case string:
+		id.Groups = strings.Fields(strings.ReplaceAll(g, ",", " "))
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+func (p *provider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// randomString returns 32 random bytes, base64url-encoded, as used for
+// state, nonce and the PKCE verifier.
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
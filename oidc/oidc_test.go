@@ -0,0 +1,334 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"copilot-go/oidc/oidctest"
+)
+
+const (
+	testClientID    = "console"
+	testRedirectURL = "http://console.test/api/auth/oidc/callback"
+)
+
+// newTestProvider starts a mock provider and enables single sign-on with it.
+func newTestProvider(t *testing.T) *oidctest.Provider {
+	t.Helper()
+	idp := oidctest.NewProvider(testClientID)
+	t.Cleanup(func() {
+		_ = Init(Config{})
+		idp.Close()
+	})
+	err := Init(Config{
+		Issuer:        idp.URL,
+		ClientID:      testClientID,
+		Scopes:        []string{"openid", "profile", "email", "groups"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp
+}
+
+// begin starts a login and checks the authorization request.
+func begin(t *testing.T) (authURL, state string) {
+	t.Helper()
+	authURL, state, err := Begin(context.Background(), testRedirectURL)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	q := mustParse(t, authURL).Query()
+	if q.Get("state") != state || q.Get("redirect_uri") != testRedirectURL || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	return authURL, state
+}
+
+// login signs in at idp with claims and finishes the login.
+func login(t *testing.T, idp *oidctest.Provider, claims map[string]any) (*Identity, error) {
+	t.Helper()
+	authURL, _ := begin(t)
+	callback, err := idp.Login(authURL, claims)
+	if err != nil {
+		t.Fatalf("provider login: %v", err)
+	}
+	q := callback.Query()
+	return Finish(context.Background(), q.Get("state"), q.Get("code"))
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func wantError(t *testing.T, err error, substr string) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), substr) {
+		t.Fatalf("err = %v, want one containing %q", err, substr)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			idp := newTestProvider(t)
+			if err := idp.RotateKey(alg, false); err != nil {
+				t.Fatal(err)
+			}
+			id, err := login(t, idp, map[string]any{
+				"sub":                "user-1",
+				"preferred_username": "alice",
+				"email":              "alice@example.com",
+				"email_verified":     true,
+				"groups":             []string{"sre", "eng"},
+			})
+			if err != nil {
+				t.Fatalf("Finish: %v", err)
+			}
+			if id.Issuer != idp.URL || id.Subject != "user-1" || id.Username != "alice" || id.Email != "alice@example.com" {
+				t.Fatalf("identity = %+v", id)
+			}
+			if strings.Join(id.Groups, ",") != "sre,eng" {
+				t.Fatalf("groups = %v", id.Groups)
+			}
+		})
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	idp := newTestProvider(t)
+	authURL, state := begin(t)
+	callback, err := idp.Login(authURL, map[string]any{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A verifier that does not match the challenge sent to the provider,
+	// as an attacker replaying an intercepted code would present.
+	p := get()
+	p.mu.Lock()
+	p.pending[state].verifier = randomString()
+	p.mu.Unlock()
+
+	_, err = Finish(context.Background(), state, callback.Query().Get("code"))
+	wantError(t, err, "invalid_grant")
+}
+
+func TestStateMismatch(t *testing.T) {
+	idp := newTestProvider(t)
+	authURL, state := begin(t)
+	callback, err := idp.Login(authURL, map[string]any{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := callback.Query().Get("code")
+
+	if _, err := Finish(context.Background(), "forged-state", code); !errors.Is(err, ErrState) {
+		t.Fatalf("unknown state: err = %v, want ErrState", err)
+	}
+	if _, err := Finish(context.Background(), state, code); err != nil {
+		t.Fatalf("right state: %v", err)
+	}
+	if _, err := Finish(context.Background(), state, code); !errors.Is(err, ErrState) {
+		t.Fatalf("reused state: err = %v, want ErrState", err)
+	}
+}
+
+func TestStateExpires(t *testing.T) {
+	idp := newTestProvider(t)
+	authURL, state := begin(t)
+	callback, err := idp.Login(authURL, map[string]any{"sub": "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := get()
+	p.mu.Lock()
+	p.pending[state].expiresAt = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+
+	if _, err := Finish(context.Background(), state, callback.Query().Get("code")); !errors.Is(err, ErrState) {
+		t.Fatalf("expired state: err = %v, want ErrState", err)
+	}
+}
+
+func TestIDTokenChecks(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		claims map[string]any
+		err    string
+	}{
+		{"nonce mismatch", map[string]any{"nonce": "another-login"}, "nonce does not match"},
+		{"no nonce", map[string]any{"nonce": nil}, "nonce does not match"},
+		{"wrong issuer", map[string]any{"iss": "https://evil.example"}, "issuer"},
+		{"wrong audience", map[string]any{"aud": "another-client"}, "not intended for this client"},
+		{"audience list without client", map[string]any{"aud": []string{"a", "b"}}, "not intended for this client"},
+		{"azp of another client", map[string]any{"aud": []string{testClientID, "b"}, "azp": "b"}, "authorized party"},
+		{"expired", map[string]any{"exp": now.Add(-clockSkew - time.Minute).Unix()}, "expired"},
+		{"no expiry", map[string]any{"exp": nil}, "expired"},
+		{"issued in the future", map[string]any{"iat": now.Add(clockSkew + time.Minute).Unix()}, "future"},
+		{"no subject", map[string]any{"sub": nil}, "no sub claim"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := newTestProvider(t)
+			claims := map[string]any{"sub": "user-1"}
+			for k, v := range tc.claims {
+				claims[k] = v
+			}
+			_, err := login(t, idp, claims)
+			wantError(t, err, tc.err)
+		})
+	}
+
+	t.Run("within clock skew", func(t *testing.T) {
+		idp := newTestProvider(t)
+		_, err := login(t, idp, map[string]any{"sub": "user-1", "exp": now.Add(-clockSkew / 2).Unix()})
+		if err != nil {
+			t.Fatalf("Finish: %v", err)
+		}
+	})
+}
+
+func TestJWKSRotation(t *testing.T) {
+	idp := newTestProvider(t)
+	if _, err := login(t, idp, map[string]any{"sub": "user-1"}); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	if n := idp.JWKSFetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	// The cached keys serve later logins.
+	if _, err := login(t, idp, map[string]any{"sub": "user-1"}); err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if n := idp.JWKSFetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	// A new key is not fetched again right away, so a flood of tokens with
+	// made-up key IDs cannot hammer the provider.
+	if err := idp.RotateKey("ES256", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := login(t, idp, map[string]any{"sub": "user-1"})
+	wantError(t, err, "unknown signing key")
+
+	// Once the refresh delay has passed, the new key is fetched.
+	p := get()
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-jwksRefreshDelay)
+	p.keys.mu.Unlock()
+	if _, err := login(t, idp, map[string]any{"sub": "user-1"}); err != nil {
+		t.Fatalf("login after rotation: %v", err)
+	}
+	if n := idp.JWKSFetches(); n != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", n)
+	}
+}
+
+func TestJWKSRotationSameKeyID(t *testing.T) {
+	idp := newTestProvider(t)
+	if _, err := login(t, idp, map[string]any{"sub": "user-1"}); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	// Cache the old key under the new key's ID, as if the provider had
+	// replaced a key without changing its ID: the signature only verifies
+	// once the key set is fetched again.
+	if err := idp.RotateKey("RS256", false); err != nil {
+		t.Fatal(err)
+	}
+	p := get()
+	p.keys.mu.Lock()
+	for kid, k := range p.keys.keys {
+		delete(p.keys.keys, kid)
+		p.keys.keys["key-2"] = k
+	}
+	p.keys.fetchedAt = time.Now().Add(-jwksRefreshDelay)
+	p.keys.mu.Unlock()
+
+	if _, err := login(t, idp, map[string]any{"sub": "user-1"}); err != nil {
+		t.Fatalf("login after rotation: %v", err)
+	}
+}
+
+func TestIdentityUsername(t *testing.T) {
+	p := &provider{cfg: Config{UsernameClaim: "preferred_username", GroupsClaim: "groups"}}
+	for _, tc := range []struct {
+		name   string
+		claims map[string]any
+		want   string
+		email  string
+	}{
+		{"preferred username", map[string]any{"preferred_username": "alice", "email": "a@example.com", "email_verified": true}, "alice", "a@example.com"},
+		{"verified email", map[string]any{"email": "a@example.com", "email_verified": true}, "a@example.com", "a@example.com"},
+		{"unverified email", map[string]any{"email": "a@example.com", "email_verified": false}, "sub-1", ""},
+		{"email without verification", map[string]any{"email": "a@example.com"}, "sub-1", ""},
+		{"subject only", map[string]any{}, "sub-1", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.claims["iss"], tc.claims["sub"] = "https://idp.example", "sub-1"
+			id, err := p.identity(tc.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Username != tc.want || id.Email != tc.email || id.Subject != "sub-1" || id.Issuer != "https://idp.example" {
+				t.Fatalf("identity = %+v, want username %q and email %q", id, tc.want, tc.email)
+			}
+		})
+	}
+
+	p.cfg.UsernameClaim = "email"
+	id, err := p.identity(map[string]any{"sub": "sub-1", "email": "a@example.com"})
+	if err != nil || id.Username != "sub-1" {
+		t.Fatalf("unverified email as username claim: %+v, %v", id, err)
+	}
+}
+
+func TestIdentityGroups(t *testing.T) {
+	p := &provider{cfg: Config{UsernameClaim: "preferred_username", GroupsClaim: "roles"}}
+	id, err := p.identity(map[string]any{"sub": "s", "roles": []any{"a", "b", 3}})
+	if err != nil || strings.Join(id.Groups, ",") != "a,b" {
+		t.Fatalf("list claim: %+v, %v", id, err)
+	}
+	id, err = p.identity(map[string]any{"sub": "s", "roles": "a, b c"})
+	if err != nil || strings.Join(id.Groups, ",") != "a,b,c" {
+		t.Fatalf("string claim: %+v, %v", id, err)
+	}
+}
+
+func TestParseRoleMap(t *testing.T) {
+	m, err := ParseRoleMap(" platform=admin, sre = operator ,,")
+	if err != nil || len(m) != 2 || m["platform"] != "admin" || m["sre"] != "operator" {
+		t.Fatalf("ParseRoleMap = %v, %v", m, err)
+	}
+	for _, s := range []string{"platform", "=admin", "a=b,c"} {
+		if _, err := ParseRoleMap(s); err == nil {
+			t.Errorf("ParseRoleMap(%q) accepted", s)
+		}
+	}
+}
+
+func TestConfigFromEnvRoleMap(t *testing.T) {
+	t.Setenv("OIDC_ROLE_MAP", "platform=admin,broken")
+	if _, err := ConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "OIDC_ROLE_MAP") {
+		t.Fatalf("malformed OIDC_ROLE_MAP: err = %v", err)
+	}
+	t.Setenv("OIDC_ROLE_MAP", "platform=admin")
+	cfg, err := ConfigFromEnv()
+	if err != nil || cfg.RoleMap["platform"] != "admin" {
+		t.Fatalf("ConfigFromEnv = %+v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"copilot-go/handler"
+	"copilot-go/store"
+)
+
+// runReplay implements "copilot-go replay": it re-sends a captured request
+// through a running proxy, served by the chosen account, and writes the
+// response body to stdout.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	proxyPort := fs.Int("proxy-port", 4141, "Port of the running proxy server")
+	proxyBind := fs.String("proxy-bind", os.Getenv("PROXY_BIND"), "Address the running proxy listens on (default loopback)")
+	proxyTLS := fs.Bool("proxy-tls", proxyServesTLS(), "The running proxy serves HTTPS (default from the TLS_* environment)")
+	accountRef := fs.String("account", "", "Account ID or name to serve the replay")
+	dataDir := fs.String("data-dir", os.Getenv("COPILOT_GO_DATA_DIR"), "Data directory of the running server (default ~/.local/share/copilot-api)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: copilot-go replay -account <id|name> [-proxy-port 4141] <request-id>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *accountRef == "" {
+		fs.Usage()
+		return 2
+	}
+	if *dataDir != "" {
+		store.AppDir = *dataDir
+	}
+
+	capture, err := store.FindCapture(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load capture %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	account, err := findAccount(*accountRef)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	resp, err := handler.ReplayCapture(context.Background(), handler.LocalProxyURL(*proxyBind, *proxyPort, *proxyTLS), capture, account)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Replay failed: %v\n", err)
+		return 1
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	fmt.Fprintf(os.Stderr, "Replayed %s %s %s on account %s: %s (request ID %s)\n",
+		capture.ID, capture.Method, capture.Path, account.Name, resp.Status, resp.Header.Get("X-Request-Id"))
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read response: %v\n", err)
+		return 1
+	}
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
+
+func findAccount(ref string) (*store.Account, error) {
+	accounts, err := store.GetAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load accounts: %v", err)
+	}
+	for i := range accounts {
+		if accounts[i].ID == ref || accounts[i].Name == ref {
+			return &accounts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("account %q not found", ref)
+}
@@ -0,0 +1,22 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// restartSignal is nil: listener handoff is not supported on this platform.
+var restartSignal os.Signal
+
+func inheritedListeners() (map[string]net.Listener, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
+
+func handoff([]*server) error {
+	return errors.New("graceful restart is not supported on this platform")
+}
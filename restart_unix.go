@@ -0,0 +1,179 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment passed to a restarted process: the keys of the inherited
+// listeners, which start at fd 3 in order, and the fd to signal readiness on.
+const (
+	handoffListenersEnv = "COPILOT_HANDOFF_LISTENERS"
+	handoffReadyEnv     = "COPILOT_HANDOFF_READY_FD"
+)
+
+// handoffTimeout is how long the new process may take to start serving.
+const handoffTimeout = time.Minute
+
+// restartSignal triggers a graceful restart when enabled.
+var restartSignal os.Signal = syscall.SIGHUP
+
+// readyFile is the pipe to the process that handed over its listeners.
+var readyFile *os.File
+
+// inheritedListeners returns the listeners handed over by the previous
+// process, keyed as in boundListener, or nil on a normal start.
+func inheritedListeners() (map[string]net.Listener, error) {
+	keys := os.Getenv(handoffListenersEnv)
+	readyFD := os.Getenv(handoffReadyEnv)
+	_ = os.Unsetenv(handoffListenersEnv)
+	_ = os.Unsetenv(handoffReadyEnv)
+	if fd, err := strconv.Atoi(readyFD); err == nil {
+		readyFile = os.NewFile(uintptr(fd), "handoff-ready")
+	}
+	if keys == "" {
+		return nil, nil
+	}
+
+	inherited := make(map[string]net.Listener)
+	for i, key := range strings.Split(keys, "\n") {
+		f := os.NewFile(uintptr(3+i), key)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit listener %s: %w", key, err)
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			// The socket file is ours now; remove it when we close it.
+			ul.SetUnlinkOnClose(true)
+		}
+		inherited[key] = ln
+	}
+	return inherited, nil
+}
+
+// notifyReady tells the previous process that this one is serving, so it can
+// stop accepting and drain.
+func notifyReady() {
+	if readyFile == nil {
+		return
+	}
+	_, _ = readyFile.Write([]byte{1})
+	_ = readyFile.Close()
+	readyFile = nil
+}
+
+// handoff starts a new process from the same executable and arguments,
+// passes it the listeners and waits until it is serving. On success the
+// caller drains and exits; on failure it keeps serving.
+func handoff(servers []*server) error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, s := range servers {
+		for _, bl := range s.lns {
+			fl, ok := bl.Listener.(interface{ File() (*os.File, error) })
+			if !ok {
+				return fmt.Errorf("listener %s cannot be handed over", bl.key)
+			}
+			f, err := fl.File()
+			if err != nil {
+				return fmt.Errorf("listener %s: %w", bl.key, err)
+			}
+			keys = append(keys, bl.key)
+			files = append(files, f)
+		}
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ready.Close() }()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, handoffListenersEnv+"=") && !strings.HasPrefix(kv, handoffReadyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(env,
+		handoffListenersEnv+"="+strings.Join(keys, "\n"),
+		handoffReadyEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	_ = readyW.Close()
+	// Start puts the passed descriptors in blocking mode, which is shared
+	// with our listeners and would leave their Accept stuck on shutdown.
+	for _, s := range servers {
+		for _, bl := range s.lns {
+			setNonblock(bl.Listener)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Started new process, waiting for it to serve", "pid", cmd.Process.Pid)
+
+	// A read returns when the child signals or exits, closing the pipe.
+	signaled := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := ready.Read(b)
+		signaled <- n == 1
+	}()
+	select {
+	case ok := <-signaled:
+		if !ok {
+			_ = cmd.Wait()
+			return errors.New("new process exited before serving")
+		}
+	case <-time.After(handoffTimeout):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new process did not start serving within %s", handoffTimeout)
+	}
+
+	// The new process owns the sockets; closing ours must not remove them.
+	for _, s := range servers {
+		for _, bl := range s.lns {
+			if ul, ok := bl.Listener.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+	return nil
+}
+
+func setNonblock(ln net.Listener) {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return
+	}
+	if rc, err := sc.SyscallConn(); err == nil {
+		_ = rc.Control(func(fd uintptr) {
+			_ = syscall.SetNonblock(int(fd), true)
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-go/audit"
+	"copilot-go/handler"
+	"copilot-go/instance"
+	"copilot-go/tracing"
+)
+
+// flushTimeout bounds writing queued usage events, captures, audit entries
+// and spans on shutdown, after the drain.
+const flushTimeout = 10 * time.Second
+
+// server serves one listenSpec on its listeners.
+type server struct {
+	spec listenSpec
+	srv  *http.Server
+	lns  []boundListener
+}
+
+// startServers opens every spec's listeners, then serves them all. Listeners
+// in inherited are reused by key; those no longer configured are closed. A
+// listener that stops serving with an error reports it on errs, which should
+// shut the process down.
+func startServers(specs []listenSpec, opts socketOptions, inherited map[string]net.Listener, errs chan<- error) ([]*server, error) {
+	var servers []*server
+	for _, spec := range specs {
+		if spec.addr == "" && spec.socket == "" {
+			return nil, errors.New(spec.name + " has neither a port nor a socket to listen on")
+		}
+		lns, err := spec.listen(opts, inherited)
+		if err != nil {
+			return nil, errors.New(spec.name + " failed: " + err.Error())
+		}
+		servers = append(servers, &server{
+			spec: spec,
+			srv:  &http.Server{Handler: spec.handler, ConnContext: handler.UnixConnContext},
+			lns:  lns,
+		})
+	}
+	for key, ln := range inherited {
+		slog.Info("Closing inherited listener, it is no longer configured", "listener", key)
+		_ = ln.Close()
+	}
+
+	for _, s := range servers {
+		for _, bl := range s.lns {
+			var ln net.Listener = bl.Listener
+			if strings.HasPrefix(bl.key, "unix:") {
+				slog.Info(s.spec.name+" listening", "addr", "unix:"+ln.Addr().String())
+			} else {
+				slog.Info(s.spec.name+" listening", "addr", ln.Addr().String(), "scheme", scheme(s.spec.tls))
+				if s.spec.tls != nil {
+					ln = tls.NewListener(ln, s.spec.tls)
+				}
+			}
+			go func() {
+				if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error(s.spec.name+" failed", "addr", ln.Addr().String(), "err", err)
+					select {
+					case errs <- fmt.Errorf("%s on %s: %w", s.spec.name, ln.Addr(), err):
+					default: // shutdown is already under way
+					}
+				}
+			}()
+		}
+	}
+	return servers, nil
+}
+
+// shutdown stops accepting connections and waits up to timeout for in-flight
+// requests and streams to finish, closing whatever is left. It then stops
+// the instances and flushes the background writers.
+func shutdown(servers []*server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.srv.Shutdown(ctx); err != nil {
+				slog.Warn(s.spec.name+": requests still running, closing their connections", "timeout", timeout)
+				_ = s.srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	instance.StopAllInstances()
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+	instance.StopUsageHistory(flushCtx)
+	instance.StopCapture(flushCtx)
+	audit.Close(flushCtx)
+	tracing.Shutdown(flushCtx)
+}
@@ -18,23 +18,16 @@ type Account struct {
 	Enabled     bool   `json:"enabled"`
 	CreatedAt   string `json:"createdAt"`
 	Priority    int    `json:"priority"`
-}
-
-type PoolConfig struct {
-	Enabled      bool   `json:"enabled"`
-	Strategy     string `json:"strategy"`
-	ApiKey       string `json:"apiKey"`
-	RateLimitRPM int    `json:"rateLimitRPM,omitempty"` // Per-account rate limit (requests per minute), 0 = no limit
+	// AllowedIPs restricts the API key to these addresses and CIDR ranges;
+	// empty allows any address.
+	AllowedIPs []string `json:"allowedIPs,omitempty"`
 }
 
 type accountStore struct {
 	Accounts []Account `json:"accounts"`
 }
 
-var (
-	accountMu sync.RWMutex
-	poolMu    sync.RWMutex
-)
+var accountMu sync.RWMutex
 
 func readAccounts() ([]Account, error) {
 	data, err := os.ReadFile(AccountsFile())
@@ -161,6 +154,9 @@ func UpdateAccount(id string, updates map[string]interface{}) (*Account, error)
 			if v, ok := updates["enabled"].(bool); ok {
 				accounts[i].Enabled = v
 			}
+			if v, ok := updates["allowedIPs"]; ok {
+				accounts[i].AllowedIPs = toStringSlice(v)
+			}
 			if v, ok := updates["priority"]; ok {
 				switch pv := v.(type) {
 				case float64:
@@ -218,54 +214,39 @@ func RegenerateApiKey(id string) (string, error) {
 	return "", nil
 }
 
-func GetPoolConfig() (*PoolConfig, error) {
-	poolMu.RLock()
-	defer poolMu.RUnlock()
+// PutAccount replaces the account with a.ID, or adds it if there is none.
+// A missing ID, API key or creation time is generated.
+func PutAccount(a Account) (*Account, error) {
+	accountMu.Lock()
+	defer accountMu.Unlock()
 
-	data, err := os.ReadFile(PoolConfigFile())
+	accounts, err := readAccounts()
 	if err != nil {
-		return &PoolConfig{Strategy: "round-robin"}, nil
+		return nil, err
 	}
-	var cfg PoolConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return &PoolConfig{Strategy: "round-robin"}, nil
+	if a.ID == "" {
+		a.ID = uuid.New().String()
 	}
-	if cfg.Strategy == "" {
-		cfg.Strategy = "round-robin"
+	if a.ApiKey == "" {
+		a.ApiKey = "sk-" + uuid.New().String()
 	}
-	return &cfg, nil
-}
-
-func UpdatePoolConfig(cfg *PoolConfig) error {
-	poolMu.Lock()
-	defer poolMu.Unlock()
-
-	data, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return err
+	if a.CreatedAt == "" {
+		a.CreatedAt = time.Now().UTC().Format(time.RFC3339)
 	}
-	return os.WriteFile(PoolConfigFile(), data, 0644)
-}
-
-func RegeneratePoolApiKey() (string, error) {
-	poolMu.Lock()
-	defer poolMu.Unlock()
 
-	data, err := os.ReadFile(PoolConfigFile())
-	if err != nil {
-		return "", err
-	}
-	var cfg PoolConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return "", err
+	replaced := false
+	for i := range accounts {
+		if accounts[i].ID == a.ID {
+			accounts[i] = a
+			replaced = true
+			break
+		}
 	}
-	cfg.ApiKey = "sk-pool-" + uuid.New().String()
-	out, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return "", err
+	if !replaced {
+		accounts = append(accounts, a)
 	}
-	if err := os.WriteFile(PoolConfigFile(), out, 0644); err != nil {
-		return "", err
+	if err := writeAccounts(accounts); err != nil {
+		return nil, err
 	}
-	return cfg.ApiKey, nil
+	return &a, nil
 }
@@ -1,111 +1,34 @@
 package store
 
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"sync"
-	"time"
+import "sync"
 
-	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
-)
-
-type AdminData struct {
-	Username     string `json:"username"`
-	PasswordHash string `json:"passwordHash"`
-}
-
-type AdminSession struct {
-	Token     string
-	ExpiresAt time.Time
-}
-
-var (
-	adminMu    sync.RWMutex
-	sessionsMu sync.RWMutex
-	sessions   = make(map[string]*AdminSession)
-	sessionTTL = 7 * 24 * time.Hour
-)
+var adminMu sync.RWMutex
 
+// IsSetupRequired reports whether no console user exists yet.
 func IsSetupRequired() (bool, error) {
 	adminMu.RLock()
 	defer adminMu.RUnlock()
 
-	data, err := os.ReadFile(AdminFile())
+	users, err := readUsers()
 	if err != nil {
 		return true, nil
 	}
-	if len(data) == 0 || string(data) == "{}" {
-		return true, nil
-	}
-	var admin AdminData
-	if err := json.Unmarshal(data, &admin); err != nil {
-		return true, nil
-	}
-	return admin.PasswordHash == "", nil
+	return len(users) == 0, nil
 }
 
+// SetupAdmin creates the first console user with the admin role. It fails
+// with ErrSetupDone once any user exists.
 func SetupAdmin(username, password string) error {
-	adminMu.Lock()
-	defer adminMu.Unlock()
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-
-	admin := AdminData{Username: username, PasswordHash: string(hash)}
-	data, err := json.MarshalIndent(admin, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(AdminFile(), data, 0644)
+	_, err := addUser(username, password, RoleAdmin, true)
+	return err
 }
 
-func LoginAdmin(username, password string) (string, error) {
-	adminMu.RLock()
-	defer adminMu.RUnlock()
-
-	data, err := os.ReadFile(AdminFile())
+// LoginAdmin checks a console user's credentials and starts a session,
+// recording the client's IP and user agent.
+func LoginAdmin(username, password, ip, userAgent string) (string, error) {
+	user, err := VerifyPassword(username, password)
 	if err != nil {
 		return "", err
 	}
-	var admin AdminData
-	if err := json.Unmarshal(data, &admin); err != nil {
-		return "", err
-	}
-
-	if admin.Username != username {
-		return "", fmt.Errorf("invalid credentials")
-	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(admin.PasswordHash), []byte(password)); err != nil {
-		return "", err
-	}
-
-	token := uuid.New().String()
-	sessionsMu.Lock()
-	sessions[token] = &AdminSession{
-		Token:     token,
-		ExpiresAt: time.Now().Add(sessionTTL),
-	}
-	sessionsMu.Unlock()
-
-	return token, nil
-}
-
-func ValidateSession(token string) bool {
-	sessionsMu.RLock()
-	defer sessionsMu.RUnlock()
-
-	session, ok := sessions[token]
-	if !ok {
-		return false
-	}
-	if time.Now().After(session.ExpiresAt) {
-		delete(sessions, token)
-		return false
-	}
-	return true
+	return CreateSession(user, ip, userAgent)
 }
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records one console action. Entries are only ever appended to
+// AuditFile; there is no API to edit or delete them.
+type AuditEntry struct {
+	Seq       int64     `json:"seq"` // increases by one per entry, used as the pagination cursor
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Session   string    `json:"session,omitempty"` // see SessionID
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Action    string    `json:"action"`           // e.g. "account.regenerate_key"
+	Target    string    `json:"target,omitempty"` // e.g. "account:<id>"
+	// Changes holds the redacted top-level fields that differ between the
+	// target before and after the action.
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is the before/after value of one field. A nil side means the
+// field (or the whole target) did not exist.
+type AuditChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// AuditQuery selects audit entries. Empty fields match everything.
+type AuditQuery struct {
+	Before int64 // only entries with Seq < Before; 0 = from the newest
+	Limit  int   // default 50
+	Actor  string
+	Action string // exact action, or a prefix ending in "." such as "pool."
+	Target string
+	From   time.Time
+	To     time.Time
+}
+
+var (
+	auditMu  sync.Mutex
+	auditSeq int64 = -1 // last assigned Seq; -1 until read from AuditFile
+)
+
+func AuditFile() string {
+	return filepath.Join(AppDir, "audit.jsonl")
+}
+
+// AppendAudit assigns e the next Seq and appends it to AuditFile.
+func AppendAudit(e *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if auditSeq < 0 {
+		auditSeq = 0
+		err := readJSONLines(AuditFile(), func(prev AuditEntry) {
+			auditSeq = max(auditSeq, prev.Seq)
+		})
+		if err != nil {
+			auditSeq = -1
+			return err
+		}
+	}
+	e.Seq = auditSeq + 1
+	if err := appendJSONLines(AuditFile(), []AuditEntry{*e}); err != nil {
+		return err
+	}
+	auditSeq = e.Seq
+	return nil
+}
+
+func (q AuditQuery) matches(e *AuditEntry) bool {
+	if q.Before > 0 && e.Seq >= q.Before {
+		return false
+	}
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			if !strings.HasPrefix(e.Action, q.Action) {
+				return false
+			}
+		} else if e.Action != q.Action {
+			return false
+		}
+	}
+	if q.Target != "" && e.Target != q.Target {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// QueryAudit returns matching entries, newest first. next is the Before cursor
+// for the following page, or 0 when there are no more entries.
+func QueryAudit(q AuditQuery) (entries []AuditEntry, next int64, err error) {
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	// Keep one extra entry to know whether another page exists.
+	var window []AuditEntry
+	err = readJSONLines(AuditFile(), func(e AuditEntry) {
+		if !q.matches(&e) {
+			return
+		}
+		window = append(window, e)
+		if len(window) > q.Limit+1 {
+			window = window[1:]
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(window) > q.Limit {
+		window = window[1:]
+		next = window[0].Seq
+	}
+	entries = make([]AuditEntry, 0, len(window))
+	for i := len(window) - 1; i >= 0; i-- {
+		entries = append(entries, window[i])
+	}
+	return entries, next, nil
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captures are stored as capture-YYYY-MM-DD.jsonl under CaptureDir, one
+// Capture per line, UTC day.
+const capturePrefix = "capture-"
+
+// ErrCaptureNotFound is returned by FindCapture for unknown IDs.
+var ErrCaptureNotFound = errors.New("capture not found")
+
+// Capture is one proxied request and its response with secrets redacted.
+type Capture struct {
+	ID         string          `json:"id"` // the request ID echoed as X-Request-Id
+	Time       time.Time       `json:"time"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	AccountID  string          `json:"accountId,omitempty"`
+	PoolID     string          `json:"poolId,omitempty"`
+	ApiKey     string          `json:"apiKey,omitempty"` // masked, see MaskApiKey
+	Model      string          `json:"model,omitempty"`
+	Status     int             `json:"status"`
+	DurationMs int64           `json:"durationMs"`
+	ReplayOf   string          `json:"replayOf,omitempty"`
+	Request    CapturedMessage `json:"request"`
+	Response   CapturedMessage `json:"response"`
+	// Upstream lists the requests made to Copilot, including retries and hedges.
+	Upstream []UpstreamExchange `json:"upstream,omitempty"`
+}
+
+// UpstreamExchange is one request to Copilot made while serving a capture.
+type UpstreamExchange struct {
+	AccountID  string          `json:"accountId"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Status     int             `json:"status,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"durationMs"` // until response headers
+	Request    CapturedMessage `json:"request"`
+	Response   CapturedMessage `json:"response"`
+}
+
+// CapturedMessage is a captured request or response.
+type CapturedMessage struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body holds JSON payloads; Text holds anything else, such as SSE streams.
+	Body      json.RawMessage `json:"body,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+var captureMu sync.Mutex
+
+func CaptureDir() string {
+	return filepath.Join(AppDir, "captures")
+}
+
+// AppendCaptures appends captures to their day files.
+func AppendCaptures(captures []Capture) error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	if err := os.MkdirAll(CaptureDir(), 0755); err != nil {
+		return err
+	}
+	byFile := make(map[string][]Capture)
+	for _, c := range captures {
+		f := filepath.Join(CaptureDir(), capturePrefix+c.Time.UTC().Format(usageDayLayout)+".jsonl")
+		byFile[f] = append(byFile[f], c)
+	}
+	for path, cs := range byFile {
+		if err := appendJSONLines(path, cs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureFiles returns the capture day files, newest first.
+func captureFiles() ([]string, error) {
+	entries, err := os.ReadDir(CaptureDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), capturePrefix) && strings.HasSuffix(e.Name(), ".jsonl") {
+			files = append(files, filepath.Join(CaptureDir(), e.Name()))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+// scanCaptureFile reads lines without a length limit, since captures embed
+// whole request and response bodies.
+func scanCaptureFile(path string, fn func(Capture) bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var c Capture
+			if json.Unmarshal(line, &c) == nil && !fn(c) {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// FindCapture returns the most recent capture with the given request ID.
+func FindCapture(id string) (*Capture, error) {
+	captureMu.Lock()
+	files, err := captureFiles()
+	captureMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		var found *Capture
+		_, err := scanCaptureFile(path, func(c Capture) bool {
+			if c.ID == id {
+				found = &c // keep reading: a later line in the day is more recent
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+	return nil, ErrCaptureNotFound
+}
+
+// CaptureQuery selects captures for listing. Empty fields match everything.
+type CaptureQuery struct {
+	From      time.Time
+	To        time.Time
+	ApiKey    string // raw or masked key
+	AccountID string
+	PoolID    string
+	Model     string
+	Endpoint  string // request path, e.g. /v1/messages
+	// Status is an exact code ("429"), a class ("4xx", "5xx") or "error" (>= 400).
+	Status string
+	Limit  int
+}
+
+// CaptureSummary is the listing view of a capture, without bodies.
+type CaptureSummary struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	AccountID  string    `json:"accountId,omitempty"`
+	PoolID     string    `json:"poolId,omitempty"`
+	ApiKey     string    `json:"apiKey,omitempty"`
+	Model      string    `json:"model,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	ReplayOf   string    `json:"replayOf,omitempty"`
+	Attempts   int       `json:"attempts"`
+}
+
+// ValidCaptureStatus reports whether s is a valid CaptureQuery.Status.
+func ValidCaptureStatus(s string) bool {
+	switch strings.ToLower(s) {
+	case "", "error", "2xx", "3xx", "4xx", "5xx":
+		return true
+	}
+	code, err := strconv.Atoi(s)
+	return err == nil && code >= 100 && code <= 599
+}
+
+func (q CaptureQuery) matches(c *Capture) bool {
+	if !q.From.IsZero() && c.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !c.Time.Before(q.To) {
+		return false
+	}
+	if q.ApiKey != "" && c.ApiKey != q.ApiKey && c.ApiKey != MaskApiKey(q.ApiKey) {
+		return false
+	}
+	if q.AccountID != "" && c.AccountID != q.AccountID {
+		return false
+	}
+	if q.PoolID != "" && c.PoolID != q.PoolID {
+		return false
+	}
+	if q.Model != "" && c.Model != ToDisplayID(q.Model) {
+		return false
+	}
+	if q.Endpoint != "" && c.Path != q.Endpoint {
+		return false
+	}
+	switch status := strings.ToLower(q.Status); status {
+	case "":
+	case "error":
+		return c.Status >= 400
+	case "2xx", "3xx", "4xx", "5xx":
+		return c.Status/100 == int(status[0]-'0')
+	default:
+		return strconv.Itoa(c.Status) == status
+	}
+	return true
+}
+
+// QueryCaptures returns summaries of the captures matching q, newest first.
+func QueryCaptures(q CaptureQuery) ([]CaptureSummary, error) {
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	captureMu.Lock()
+	files, err := captureFiles()
+	captureMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []CaptureSummary{}
+	for _, path := range files {
+		day, err := time.Parse(usageDayLayout, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), capturePrefix), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		if !q.To.IsZero() && !day.Before(q.To) {
+			continue
+		}
+		if !q.From.IsZero() && day.AddDate(0, 0, 1).Before(q.From) {
+			break // files are newest first
+		}
+
+		var dayRows []CaptureSummary
+		_, err = scanCaptureFile(path, func(c Capture) bool {
+			if q.matches(&c) {
+				dayRows = append(dayRows, summarizeCapture(&c))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := len(dayRows) - 1; i >= 0 && len(out) < q.Limit; i-- {
+			out = append(out, dayRows[i])
+		}
+		if len(out) >= q.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func summarizeCapture(c *Capture) CaptureSummary {
+	return CaptureSummary{
+		ID:         c.ID,
+		Time:       c.Time,
+		Method:     c.Method,
+		Path:       c.Path,
+		AccountID:  c.AccountID,
+		PoolID:     c.PoolID,
+		ApiKey:     c.ApiKey,
+		Model:      c.Model,
+		Status:     c.Status,
+		DurationMs: c.DurationMs,
+		ReplayOf:   c.ReplayOf,
+		Attempts:   len(c.Upstream),
+	}
+}
+
+// PruneCaptures deletes capture day files older than retention.
+func PruneCaptures(retention time.Duration) error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+
+	files, err := captureFiles()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-retention).Truncate(24 * time.Hour)
+	for _, path := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), capturePrefix), ".jsonl")
+		day, err := time.Parse(usageDayLayout, name)
+		if err != nil || !day.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ClientCert maps a proxy client certificate to the credentials it stands in
+// for. The certificate is matched by SHA-256 fingerprint or by subject common
+// name, and authenticates as an API key or as a pool.
+type ClientCert struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint,omitempty"` // Lowercase hex SHA-256 of the DER certificate
+	CommonName  string `json:"commonName,omitempty"`
+	ApiKey      string `json:"apiKey,omitempty"` // Account or pool API key
+	PoolID      string `json:"poolId,omitempty"` // Pool, authenticated with its first API key
+	CreatedAt   string `json:"createdAt"`
+}
+
+type clientCertStore struct {
+	Certs []ClientCert `json:"certs"`
+}
+
+var (
+	ErrClientCertNotFound = errors.New("client certificate binding not found")
+	ErrClientCertExists   = errors.New("a binding for this certificate already exists")
+)
+
+var clientCertsMu sync.RWMutex
+
+func readClientCerts() (*clientCertStore, error) {
+	data, err := os.ReadFile(ClientCertsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &clientCertStore{}, nil
+		}
+		return nil, err
+	}
+	var s clientCertStore
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func writeClientCerts(s *clientCertStore) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ClientCertsFile(), data, 0644)
+}
+
+// NormalizeFingerprint lowercases a fingerprint and strips the colons that
+// openssl prints between bytes.
+func NormalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+func ListClientCerts() ([]ClientCert, error) {
+	clientCertsMu.RLock()
+	defer clientCertsMu.RUnlock()
+	s, err := readClientCerts()
+	if err != nil {
+		return nil, err
+	}
+	if s.Certs == nil {
+		return []ClientCert{}, nil
+	}
+	return s.Certs, nil
+}
+
+// AddClientCert stores a new binding. Exactly one of Fingerprint and
+// CommonName, and exactly one of ApiKey and PoolID, must be set.
+func AddClientCert(cert ClientCert) (*ClientCert, error) {
+	cert.Fingerprint = NormalizeFingerprint(cert.Fingerprint)
+	cert.CommonName = strings.TrimSpace(cert.CommonName)
+	if (cert.Fingerprint == "") == (cert.CommonName == "") {
+		return nil, errors.New("set either fingerprint or commonName")
+	}
+	if cert.Fingerprint != "" && len(cert.Fingerprint) != 64 {
+		return nil, errors.New("fingerprint must be a SHA-256 hash (64 hex digits)")
+	}
+	if (cert.ApiKey == "") == (cert.PoolID == "") {
+		return nil, errors.New("set either apiKey or poolId")
+	}
+
+	clientCertsMu.Lock()
+	defer clientCertsMu.Unlock()
+	s, err := readClientCerts()
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range s.Certs {
+		if (cert.Fingerprint != "" && existing.Fingerprint == cert.Fingerprint) ||
+			(cert.CommonName != "" && existing.CommonName == cert.CommonName) {
+			return nil, ErrClientCertExists
+		}
+	}
+	cert.ID = uuid.New().String()
+	cert.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	s.Certs = append(s.Certs, cert)
+	if err := writeClientCerts(s); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func DeleteClientCert(id string) (*ClientCert, error) {
+	clientCertsMu.Lock()
+	defer clientCertsMu.Unlock()
+	s, err := readClientCerts()
+	if err != nil {
+		return nil, err
+	}
+	for i, cert := range s.Certs {
+		if cert.ID == id {
+			s.Certs = append(s.Certs[:i], s.Certs[i+1:]...)
+			return &cert, writeClientCerts(s)
+		}
+	}
+	return nil, ErrClientCertNotFound
+}
+
+// MatchClientCert finds the binding for a verified client certificate. A
+// fingerprint binding takes precedence over a common name binding.
+func MatchClientCert(fingerprint, commonName string) *ClientCert {
+	clientCertsMu.RLock()
+	defer clientCertsMu.RUnlock()
+	s, err := readClientCerts()
+	if err != nil {
+		return nil
+	}
+	var byName *ClientCert
+	for i, cert := range s.Certs {
+		if cert.Fingerprint != "" && cert.Fingerprint == fingerprint {
+			return &s.Certs[i]
+		}
+		if byName == nil && cert.CommonName != "" && cert.CommonName == commonName {
+			byName = &s.Certs[i]
+		}
+	}
+	return byName
+}
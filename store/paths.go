@@ -19,10 +19,15 @@ func AccountsFile() string {
 	return filepath.Join(AppDir, "accounts.json")
 }
 
+// PoolConfigFile is the legacy single-pool config, migrated into PoolsFile on startup.
 func PoolConfigFile() string {
 	return filepath.Join(AppDir, "pool-config.json")
 }
 
+func PoolsFile() string {
+	return filepath.Join(AppDir, "pools.json")
+}
+
 func AdminFile() string {
 	return filepath.Join(AppDir, "admin.json")
 }
@@ -31,6 +36,19 @@ func ModelMapFile() string {
 	return filepath.Join(AppDir, "model_map.json")
 }
 
+func SecurityFile() string {
+	return filepath.Join(AppDir, "security.json")
+}
+
+func ClientCertsFile() string {
+	return filepath.Join(AppDir, "client_certs.json")
+}
+
+// TLSDir holds the self-signed certificate generated on first run.
+func TLSDir() string {
+	return filepath.Join(AppDir, "tls")
+}
+
 func ProxyConfigFile() string {
 	return filepath.Join(AppDir, "proxy-config.json")
 }
@@ -39,7 +57,7 @@ func EnsurePaths() error {
 	if err := os.MkdirAll(AppDir, 0755); err != nil {
 		return err
 	}
-	files := []string{AccountsFile(), PoolConfigFile(), AdminFile(), ModelMapFile(), ProxyConfigFile()}
+	files := []string{AccountsFile(), PoolsFile(), AdminFile(), ModelMapFile(), ProxyConfigFile()}
 	for _, f := range files {
 		if _, err := os.Stat(f); os.IsNotExist(err) {
 			if err := os.WriteFile(f, []byte("{}"), 0644); err != nil {
@@ -47,5 +65,8 @@ func EnsurePaths() error {
 			}
 		}
 	}
-	return nil
+	if err := migrateLegacyAdmin(); err != nil {
+		return err
+	}
+	return migrateLegacyPool()
 }
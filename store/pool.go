@@ -0,0 +1,512 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultPoolID is the pool migrated from the legacy single pool-config.json.
+// It cannot be deleted and backs the legacy /api/pool endpoints.
+const DefaultPoolID = "default"
+
+// Mid-stream failover modes for a pool's streaming responses.
+const (
+	StreamFailoverOff = ""
+	// StreamFailoverRetry replays the request on another account if the stream
+	// breaks before any content reached the client.
+	StreamFailoverRetry = "retry"
+	// StreamFailoverContinue additionally resumes a text stream that broke
+	// midway by re-requesting with the partial output as an assistant prefill.
+	StreamFailoverContinue = "continue"
+)
+
+// Strategies are the account selection strategies a pool can use.
+var Strategies = []string{"round-robin", "priority", "least-used", "smart", "quota-aware", "weighted", "latency", "sticky"}
+
+// ValidStrategy reports whether s is a known strategy or empty (round-robin).
+func ValidStrategy(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, known := range Strategies {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// HedgePolicy enables hedged requests for one pool API key: if no response
+// arrives within ThresholdMs, the request is also sent to a second account.
+type HedgePolicy struct {
+	ThresholdMs  int `json:"thresholdMs"`
+	MaxPerMinute int `json:"maxPerMinute,omitempty"` // Cap on hedges per minute, 0 = default (10)
+}
+
+// Pool is a named group of accounts served behind its own API keys.
+type Pool struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Enabled      bool     `json:"enabled"`
+	Strategy     string   `json:"strategy"`
+	ApiKeys      []string `json:"apiKeys"`
+	Members      []string `json:"members,omitempty"`      // Account IDs; empty = all enabled accounts
+	Models       []string `json:"models,omitempty"`       // Allowed model IDs (display or Copilot); empty = all
+	RateLimitRPM int      `json:"rateLimitRPM,omitempty"` // Per-account rate limit (requests per minute), 0 = no limit
+	// Sticky pins each conversation to one account so upstream prompt caching
+	// keeps working. The "sticky" strategy implies it.
+	Sticky           bool   `json:"sticky,omitempty"`
+	StickyTTLMinutes int    `json:"stickyTTLMinutes,omitempty"` // Idle time before a pinned session expires, 0 = default (30)
+	StreamFailover   string `json:"streamFailover,omitempty"`   // "", "retry" or "continue"
+	// Hedging holds hedge policies keyed by API key; keys without one are not hedged.
+	Hedging map[string]HedgePolicy `json:"hedging,omitempty"`
+	// AllowedIPs restricts API keys to addresses and CIDR ranges, keyed by
+	// API key; keys without an entry are allowed from any address.
+	AllowedIPs map[string][]string `json:"allowedIPs,omitempty"`
+	CreatedAt  string              `json:"createdAt"`
+}
+
+// legacyPoolConfig is the format of pool-config.json before named pools.
+type legacyPoolConfig struct {
+	Enabled          bool   `json:"enabled"`
+	Strategy         string `json:"strategy"`
+	ApiKey           string `json:"apiKey"`
+	RateLimitRPM     int    `json:"rateLimitRPM,omitempty"`
+	Sticky           bool   `json:"sticky,omitempty"`
+	StickyTTLMinutes int    `json:"stickyTTLMinutes,omitempty"`
+}
+
+type poolStore struct {
+	Pools []Pool `json:"pools"`
+}
+
+var poolMu sync.RWMutex
+
+// HasMember reports whether the pool serves the given account.
+func (p *Pool) HasMember(accountID string) bool {
+	if len(p.Members) == 0 {
+		return true
+	}
+	for _, id := range p.Members {
+		if id == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the pool's allowlist admits the model, given as
+// the client-facing display ID and the resolved Copilot ID.
+func (p *Pool) AllowsModel(displayID, copilotID string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+	for _, m := range p.Models {
+		if m == displayID || m == copilotID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasApiKey reports whether key is one of the pool's API keys.
+func (p *Pool) HasApiKey(key string) bool {
+	for _, k := range p.ApiKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// HedgePolicyFor returns the hedge policy of an API key, or nil if it has none.
+func (p *Pool) HedgePolicyFor(key string) *HedgePolicy {
+	policy, ok := p.Hedging[key]
+	if !ok || policy.ThresholdMs <= 0 {
+		return nil
+	}
+	return &policy
+}
+
+// AllowedIPsFor returns the address restrictions of an API key, or nil if it
+// has none.
+func (p *Pool) AllowedIPsFor(key string) []string {
+	return p.AllowedIPs[key]
+}
+
+func newPoolApiKey() string {
+	return "sk-pool-" + uuid.New().String()
+}
+
+func readPools() ([]Pool, error) {
+	data, err := os.ReadFile(PoolsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Pool{}, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 || string(data) == "{}" {
+		return []Pool{}, nil
+	}
+	var s poolStore
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse pools: %w", err)
+	}
+	return s.Pools, nil
+}
+
+func writePools(pools []Pool) error {
+	data, err := json.MarshalIndent(poolStore{Pools: pools}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(PoolsFile(), data, 0644)
+}
+
+// migrateLegacyPool creates the default pool from pool-config.json when no
+// pools exist yet.
+func migrateLegacyPool() error {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil || len(pools) > 0 {
+		return err
+	}
+
+	var legacy legacyPoolConfig
+	if data, err := os.ReadFile(PoolConfigFile()); err == nil {
+		_ = json.Unmarshal(data, &legacy)
+	}
+
+	def := Pool{
+		ID:               DefaultPoolID,
+		Name:             "Default",
+		Enabled:          legacy.Enabled,
+		Strategy:         legacy.Strategy,
+		ApiKeys:          []string{},
+		RateLimitRPM:     legacy.RateLimitRPM,
+		Sticky:           legacy.Sticky,
+		StickyTTLMinutes: legacy.StickyTTLMinutes,
+		CreatedAt:        time.Now().UTC().Format(time.RFC3339),
+	}
+	if def.Strategy == "" {
+		def.Strategy = "round-robin"
+	}
+	if legacy.ApiKey != "" {
+		def.ApiKeys = append(def.ApiKeys, legacy.ApiKey)
+	}
+	return writePools([]Pool{def})
+}
+
+func GetPools() ([]Pool, error) {
+	poolMu.RLock()
+	defer poolMu.RUnlock()
+	return readPools()
+}
+
+func GetPool(id string) (*Pool, error) {
+	pools, err := GetPools()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		if p.ID == id {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetPoolByApiKey returns the pool owning apiKey, or nil if none does.
+func GetPoolByApiKey(apiKey string) (*Pool, error) {
+	pools, err := GetPools()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		if p.HasApiKey(apiKey) {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func CreatePool(p Pool) (*Pool, error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ID == "" {
+		p.ID = uuid.New().String()
+	}
+	for _, existing := range pools {
+		if existing.ID == p.ID {
+			return nil, fmt.Errorf("pool %s already exists", p.ID)
+		}
+	}
+	if p.Strategy == "" {
+		p.Strategy = "round-robin"
+	}
+	p.ApiKeys = []string{newPoolApiKey()}
+	p.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	pools = append(pools, p)
+	if err := writePools(pools); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func UpdatePool(id string, updates map[string]interface{}) (*Pool, error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range pools {
+		if p.ID != id {
+			continue
+		}
+		if v, ok := updates["name"].(string); ok && v != "" {
+			pools[i].Name = v
+		}
+		if v, ok := updates["enabled"].(bool); ok {
+			pools[i].Enabled = v
+		}
+		if v, ok := updates["strategy"].(string); ok && v != "" {
+			pools[i].Strategy = v
+		}
+		if v, ok := updates["members"]; ok {
+			pools[i].Members = toStringSlice(v)
+		}
+		if v, ok := updates["models"]; ok {
+			pools[i].Models = toStringSlice(v)
+		}
+		if v, ok := updates["rateLimitRPM"]; ok {
+			switch rv := v.(type) {
+			case float64:
+				pools[i].RateLimitRPM = int(rv)
+			case int:
+				pools[i].RateLimitRPM = rv
+			}
+		}
+		if v, ok := updates["sticky"].(bool); ok {
+			pools[i].Sticky = v
+		}
+		if v, ok := updates["streamFailover"].(string); ok {
+			pools[i].StreamFailover = v
+		}
+		if v, ok := updates["stickyTTLMinutes"]; ok {
+			switch tv := v.(type) {
+			case float64:
+				pools[i].StickyTTLMinutes = int(tv)
+			case int:
+				pools[i].StickyTTLMinutes = tv
+			}
+		}
+
+		// Generate a key if the pool is being enabled and has no key yet
+		if pools[i].Enabled && len(pools[i].ApiKeys) == 0 {
+			pools[i].ApiKeys = []string{newPoolApiKey()}
+		}
+
+		if err := writePools(pools); err != nil {
+			return nil, err
+		}
+		return &pools[i], nil
+	}
+	return nil, nil
+}
+
+func DeletePool(id string) error {
+	if id == DefaultPoolID {
+		return fmt.Errorf("the default pool cannot be deleted")
+	}
+
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil {
+		return err
+	}
+
+	var filtered []Pool
+	for _, p := range pools {
+		if p.ID != id {
+			filtered = append(filtered, p)
+		}
+	}
+	return writePools(filtered)
+}
+
+// PutPool replaces the pool with p.ID, or adds it if there is none. A missing
+// strategy, API key or creation time is filled in.
+func PutPool(p Pool) (*Pool, error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil {
+		return nil, err
+	}
+	if p.Strategy == "" {
+		p.Strategy = "round-robin"
+	}
+	if len(p.ApiKeys) == 0 {
+		p.ApiKeys = []string{newPoolApiKey()}
+	}
+	if p.CreatedAt == "" {
+		p.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	replaced := false
+	for i := range pools {
+		if pools[i].ID == p.ID {
+			pools[i] = p
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		pools = append(pools, p)
+	}
+	if err := writePools(pools); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// mutatePool applies fn to the pool with the given ID and persists the result.
+// Returns nil if the pool does not exist.
+func mutatePool(id string, fn func(p *Pool)) (*Pool, error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+
+	pools, err := readPools()
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		if pools[i].ID == id {
+			fn(&pools[i])
+			if err := writePools(pools); err != nil {
+				return nil, err
+			}
+			return &pools[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// AddPoolApiKey issues an additional API key for the pool.
+func AddPoolApiKey(id string) (string, error) {
+	key := newPoolApiKey()
+	p, err := mutatePool(id, func(p *Pool) { p.ApiKeys = append(p.ApiKeys, key) })
+	if err != nil || p == nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// RevokePoolApiKey removes one API key from the pool.
+func RevokePoolApiKey(id, key string) (*Pool, error) {
+	return mutatePool(id, func(p *Pool) {
+		keys := make([]string, 0, len(p.ApiKeys))
+		for _, k := range p.ApiKeys {
+			if k != key {
+				keys = append(keys, k)
+			}
+		}
+		p.ApiKeys = keys
+		delete(p.Hedging, key)
+		delete(p.AllowedIPs, key)
+	})
+}
+
+// RegeneratePoolApiKeys replaces all of the pool's API keys with a single new one.
+// Hedge policies and address restrictions belong to the old keys and are
+// dropped.
+func RegeneratePoolApiKeys(id string) (*Pool, error) {
+	return mutatePool(id, func(p *Pool) {
+		p.ApiKeys = []string{newPoolApiKey()}
+		p.Hedging = nil
+		p.AllowedIPs = nil
+	})
+}
+
+// SetPoolKeyHedging sets or, with a nil policy, removes the hedge policy of one
+// of the pool's API keys.
+func SetPoolKeyHedging(id, key string, policy *HedgePolicy) (*Pool, error) {
+	var keyErr error
+	p, err := mutatePool(id, func(p *Pool) {
+		if !p.HasApiKey(key) {
+			keyErr = fmt.Errorf("API key not found in pool")
+			return
+		}
+		if policy == nil {
+			delete(p.Hedging, key)
+			return
+		}
+		if p.Hedging == nil {
+			p.Hedging = make(map[string]HedgePolicy)
+		}
+		p.Hedging[key] = *policy
+	})
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return p, err
+}
+
+// SetPoolKeyAllowedIPs restricts one of the pool's API keys to the given
+// addresses and CIDR ranges, or with none lifts the restriction.
+func SetPoolKeyAllowedIPs(id, key string, allowed []string) (*Pool, error) {
+	var keyErr error
+	p, err := mutatePool(id, func(p *Pool) {
+		if !p.HasApiKey(key) {
+			keyErr = fmt.Errorf("API key not found in pool")
+			return
+		}
+		if len(allowed) == 0 {
+			delete(p.AllowedIPs, key)
+			return
+		}
+		if p.AllowedIPs == nil {
+			p.AllowedIPs = make(map[string][]string)
+		}
+		p.AllowedIPs[key] = allowed
+	})
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	return p, err
+}
+
+func toStringSlice(v interface{}) []string {
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]string, 0, len(raw))
+	for _, item := range raw {
+		if s, ok := item.(string); ok && s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// SecuritySettings are console-wide authentication policies set by admins.
+type SecuritySettings struct {
+	// Require2FA makes users without TOTP enroll before they can use anything
+	// but the enrollment endpoints.
+	Require2FA bool `json:"require2FA"`
+}
+
+var securityMu sync.RWMutex
+
+func GetSecuritySettings() (SecuritySettings, error) {
+	securityMu.RLock()
+	defer securityMu.RUnlock()
+
+	data, err := os.ReadFile(SecurityFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return SecuritySettings{}, nil
+		}
+		return SecuritySettings{}, err
+	}
+	var s SecuritySettings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return SecuritySettings{}, err
+	}
+	return s, nil
+}
+
+func UpdateSecuritySettings(s SecuritySettings) error {
+	securityMu.Lock()
+	defer securityMu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SecurityFile(), data, 0644)
+}
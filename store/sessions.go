@@ -0,0 +1,265 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sessionTTL         = 7 * 24 * time.Hour  // idle time before a session expires
+	SessionMaxLifetime = 30 * 24 * time.Hour // expiry no longer slides past this
+	// sessionTouchInterval limits how often sliding expiry is written to disk.
+	sessionTouchInterval = time.Minute
+)
+
+// AdminSession is a console session. Only a hash of its token is kept, in
+// memory and in SessionsFile, so sessions survive restarts.
+type AdminSession struct {
+	ID         string    `json:"id"` // see SessionID
+	TokenHash  string    `json:"tokenHash"`
+	Username   string    `json:"username"`
+	Role       string    `json:"role"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type sessionStore struct {
+	Sessions []AdminSession `json:"sessions"`
+}
+
+var (
+	sessionsMu     sync.Mutex
+	sessions       map[string]*AdminSession // keyed by token hash; nil until loaded
+	sessionsSynced time.Time                // last write of SessionsFile
+)
+
+func SessionsFile() string {
+	return filepath.Join(AppDir, "sessions.json")
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SessionID identifies a session in logs and the audit trail without
+// revealing its token.
+func SessionID(token string) string {
+	return hashSessionToken(token)[:12]
+}
+
+// CSRFToken derives the CSRF token that cookie-authenticated requests must
+// echo in a header. It is bound to the session token, so nothing extra is
+// stored.
+func CSRFToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// loadSessionsLocked reads SessionsFile on first use, dropping expired sessions.
+func loadSessionsLocked() {
+	if sessions != nil {
+		return
+	}
+	sessions = make(map[string]*AdminSession)
+	data, err := os.ReadFile(SessionsFile())
+	if err != nil {
+		return
+	}
+	var s sessionStore
+	if err := json.Unmarshal(data, &s); err != nil {
+		slog.Warn("ignoring unreadable sessions file", "file", SessionsFile(), "err", err)
+		return
+	}
+	now := time.Now()
+	for i := range s.Sessions {
+		if now.Before(s.Sessions[i].ExpiresAt) {
+			sessions[s.Sessions[i].TokenHash] = &s.Sessions[i]
+		}
+	}
+}
+
+// saveSessionsLocked writes all live sessions to SessionsFile.
+func saveSessionsLocked() {
+	now := time.Now()
+	list := make([]AdminSession, 0, len(sessions))
+	for hash, s := range sessions {
+		if !now.Before(s.ExpiresAt) {
+			delete(sessions, hash)
+			continue
+		}
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(sessionStore{Sessions: list}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(SessionsFile(), data, 0644)
+	}
+	if err != nil {
+		slog.Warn("failed to persist sessions", "err", err)
+		return
+	}
+	sessionsSynced = now
+}
+
+// newSessionToken returns a random 256-bit session token.
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateSession starts a session for user and returns its token.
+func CreateSession(user *UserInfo, ip, userAgent string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+	hash := hashSessionToken(token)
+	sessions[hash] = &AdminSession{
+		ID:         SessionID(token),
+		TokenHash:  hash,
+		Username:   user.Username,
+		Role:       user.Role,
+		IP:         ip,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL),
+	}
+	saveSessionsLocked()
+	return token, nil
+}
+
+// LookupSession returns a copy of the session for token, or nil if it is
+// unknown or expired. A valid session's expiry slides forward by sessionTTL,
+// up to SessionMaxLifetime after it was created.
+func LookupSession(token string) *AdminSession {
+	if token == "" {
+		return nil
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+
+	hash := hashSessionToken(token)
+	s, ok := sessions[hash]
+	if !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	if !now.Before(s.ExpiresAt) {
+		delete(sessions, hash)
+		saveSessionsLocked()
+		return nil
+	}
+	s.LastSeenAt = now
+	s.ExpiresAt = now.Add(sessionTTL)
+	if limit := s.CreatedAt.Add(SessionMaxLifetime); s.ExpiresAt.After(limit) {
+		s.ExpiresAt = limit
+	}
+	if now.Sub(sessionsSynced) >= sessionTouchInterval {
+		saveSessionsLocked()
+	}
+	out := *s
+	return &out
+}
+
+// ValidateSession reports whether token belongs to a live session.
+func ValidateSession(token string) bool {
+	return LookupSession(token) != nil
+}
+
+// ListSessions returns live sessions, oldest first. An empty username lists
+// every user's sessions.
+func ListSessions(username string) []AdminSession {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+
+	now := time.Now()
+	var out []AdminSession
+	for _, s := range sessions {
+		if now.Before(s.ExpiresAt) && (username == "" || s.Username == username) {
+			out = append(out, *s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// RevokeSession ends the session with the given ID. With a non-empty
+// username, only that user's session can be revoked. It reports whether a
+// session was found.
+func RevokeSession(id, username string) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+
+	for hash, s := range sessions {
+		if s.ID == id && (username == "" || s.Username == username) {
+			delete(sessions, hash)
+			saveSessionsLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// RevokeToken ends the session for token, as on logout.
+func RevokeToken(token string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+
+	hash := hashSessionToken(token)
+	if _, ok := sessions[hash]; ok {
+		delete(sessions, hash)
+		saveSessionsLocked()
+	}
+}
+
+// RevokeUserSessions ends every session of username except keepToken and
+// returns how many were ended.
+func RevokeUserSessions(username, keepToken string) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	loadSessionsLocked()
+
+	keep := ""
+	if keepToken != "" {
+		keep = hashSessionToken(keepToken)
+	}
+	n := 0
+	for hash, s := range sessions {
+		if s.Username == username && hash != keep {
+			delete(sessions, hash)
+			n++
+		}
+	}
+	if n > 0 {
+		saveSessionsLocked()
+	}
+	return n
+}
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"copilot-go/totp"
+)
+
+const (
+	recoveryCodeCount = 10
+
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeAttempts = 5
+)
+
+var (
+	ErrTOTPEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotEnrolled = errors.New("no two-factor enrollment in progress")
+	ErrInvalidCode     = errors.New("invalid two-factor code")
+	ErrChallenge       = errors.New("login challenge expired or not found")
+)
+
+// BeginTOTPEnrollment generates a new secret for username that becomes
+// active once ConfirmTOTPEnrollment sees a valid code for it.
+func BeginTOTPEnrollment(username string) (string, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = mutateUser(username, func(u *User) error {
+		if u.TOTPSecret != "" {
+			return ErrTOTPEnabled
+		}
+		u.TOTPPending = secret
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// ConfirmTOTPEnrollment enables 2FA if code matches the pending secret and
+// returns a fresh set of recovery codes, shown to the user only once.
+func ConfirmTOTPEnrollment(username, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = mutateUser(username, func(u *User) error {
+		if u.TOTPSecret != "" {
+			return ErrTOTPEnabled
+		}
+		if u.TOTPPending == "" {
+			return ErrTOTPNotEnrolled
+		}
+		counter, ok := totp.Validate(u.TOTPPending, code, totp.Now())
+		if !ok {
+			return ErrInvalidCode
+		}
+		u.TOTPSecret, u.TOTPPending = u.TOTPPending, ""
+		u.TOTPLastCounter = counter
+		u.RecoveryCodes = hashes
+		u.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor accepts a current TOTP code or an unused recovery code,
+// which is then spent. A TOTP code is accepted only once.
+func VerifySecondFactor(username, code string) (usedRecovery bool, err error) {
+	_, err = mutateUser(username, func(u *User) error {
+		if u.TOTPSecret == "" {
+			return ErrTOTPNotEnabled
+		}
+		if _, ok := totp.Validate(u.TOTPSecret, code, totp.Now()); ok {
+			return useTOTPCode(u, code)
+		}
+		hash := hashRecoveryCode(code)
+		for i, h := range u.RecoveryCodes {
+			if h == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				usedRecovery = true
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	})
+	return usedRecovery, err
+}
+
+// useTOTPCode accepts a current TOTP code for u that has not been used yet.
+func useTOTPCode(u *User, code string) error {
+	counter, ok := totp.Validate(u.TOTPSecret, code, totp.Now())
+	if !ok || counter <= u.TOTPLastCounter {
+		return ErrInvalidCode
+	}
+	u.TOTPLastCounter = counter
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces username's recovery codes after checking a
+// current TOTP code. A recovery code is not accepted here.
+func RegenerateRecoveryCodes(username, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	_, err = mutateUser(username, func(u *User) error {
+		if u.TOTPSecret == "" {
+			return ErrTOTPNotEnabled
+		}
+		if err := useTOTPCode(u, code); err != nil {
+			return err
+		}
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes username's 2FA secret, pending enrollment and
+// recovery codes.
+func DisableTOTP(username string) error {
+	_, err := mutateUser(username, func(u *User) error {
+		u.TOTPSecret, u.TOTPPending = "", ""
+		u.TOTPLastCounter = 0
+		u.RecoveryCodes = nil
+		u.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+	return err
+}
+
+// RecoveryCodesLeft returns how many unused recovery codes username has.
+func RecoveryCodesLeft(username string) int {
+	adminMu.RLock()
+	defer adminMu.RUnlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return 0
+	}
+	if i := findUser(users, username); i >= 0 {
+		return len(users[i].RecoveryCodes)
+	}
+	return 0
+}
+
+// newRecoveryCodes returns codes formatted like "abcd-efgh" and their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))
+		code := s[:4] + "-" + s[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes case and separators before hashing, so codes
+// can be typed loosely.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginChallenge is a password-verified login waiting for its second factor.
+type loginChallenge struct {
+	username  string
+	cookie    bool
+	attempts  int
+	expiresAt time.Time
+}
+
+var (
+	challengeMu sync.Mutex
+	challenges  = make(map[string]*loginChallenge)
+)
+
+// NewLoginChallenge records that username passed the password step and
+// returns the ID to present with the second factor. cookie carries the
+// client's choice of session cookie through to the second step.
+func NewLoginChallenge(username string, cookie bool) (string, error) {
+	id, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := totp.Now()
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	for k, ch := range challenges {
+		if now.After(ch.expiresAt) {
+			delete(challenges, k)
+		}
+	}
+	challenges[id] = &loginChallenge{username: username, cookie: cookie, expiresAt: now.Add(loginChallengeTTL)}
+	return id, nil
+}
+
+// LoginChallengeUser returns the username of a pending challenge, or "" if
+// the challenge is unknown or expired.
+func LoginChallengeUser(id string) string {
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	ch, ok := challenges[id]
+	if !ok || totp.Now().After(ch.expiresAt) {
+		return ""
+	}
+	return ch.username
+}
+
+// CompleteLoginChallenge checks the second factor for a challenge. The
+// challenge is consumed on success and after too many wrong codes.
+func CompleteLoginChallenge(id, code string) (username string, cookie bool, err error) {
+	challengeMu.Lock()
+	ch, ok := challenges[id]
+	if !ok || totp.Now().After(ch.expiresAt) {
+		delete(challenges, id)
+		challengeMu.Unlock()
+		return "", false, ErrChallenge
+	}
+	challengeMu.Unlock()
+
+	_, err = VerifySecondFactor(ch.username, code)
+
+	challengeMu.Lock()
+	defer challengeMu.Unlock()
+	if err != nil {
+		ch.attempts++
+		if ch.attempts >= loginChallengeAttempts {
+			delete(challenges, id)
+		}
+		return ch.username, false, err
+	}
+	delete(challenges, id)
+	return ch.username, ch.cookie, nil
+}
@@ -0,0 +1,251 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"copilot-go/totp"
+)
+
+// clock is the time totp.Now returns during a test.
+type clock struct{ now time.Time }
+
+func (c *clock) add(d time.Duration) { c.now = c.now.Add(d) }
+
+// code returns the TOTP code for secret at the clock's time plus offset.
+func (c *clock) code(t *testing.T, secret string, offset time.Duration) string {
+	t.Helper()
+	code, err := totp.Code(secret, c.now.Add(offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// setupTwoFactor points the store at a temporary data directory, pins the
+// clock and creates user "alice" with 2FA enabled. It returns the secret and
+// recovery codes.
+func setupTwoFactor(t *testing.T) (*clock, string, []string) {
+	t.Helper()
+	oldDir, oldNow := AppDir, totp.Now
+	AppDir = t.TempDir()
+	clk := &clock{now: time.Unix(1_700_000_000, 0)}
+	totp.Now = func() time.Time { return clk.now }
+	t.Cleanup(func() {
+		AppDir, totp.Now = oldDir, oldNow
+		challengeMu.Lock()
+		clear(challenges)
+		challengeMu.Unlock()
+	})
+
+	if _, err := CreateUser("alice", "correct horse", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := BeginTOTPEnrollment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := ConfirmTOTPEnrollment("alice", clk.code(t, secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recovery), recoveryCodeCount)
+	}
+	// Move past the step used to confirm, which is now spent.
+	clk.add(totp.Period)
+	return clk, secret, recovery
+}
+
+func TestConfirmTOTPEnrollment(t *testing.T) {
+	oldDir, oldNow := AppDir, totp.Now
+	AppDir = t.TempDir()
+	at := time.Unix(1_700_000_000, 0)
+	totp.Now = func() time.Time { return at }
+	defer func() { AppDir, totp.Now = oldDir, oldNow }()
+
+	if _, err := CreateUser("bob", "correct horse", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConfirmTOTPEnrollment("bob", "123456"); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("confirm without enrollment: err = %v, want ErrTOTPNotEnrolled", err)
+	}
+	secret, err := BeginTOTPEnrollment("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, _ := totp.Code(secret, at.Add(5*totp.Period))
+	if _, err := ConfirmTOTPEnrollment("bob", wrong); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("confirm with a wrong code: err = %v, want ErrInvalidCode", err)
+	}
+	if u, _ := GetUser("bob"); u.TwoFactor {
+		t.Fatal("2FA enabled by a wrong code")
+	}
+	code, _ := totp.Code(secret, at)
+	if _, err := ConfirmTOTPEnrollment("bob", code); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	if u, _ := GetUser("bob"); !u.TwoFactor {
+		t.Fatal("2FA not enabled after confirming")
+	}
+	if _, err := BeginTOTPEnrollment("bob"); !errors.Is(err, ErrTOTPEnabled) {
+		t.Fatalf("second enrollment: err = %v, want ErrTOTPEnabled", err)
+	}
+}
+
+func TestVerifySecondFactorWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		offset time.Duration
+		ok     bool
+	}{
+		{"previous step", -totp.Period, true},
+		{"current step", 0, true},
+		{"next step", totp.Period, true},
+		{"two steps ahead", 2 * totp.Period, false},
+		{"three steps behind", -3 * totp.Period, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clk, secret, _ := setupTwoFactor(t)
+			// Far enough from the confirmation step that "behind" codes
+			// are not rejected as reused.
+			clk.add(10 * totp.Period)
+			_, err := VerifySecondFactor("alice", clk.code(t, secret, tc.offset))
+			if tc.ok && err != nil {
+				t.Fatalf("err = %v, want nil", err)
+			}
+			if !tc.ok && !errors.Is(err, ErrInvalidCode) {
+				t.Fatalf("err = %v, want ErrInvalidCode", err)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactorRejectsReuse(t *testing.T) {
+	clk, secret, _ := setupTwoFactor(t)
+
+	code := clk.code(t, secret, 0)
+	if _, err := VerifySecondFactor("alice", code); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := VerifySecondFactor("alice", code); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("second use: err = %v, want ErrInvalidCode", err)
+	}
+
+	// A code from an earlier step, still inside the window, is spent too.
+	clk.add(totp.Period)
+	if _, err := VerifySecondFactor("alice", code); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("earlier step after a later one: err = %v, want ErrInvalidCode", err)
+	}
+	if _, err := VerifySecondFactor("alice", clk.code(t, secret, 0)); err != nil {
+		t.Fatalf("next step: %v", err)
+	}
+
+	adminMu.RLock()
+	users, _ := readUsers()
+	adminMu.RUnlock()
+	if got, want := users[findUser(users, "alice")].TOTPLastCounter, totp.Counter(clk.now); got != want {
+		t.Fatalf("TOTPLastCounter = %d, want %d", got, want)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	_, _, recovery := setupTwoFactor(t)
+
+	used, err := VerifySecondFactor("alice", recovery[0])
+	if err != nil || !used {
+		t.Fatalf("first use: used = %v, err = %v", used, err)
+	}
+	if _, err := VerifySecondFactor("alice", recovery[0]); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("second use: err = %v, want ErrInvalidCode", err)
+	}
+	if got := RecoveryCodesLeft("alice"); got != recoveryCodeCount-1 {
+		t.Fatalf("RecoveryCodesLeft = %d, want %d", got, recoveryCodeCount-1)
+	}
+
+	// Codes may be typed in upper case and without the dash.
+	loose := recovery[1][:4] + recovery[1][5:]
+	if used, err := VerifySecondFactor("alice", " "+strings.ToUpper(loose)); err != nil || !used {
+		t.Fatalf("loosely typed code: used = %v, err = %v", used, err)
+	}
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	clk, secret, recovery := setupTwoFactor(t)
+
+	if _, err := RegenerateRecoveryCodes("alice", recovery[1]); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("recovery code: err = %v, want ErrInvalidCode", err)
+	}
+	fresh, err := RegenerateRecoveryCodes("alice", clk.code(t, secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(fresh), recoveryCodeCount)
+	}
+	if _, err := VerifySecondFactor("alice", recovery[0]); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("old recovery code: err = %v, want ErrInvalidCode", err)
+	}
+	if _, err := VerifySecondFactor("alice", fresh[0]); err != nil {
+		t.Fatalf("new recovery code: %v", err)
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	clk, secret, _ := setupTwoFactor(t)
+
+	id, err := NewLoginChallenge("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, cookie, err := CompleteLoginChallenge(id, clk.code(t, secret, 0))
+	if err != nil || user != "alice" || !cookie {
+		t.Fatalf("CompleteLoginChallenge = %q, %v, %v", user, cookie, err)
+	}
+	if _, _, err := CompleteLoginChallenge(id, clk.code(t, secret, totp.Period)); !errors.Is(err, ErrChallenge) {
+		t.Fatalf("reused challenge: err = %v, want ErrChallenge", err)
+	}
+}
+
+func TestLoginChallengeAttempts(t *testing.T) {
+	clk, secret, _ := setupTwoFactor(t)
+
+	id, err := NewLoginChallenge("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := clk.code(t, secret, 5*totp.Period)
+	for i := 1; i <= loginChallengeAttempts; i++ {
+		user, _, err := CompleteLoginChallenge(id, wrong)
+		if !errors.Is(err, ErrInvalidCode) || user != "alice" {
+			t.Fatalf("attempt %d: user = %q, err = %v, want ErrInvalidCode", i, user, err)
+		}
+	}
+	if _, _, err := CompleteLoginChallenge(id, clk.code(t, secret, 0)); !errors.Is(err, ErrChallenge) {
+		t.Fatalf("right code after %d wrong ones: err = %v, want ErrChallenge", loginChallengeAttempts, err)
+	}
+}
+
+func TestLoginChallengeExpires(t *testing.T) {
+	clk, secret, _ := setupTwoFactor(t)
+
+	id, err := NewLoginChallenge("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.add(loginChallengeTTL + time.Second)
+	if _, _, err := CompleteLoginChallenge(id, clk.code(t, secret, 0)); !errors.Is(err, ErrChallenge) {
+		t.Fatalf("expired challenge: err = %v, want ErrChallenge", err)
+	}
+
+	id, err = NewLoginChallenge("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.add(loginChallengeTTL - time.Second)
+	if _, _, err := CompleteLoginChallenge(id, clk.code(t, secret, 0)); err != nil {
+		t.Fatalf("challenge within its lifetime: %v", err)
+	}
+}
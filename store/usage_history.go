@@ -0,0 +1,409 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage history layout under UsageDir:
+//
+//	events-YYYY-MM-DD.jsonl  one UsageEvent per line, UTC day
+//	rollup-YYYY-MM.jsonl     hourly UsageRollup rows for compacted days
+const (
+	usageEventsPrefix = "events-"
+	usageRollupPrefix = "rollup-"
+	usageDayLayout    = "2006-01-02"
+	usageMonthLayout  = "2006-01"
+)
+
+// UsageEvent is one proxied request.
+type UsageEvent struct {
+	Time         time.Time `json:"time"`
+	AccountID    string    `json:"accountId,omitempty"`
+	PoolID       string    `json:"poolId,omitempty"`
+	ApiKey       string    `json:"apiKey,omitempty"` // masked, see MaskApiKey
+	Model        string    `json:"model,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	Status       int       `json:"status"`
+	InputTokens  int       `json:"inputTokens,omitempty"`
+	OutputTokens int       `json:"outputTokens,omitempty"`
+	CachedTokens int       `json:"cachedTokens,omitempty"`
+	TTFTMs       int64     `json:"ttftMs,omitempty"`
+	DurationMs   int64     `json:"durationMs"`
+}
+
+// UsageRollup aggregates the events of one hour that share all dimensions.
+type UsageRollup struct {
+	Hour         time.Time `json:"hour"`
+	AccountID    string    `json:"accountId,omitempty"`
+	PoolID       string    `json:"poolId,omitempty"`
+	ApiKey       string    `json:"apiKey,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	Endpoint     string    `json:"endpoint"`
+	Status       int       `json:"status"`
+	Requests     int64     `json:"requests"`
+	InputTokens  int64     `json:"inputTokens,omitempty"`
+	OutputTokens int64     `json:"outputTokens,omitempty"`
+	CachedTokens int64     `json:"cachedTokens,omitempty"`
+	TTFTMsSum    int64     `json:"ttftMsSum,omitempty"`
+	TTFTCount    int64     `json:"ttftCount,omitempty"`
+	DurationMs   int64     `json:"durationMsSum"`
+}
+
+// UsageDimensions are the fields a usage query can group or filter by.
+var UsageDimensions = []string{"account", "pool", "key", "model", "endpoint", "status"}
+
+// UsageQuery selects and groups usage history.
+type UsageQuery struct {
+	From    time.Time
+	To      time.Time
+	GroupBy []string          // subset of UsageDimensions
+	Filters map[string]string // dimension -> exact value
+	// Interval buckets results by time: "hour", "day" or "" for the whole range.
+	Interval string
+}
+
+// UsageQueryRow is one group of a usage query result.
+type UsageQueryRow struct {
+	Bucket        string            `json:"bucket,omitempty"` // RFC3339 start of the time bucket
+	Group         map[string]string `json:"group"`
+	Requests      int64             `json:"requests"`
+	Errors        int64             `json:"errors"`
+	InputTokens   int64             `json:"inputTokens"`
+	OutputTokens  int64             `json:"outputTokens"`
+	CachedTokens  int64             `json:"cachedTokens"`
+	AvgTTFTMs     float64           `json:"avgTtftMs"`
+	AvgDurationMs float64           `json:"avgDurationMs"`
+
+	ttftSum, ttftCount, durationSum int64
+}
+
+var usageHistoryMu sync.Mutex
+
+func UsageDir() string {
+	return filepath.Join(AppDir, "usage")
+}
+
+// MaskApiKey shortens an API key to an identifier that is safe to persist.
+func MaskApiKey(key string) string {
+	if len(key) <= 16 {
+		return key
+	}
+	return key[:12] + "..." + key[len(key)-4:]
+}
+
+func usageEventsFile(day time.Time) string {
+	return filepath.Join(UsageDir(), usageEventsPrefix+day.UTC().Format(usageDayLayout)+".jsonl")
+}
+
+func usageRollupFile(month time.Time) string {
+	return filepath.Join(UsageDir(), usageRollupPrefix+month.UTC().Format(usageMonthLayout)+".jsonl")
+}
+
+// AppendUsageEvents appends events to their day files.
+func AppendUsageEvents(events []UsageEvent) error {
+	usageHistoryMu.Lock()
+	defer usageHistoryMu.Unlock()
+
+	if err := os.MkdirAll(UsageDir(), 0755); err != nil {
+		return err
+	}
+
+	byFile := make(map[string][]UsageEvent)
+	for _, ev := range events {
+		f := usageEventsFile(ev.Time)
+		byFile[f] = append(byFile[f], ev)
+	}
+	for path, evs := range byFile {
+		if err := appendJSONLines(path, evs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendJSONLines[T any](path string, rows []T) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJSONLines calls fn for each decodable line of path. Missing files are empty.
+func readJSONLines[T any](path string, fn func(T)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var row T
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			continue // skip a torn line from an interrupted write
+		}
+		fn(row)
+	}
+	return scanner.Err()
+}
+
+func rollupKey(r UsageRollup) string {
+	return strings.Join([]string{r.Hour.Format(time.RFC3339), r.AccountID, r.PoolID, r.ApiKey, r.Model, r.Endpoint, fmt.Sprint(r.Status)}, "\x00")
+}
+
+func (r *UsageRollup) add(ev UsageEvent) {
+	r.Requests++
+	r.InputTokens += int64(ev.InputTokens)
+	r.OutputTokens += int64(ev.OutputTokens)
+	r.CachedTokens += int64(ev.CachedTokens)
+	if ev.TTFTMs > 0 {
+		r.TTFTMsSum += ev.TTFTMs
+		r.TTFTCount++
+	}
+	r.DurationMs += ev.DurationMs
+}
+
+func eventRollup(ev UsageEvent) UsageRollup {
+	r := UsageRollup{
+		Hour:      ev.Time.UTC().Truncate(time.Hour),
+		AccountID: ev.AccountID,
+		PoolID:    ev.PoolID,
+		ApiKey:    ev.ApiKey,
+		Model:     ev.Model,
+		Endpoint:  ev.Endpoint,
+		Status:    ev.Status,
+	}
+	r.add(ev)
+	return r
+}
+
+// CompactUsageHistory rolls raw event files older than rawRetention up into
+// hourly rollups and deletes rollup months that ended before rollupRetention.
+func CompactUsageHistory(rawRetention, rollupRetention time.Duration) error {
+	usageHistoryMu.Lock()
+	defer usageHistoryMu.Unlock()
+
+	entries, err := os.ReadDir(UsageDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	now := time.Now().UTC()
+	rawCutoff := now.Add(-rawRetention).Truncate(24 * time.Hour)
+	rollupCutoff := now.Add(-rollupRetention)
+
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(UsageDir(), name)
+		switch {
+		case strings.HasPrefix(name, usageEventsPrefix):
+			day, err := time.Parse(usageDayLayout, strings.TrimSuffix(strings.TrimPrefix(name, usageEventsPrefix), ".jsonl"))
+			if err != nil || !day.Before(rawCutoff) {
+				continue
+			}
+			if err := rollUpDay(path, day); err != nil {
+				return fmt.Errorf("failed to roll up %s: %w", name, err)
+			}
+		case strings.HasPrefix(name, usageRollupPrefix):
+			month, err := time.Parse(usageMonthLayout, strings.TrimSuffix(strings.TrimPrefix(name, usageRollupPrefix), ".jsonl"))
+			if err != nil || !month.AddDate(0, 1, 0).Before(rollupCutoff) {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rollUpDay aggregates one raw day file into its month's rollup file and removes it.
+func rollUpDay(path string, day time.Time) error {
+	rollups := make(map[string]*UsageRollup)
+	var order []string
+	err := readJSONLines(path, func(ev UsageEvent) {
+		r := eventRollup(ev)
+		key := rollupKey(r)
+		if existing, ok := rollups[key]; ok {
+			existing.add(ev)
+			return
+		}
+		rollups[key] = &r
+		order = append(order, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	rows := make([]UsageRollup, 0, len(order))
+	for _, key := range order {
+		rows = append(rows, *rollups[key])
+	}
+	if len(rows) > 0 {
+		if err := appendJSONLines(usageRollupFile(day), rows); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// QueryUsage aggregates raw events and rollups within [q.From, q.To).
+// Rolled-up history has hourly resolution.
+func QueryUsage(q UsageQuery) ([]UsageQueryRow, error) {
+	for _, dim := range q.GroupBy {
+		if !isUsageDimension(dim) {
+			return nil, fmt.Errorf("unknown group-by dimension %q", dim)
+		}
+	}
+	for dim := range q.Filters {
+		if !isUsageDimension(dim) {
+			return nil, fmt.Errorf("unknown filter dimension %q", dim)
+		}
+	}
+	switch q.Interval {
+	case "", "hour", "day":
+	default:
+		return nil, fmt.Errorf("interval must be \"hour\", \"day\" or empty")
+	}
+
+	usageHistoryMu.Lock()
+	defer usageHistoryMu.Unlock()
+
+	groups := make(map[string]*UsageQueryRow)
+	var order []string
+	collect := func(r UsageRollup) {
+		if r.Hour.Before(q.From.Truncate(time.Hour)) || !r.Hour.Before(q.To) {
+			return
+		}
+		for dim, want := range q.Filters {
+			if rollupDimension(r, dim) != want {
+				return
+			}
+		}
+
+		row := UsageQueryRow{Group: make(map[string]string, len(q.GroupBy))}
+		switch q.Interval {
+		case "hour":
+			row.Bucket = r.Hour.Format(time.RFC3339)
+		case "day":
+			row.Bucket = r.Hour.Truncate(24 * time.Hour).Format(time.RFC3339)
+		}
+		parts := []string{row.Bucket}
+		for _, dim := range q.GroupBy {
+			v := rollupDimension(r, dim)
+			row.Group[dim] = v
+			parts = append(parts, v)
+		}
+		key := strings.Join(parts, "\x00")
+
+		g, ok := groups[key]
+		if !ok {
+			g = &row
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.Requests += r.Requests
+		if r.Status == 0 || r.Status >= 400 {
+			g.Errors += r.Requests
+		}
+		g.InputTokens += r.InputTokens
+		g.OutputTokens += r.OutputTokens
+		g.CachedTokens += r.CachedTokens
+		g.ttftSum += r.TTFTMsSum
+		g.ttftCount += r.TTFTCount
+		g.durationSum += r.DurationMs
+	}
+
+	from, to := q.From.UTC(), q.To.UTC()
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		err := readJSONLines(usageEventsFile(day), func(ev UsageEvent) {
+			if ev.Time.Before(from) || !ev.Time.Before(to) {
+				return
+			}
+			r := eventRollup(ev)
+			collect(r)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(to); month = month.AddDate(0, 1, 0) {
+		if err := readJSONLines(usageRollupFile(month), collect); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := make([]UsageQueryRow, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		if g.ttftCount > 0 {
+			g.AvgTTFTMs = float64(g.ttftSum) / float64(g.ttftCount)
+		}
+		if g.Requests > 0 {
+			g.AvgDurationMs = float64(g.durationSum) / float64(g.Requests)
+		}
+		rows = append(rows, *g)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Bucket != rows[j].Bucket {
+			return rows[i].Bucket < rows[j].Bucket
+		}
+		return rows[i].Requests > rows[j].Requests
+	})
+	return rows, nil
+}
+
+func isUsageDimension(dim string) bool {
+	for _, d := range UsageDimensions {
+		if d == dim {
+			return true
+		}
+	}
+	return false
+}
+
+func rollupDimension(r UsageRollup, dim string) string {
+	switch dim {
+	case "account":
+		return r.AccountID
+	case "pool":
+		return r.PoolID
+	case "key":
+		return r.ApiKey
+	case "model":
+		return r.Model
+	case "endpoint":
+		return r.Endpoint
+	case "status":
+		return fmt.Sprint(r.Status)
+	}
+	return ""
+}
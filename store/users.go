@@ -0,0 +1,506 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Console roles, from least to most privileged.
+const (
+	RoleViewer   = "viewer"   // read-only; tokens and keys are hidden
+	RoleOperator = "operator" // viewer + start/stop accounts and manage API keys
+	RoleAdmin    = "admin"    // everything, including user management
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	ErrLastAdmin    = errors.New("cannot remove or demote the last admin")
+	ErrSetupDone    = errors.New("admin already configured")
+)
+
+// UserSourceOIDC marks users provisioned by single sign-on. They have no
+// password and their role follows the identity provider's groups.
+const UserSourceOIDC = "oidc"
+
+// ValidRole reports whether role is one of the console roles.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAtLeast reports whether role grants at least the privileges of min.
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min] && roleRank[min] > 0
+}
+
+// User is a console user stored in admin.json.
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+	Role         string `json:"role"`
+	CreatedAt    string `json:"createdAt"`
+	UpdatedAt    string `json:"updatedAt,omitempty"`
+	Source       string `json:"source,omitempty"` // "" for local users, or UserSourceOIDC
+
+	// Single sign-on users are identified by the provider's issuer and
+	// subject; DisplayName is the name the provider last gave them.
+	SSOIssuer   string `json:"ssoIssuer,omitempty"`
+	SSOSubject  string `json:"ssoSubject,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+
+	// TOTP two-factor authentication, see twofactor.go.
+	TOTPSecret      string   `json:"totpSecret,omitempty"`      // set once enrollment is confirmed
+	TOTPPending     string   `json:"totpPending,omitempty"`     // secret awaiting confirmation
+	TOTPLastCounter int64    `json:"totpLastCounter,omitempty"` // last accepted time step, to reject reuse
+	RecoveryCodes   []string `json:"recoveryCodes,omitempty"`   // SHA-256 hashes of unused codes
+}
+
+// UserInfo is a User without its password hash and 2FA secrets.
+type UserInfo struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	Role        string `json:"role"`
+	TwoFactor   bool   `json:"twoFactor"`
+	Source      string `json:"source,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+func (u User) Info() UserInfo {
+	return UserInfo{
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		Role:        u.Role,
+		TwoFactor:   u.TOTPSecret != "",
+		Source:      u.Source,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
+}
+
+type userStore struct {
+	Users []User `json:"users"`
+}
+
+// AdminData is the single-admin format of admin.json, migrated to a user
+// with the admin role on startup.
+type AdminData struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+}
+
+// ValidateUsername checks that name is usable as a login and in URL paths.
+func ValidateUsername(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("username must be 1-64 characters")
+	}
+	if strings.ContainsAny(name, " \t\r\n/\\?#%") {
+		return fmt.Errorf("username must not contain whitespace, slashes, '?', '#' or '%%'")
+	}
+	return nil
+}
+
+func readUsers() ([]User, error) {
+	data, err := os.ReadFile(AdminFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []User{}, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 || string(data) == "{}" {
+		return []User{}, nil
+	}
+	var s userStore
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if s.Users == nil {
+		// Not yet migrated from the single-admin format.
+		var legacy AdminData
+		if err := json.Unmarshal(data, &legacy); err == nil && legacy.PasswordHash != "" {
+			return []User{{Username: legacy.Username, PasswordHash: legacy.PasswordHash, Role: RoleAdmin}}, nil
+		}
+		return []User{}, nil
+	}
+	return s.Users, nil
+}
+
+func writeUsers(users []User) error {
+	data, err := json.MarshalIndent(userStore{Users: users}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The file holds TOTP secrets. WriteFile keeps the mode of an existing
+	// file, so tighten one written 0644 by an older version.
+	if err := os.WriteFile(AdminFile(), data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(AdminFile(), 0600)
+}
+
+// migrateLegacyAdmin rewrites a single-admin admin.json as a user list.
+func migrateLegacyAdmin() error {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	data, err := os.ReadFile(AdminFile())
+	if err != nil || len(data) == 0 || string(data) == "{}" {
+		return nil
+	}
+	var s userStore
+	if json.Unmarshal(data, &s) != nil || s.Users != nil {
+		return nil
+	}
+	users, err := readUsers()
+	if err != nil || len(users) == 0 {
+		return err
+	}
+	users[0].CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	return writeUsers(users)
+}
+
+func findUser(users []User, username string) int {
+	for i, u := range users {
+		if u.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func countAdmins(users []User) int {
+	n := 0
+	for _, u := range users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// mutateUser applies fn to a user under the lock and saves the result.
+func mutateUser(username string, fn func(u *User) error) (*User, error) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	i := findUser(users, username)
+	if i < 0 {
+		return nil, ErrUserNotFound
+	}
+	if err := fn(&users[i]); err != nil {
+		return nil, err
+	}
+	if err := writeUsers(users); err != nil {
+		return nil, err
+	}
+	u := users[i]
+	return &u, nil
+}
+
+// ListUsers returns all console users sorted by username.
+func ListUsers() ([]UserInfo, error) {
+	adminMu.RLock()
+	defer adminMu.RUnlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]UserInfo, 0, len(users))
+	for _, u := range users {
+		out = append(out, u.Info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out, nil
+}
+
+// GetUser returns the user, or nil if it does not exist.
+func GetUser(username string) (*UserInfo, error) {
+	adminMu.RLock()
+	defer adminMu.RUnlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	if i := findUser(users, username); i >= 0 {
+		info := users[i].Info()
+		return &info, nil
+	}
+	return nil, nil
+}
+
+// CreateUser adds a console user.
+func CreateUser(username, password, role string) (*UserInfo, error) {
+	return addUser(username, password, role, false)
+}
+
+// addUser adds a user; with firstOnly it fails with ErrSetupDone if any user
+// already exists.
+func addUser(username, password, role string, firstOnly bool) (*UserInfo, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	if firstOnly && len(users) > 0 {
+		return nil, ErrSetupDone
+	}
+	if findUser(users, username) >= 0 {
+		return nil, ErrUserExists
+	}
+	u := User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := writeUsers(append(users, u)); err != nil {
+		return nil, err
+	}
+	info := u.Info()
+	return &info, nil
+}
+
+// ProvisionSSOUser creates or updates the single sign-on user that the
+// provider identifies by issuer and subject, giving them role. name is the
+// provider's username for them: it names a new user unless another user
+// already has that name, in which case a suffix derived from the subject is
+// added. Later logins only update the display name. A role change ends the
+// user's other sessions, as SetUserRole does.
+func ProvisionSSOUser(issuer, subject, name, role string) (*UserInfo, error) {
+	if issuer == "" || subject == "" {
+		return nil, fmt.Errorf("single sign-on user needs an issuer and subject")
+	}
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	i := slices.IndexFunc(users, func(u User) bool {
+		return u.Source == UserSourceOIDC && u.SSOIssuer == issuer && u.SSOSubject == subject
+	})
+	if i < 0 {
+		username := ssoUsername(users, issuer, subject, name)
+		if username == "" {
+			return nil, ErrUserExists
+		}
+		users = append(users, User{
+			Username:    username,
+			Role:        role,
+			Source:      UserSourceOIDC,
+			SSOIssuer:   issuer,
+			SSOSubject:  subject,
+			DisplayName: name,
+			CreatedAt:   now,
+		})
+		if err := writeUsers(users); err != nil {
+			return nil, err
+		}
+		info := users[len(users)-1].Info()
+		return &info, nil
+	}
+
+	u := &users[i]
+	roleChanged := u.Role != role
+	if roleChanged && u.Role == RoleAdmin && countAdmins(users) == 1 {
+		return nil, ErrLastAdmin
+	}
+	if roleChanged || u.DisplayName != name {
+		u.Role, u.DisplayName = role, name
+		u.UpdatedAt = now
+		if err := writeUsers(users); err != nil {
+			return nil, err
+		}
+	}
+	if roleChanged {
+		RevokeUserSessions(u.Username, "")
+	}
+	info := u.Info()
+	return &info, nil
+}
+
+// ssoUsername picks the console username for a new single sign-on user: name
+// if it is valid and free, else name (or "sso") with a suffix derived from
+// issuer and subject. It returns "" if that is taken too.
+func ssoUsername(users []User, issuer, subject, name string) string {
+	if ValidateUsername(name) == nil && findUser(users, name) < 0 {
+		return name
+	}
+	sum := sha256.Sum256([]byte(issuer + "\x00" + subject))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	base := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" \t\r\n/\\?#%", r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if base == "" {
+		base = "sso"
+	}
+	for len(base)+len(suffix) > 64 {
+		_, size := utf8.DecodeLastRuneInString(base)
+		base = base[:len(base)-size]
+	}
+	if findUser(users, base+suffix) >= 0 {
+		return ""
+	}
+	return base + suffix
+}
+
+// SetUserRole changes a user's role and ends their sessions.
+func SetUserRole(username, role string) (*UserInfo, error) {
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return nil, err
+	}
+	i := findUser(users, username)
+	if i < 0 {
+		return nil, ErrUserNotFound
+	}
+	if users[i].Role == RoleAdmin && role != RoleAdmin && countAdmins(users) == 1 {
+		return nil, ErrLastAdmin
+	}
+	if users[i].Role != role {
+		users[i].Role = role
+		users[i].UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		if err := writeUsers(users); err != nil {
+			return nil, err
+		}
+		RevokeUserSessions(username, "")
+	}
+	info := users[i].Info()
+	return &info, nil
+}
+
+// DeleteUser removes a user and ends their sessions.
+func DeleteUser(username string) error {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	i := findUser(users, username)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	if users[i].Role == RoleAdmin && countAdmins(users) == 1 {
+		return ErrLastAdmin
+	}
+	if err := writeUsers(append(users[:i], users[i+1:]...)); err != nil {
+		return err
+	}
+	RevokeUserSessions(username, "")
+	return nil
+}
+
+// SetUserPassword replaces a user's password and ends their sessions except
+// keepToken (the caller's own session when changing their own password).
+func SetUserPassword(username, password, keepToken string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	adminMu.Lock()
+	defer adminMu.Unlock()
+
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	i := findUser(users, username)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	users[i].PasswordHash = string(hash)
+	users[i].UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := writeUsers(users); err != nil {
+		return err
+	}
+	RevokeUserSessions(username, keepToken)
+	return nil
+}
+
+// bcryptSlots bounds concurrent password checks so a flood of logins cannot
+// monopolize the CPU.
+var bcryptSlots = make(chan struct{}, max(1, runtime.NumCPU()/2))
+
+// dummyHash is compared against for unknown users, so a login takes as long
+// whether or not the username exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// VerifyPassword checks a user's password and returns the user.
+func VerifyPassword(username, password string) (*UserInfo, error) {
+	adminMu.RLock()
+	users, err := readUsers()
+	adminMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := dummyHash
+	i := findUser(users, username)
+	if i >= 0 {
+		hash = []byte(users[i].PasswordHash)
+	}
+	bcryptSlots <- struct{}{}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	<-bcryptSlots
+	if i < 0 {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := users[i].Info()
+	return &info, nil
+}
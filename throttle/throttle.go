@@ -0,0 +1,236 @@
+// Package throttle slows down repeated failures from the same source, such as
+// wrong passwords or invalid API keys, with exponential backoff and temporary
+// lockouts.
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxEntries bounds memory use when failures come from many sources.
+const maxEntries = 10000
+
+// Policy describes how failures are penalized.
+type Policy struct {
+	// FreeFailures are allowed before any delay is imposed.
+	FreeFailures int
+	// BaseDelay is the first delay, doubled with each further failure up to
+	// MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter failures block the source for Lockout. Zero disables
+	// lockouts, leaving only the backoff.
+	LockoutAfter int
+	Lockout      time.Duration
+	// Window is how long after its last failure a source is forgotten.
+	Window time.Duration
+}
+
+type entry struct {
+	failures     int // since the last success or the window expiring
+	total        int // since the entry was created
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+	inFlight     int // attempts begun and not yet ended
+}
+
+// Limiter tracks failures per key, for example per IP or per username.
+type Limiter struct {
+	policy Policy
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// New returns a Limiter that applies policy.
+func New(policy Policy) *Limiter {
+	return &Limiter{policy: policy, entries: make(map[string]*entry)}
+}
+
+// Check reports whether key may try again now, or how long it must wait.
+// It does not count as an attempt.
+func (l *Limiter) Check(key string) (retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[key]
+	if e == nil {
+		return 0, true
+	}
+	if wait := time.Until(e.blockedUntil); wait > 0 {
+		return wait, false
+	}
+	return 0, true
+}
+
+// Begin reserves an attempt for key, as Check does but counting the attempts
+// still in progress: while their failures would still be free they may run in
+// parallel, past that only one at a time, so concurrent requests cannot all
+// slip in before the first failure is recorded. Every successful Begin must be
+// followed by End.
+func (l *Limiter) Begin(key string) (retryAfter time.Duration, ok bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[key]
+	if e == nil {
+		if len(l.entries) >= maxEntries {
+			l.pruneLocked(now)
+		}
+		e = &entry{}
+		l.entries[key] = e
+	} else if l.expiredLocked(e, now) {
+		e.failures, e.locked = 0, false
+	}
+	if wait := e.blockedUntil.Sub(now); wait > 0 {
+		return wait, false
+	}
+	if e.inFlight > 0 && e.failures+e.inFlight >= l.policy.FreeFailures {
+		return l.policy.BaseDelay, false
+	}
+	e.inFlight++
+	return 0, true
+}
+
+// End releases an attempt reserved by Begin. Record its outcome with Fail or
+// Succeed first.
+func (l *Limiter) End(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entries[key]
+	if e == nil {
+		return
+	}
+	if e.inFlight > 0 {
+		e.inFlight--
+	}
+	if e.inFlight == 0 && e.total == 0 {
+		delete(l.entries, key)
+	}
+}
+
+// Fail records a failure for key and returns how long it is now blocked.
+func (l *Limiter) Fail(key string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entries[key]
+	if e == nil {
+		if len(l.entries) >= maxEntries {
+			l.pruneLocked(now)
+		}
+		e = &entry{}
+		l.entries[key] = e
+	} else if l.expiredLocked(e, now) {
+		e.failures, e.locked = 0, false
+	}
+	e.failures++
+	e.total++
+	e.lastFailure = now
+
+	p := l.policy
+	var delay time.Duration
+	switch {
+	case p.LockoutAfter > 0 && e.failures >= p.LockoutAfter:
+		delay, e.locked = p.Lockout, true
+	case e.failures > p.FreeFailures:
+		delay = p.BaseDelay << min(e.failures-p.FreeFailures-1, 30)
+		if delay > p.MaxDelay || delay <= 0 {
+			delay = p.MaxDelay
+		}
+	}
+	if until := now.Add(delay); until.After(e.blockedUntil) {
+		e.blockedUntil = until
+	}
+	return time.Until(e.blockedUntil)
+}
+
+// Succeed clears key's failures after a successful attempt.
+func (l *Limiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// Reset unblocks key, as when an admin lifts a lockout. It reports whether
+// key was tracked.
+func (l *Limiter) Reset(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok && e.total > 0
+}
+
+// Entry is a snapshot of one key's failures.
+type Entry struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	TotalFailures int        `json:"totalFailures"`
+	LastFailure   time.Time  `json:"lastFailure"`
+	BlockedUntil  *time.Time `json:"blockedUntil,omitempty"`
+	Locked        bool       `json:"locked"`
+}
+
+// Snapshot returns the keys with recent failures, most recent first.
+func (l *Limiter) Snapshot() []Entry {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pruneLocked(now)
+
+	out := make([]Entry, 0, len(l.entries))
+	for k, e := range l.entries {
+		if e.total == 0 {
+			continue // only attempts in progress
+		}
+		s := Entry{Key: k, Failures: e.failures, TotalFailures: e.total, LastFailure: e.lastFailure}
+		if e.blockedUntil.After(now) {
+			t := e.blockedUntil
+			s.BlockedUntil = &t
+			s.Locked = e.locked
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastFailure.After(out[j].LastFailure) })
+	return out
+}
+
+// expiredLocked reports whether e's failures are old enough to forget.
+func (l *Limiter) expiredLocked(e *entry, now time.Time) bool {
+	return !now.Before(e.blockedUntil) && now.Sub(e.lastFailure) > l.policy.Window
+}
+
+// idleLocked reports whether e can be dropped: forgotten and with no
+// attempt in progress.
+func (l *Limiter) idleLocked(e *entry, now time.Time) bool {
+	return e.inFlight == 0 && l.expiredLocked(e, now)
+}
+
+// pruneLocked drops forgotten entries and, if the map is still full, the
+// stalest unblocked ones.
+func (l *Limiter) pruneLocked(now time.Time) {
+	for k, e := range l.entries {
+		if l.idleLocked(e, now) {
+			delete(l.entries, k)
+		}
+	}
+	if len(l.entries) < maxEntries {
+		return
+	}
+	keys := make([]string, 0, len(l.entries))
+	for k, e := range l.entries {
+		if !e.blockedUntil.After(now) && e.inFlight == 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return l.entries[keys[i]].lastFailure.Before(l.entries[keys[j]].lastFailure)
+	})
+	for _, k := range keys[:min(len(keys), len(l.entries)-maxEntries+1)] {
+		delete(l.entries, k)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"copilot-go/tlsutil"
+)
+
+// parseListeners parses a -tls-listeners value.
+func parseListeners(s string) ([]string, error) {
+	var out []string
+	for _, l := range strings.Split(s, ",") {
+		switch l = strings.TrimSpace(l); l {
+		case "":
+		case "web", "proxy":
+			out = append(out, l)
+		default:
+			return nil, fmt.Errorf("invalid -tls-listeners entry %q, want web or proxy", l)
+		}
+	}
+	return out, nil
+}
+
+// listenerTLS builds the TLS configurations for the web console and proxy
+// listeners; a nil configuration means plain HTTP. proxyOpts carries the
+// proxy's client certificate settings.
+func listenerTLS(certFile, keyFile, listeners string, proxyOpts tlsutil.Options) (web, proxy *tls.Config, err error) {
+	enabled, err := parseListeners(listeners)
+	if err != nil {
+		return nil, nil, err
+	}
+	if certFile == "" {
+		if keyFile != "" {
+			return nil, nil, errors.New("-tls-key needs -tls-cert")
+		}
+		if proxyOpts.ClientCAFile != "" {
+			return nil, nil, errors.New("-proxy-client-ca needs HTTPS on the proxy (-tls-cert or -tls-self-signed)")
+		}
+		return nil, nil, nil
+	}
+	if keyFile == "" {
+		return nil, nil, errors.New("-tls-cert needs -tls-key")
+	}
+
+	if slices.Contains(enabled, "web") {
+		if web, err = tlsutil.Config(tlsutil.Options{CertFile: certFile, KeyFile: keyFile}); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !slices.Contains(enabled, "proxy") {
+		if proxyOpts.ClientCAFile != "" {
+			return nil, nil, errors.New("-proxy-client-ca needs proxy in -tls-listeners")
+		}
+		return web, nil, nil
+	}
+	proxyOpts.CertFile, proxyOpts.KeyFile = certFile, keyFile
+	if proxyOpts.ClientCAFile == "" {
+		proxyOpts.ClientAuth = tlsutil.ClientAuthOff
+	}
+	if proxy, err = tlsutil.Config(proxyOpts); err != nil {
+		return nil, nil, err
+	}
+	return web, proxy, nil
+}
+
+// proxyServesTLS reports whether the environment configures HTTPS on the
+// proxy, for subcommands that connect to a running server.
+func proxyServesTLS() bool {
+	if os.Getenv("TLS_CERT_FILE") == "" && os.Getenv("TLS_SELF_SIGNED") != "true" {
+		return false
+	}
+	listeners, err := parseListeners(envOr("TLS_LISTENERS", "web,proxy"))
+	return err == nil && slices.Contains(listeners, "proxy")
+}
+
+func scheme(cfg *tls.Config) string {
+	if cfg == nil {
+		return "http"
+	}
+	return "https"
+}
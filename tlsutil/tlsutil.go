@@ -0,0 +1,258 @@
+// Package tlsutil builds TLS configurations for the listeners: certificates
+// that reload when their files change, self-signed certificates for first
+// runs, and optional client-certificate verification.
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the files are checked for changes, at most.
+const reloadInterval = 10 * time.Second
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+// reloader re-reads a set of files when any of them changes, checked on use
+// and at most every reloadInterval. A failed reload keeps the previous value,
+// so a half-written renewal never takes a listener down.
+type reloader[T any] struct {
+	paths []string
+	load  func() (T, error)
+
+	mu      sync.Mutex
+	value   T
+	stamps  []fileStamp
+	checked time.Time
+}
+
+func newReloader[T any](load func() (T, error), paths ...string) (*reloader[T], error) {
+	r := &reloader[T]{paths: paths, load: load}
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.value, r.stamps, r.checked = v, stamps, time.Now()
+	return r, nil
+}
+
+func (r *reloader[T]) stat() ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(r.paths))
+	for i, p := range r.paths {
+		s, err := stampOf(p)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = s
+	}
+	return stamps, nil
+}
+
+func (r *reloader[T]) get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < reloadInterval {
+		return r.value
+	}
+	r.checked = time.Now()
+	stamps, err := r.stat()
+	if err != nil || equalStamps(stamps, r.stamps) {
+		return r.value
+	}
+	v, err := r.load()
+	if err != nil {
+		slog.Warn("Keeping previous TLS files, reload failed", "files", r.paths, "err", err)
+		return r.value
+	}
+	slog.Info("Reloaded TLS files", "files", r.paths)
+	r.value, r.stamps = v, stamps
+	return v
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientAuth selects whether the proxy asks for client certificates.
+type ClientAuth string
+
+const (
+	ClientAuthOff      ClientAuth = ""
+	ClientAuthOptional ClientAuth = "optional" // verify a certificate if one is sent
+	ClientAuthRequire  ClientAuth = "require"  // refuse connections without one
+)
+
+// Options describes one listener's TLS setup.
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is a PEM bundle of CAs that client certificates
+	// must chain to.
+	ClientCAFile string
+	ClientAuth   ClientAuth
+}
+
+// Config returns a server TLS configuration for opts whose certificate and
+// client CAs are reloaded when their files change.
+func Config(opts Options) (*tls.Config, error) {
+	certs, err := newReloader(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		return &cert, err
+	}, opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.get(), nil
+		},
+	}
+	if opts.ClientCAFile == "" {
+		if opts.ClientAuth != ClientAuthOff {
+			return nil, errors.New("client certificate authentication needs a client CA file")
+		}
+		return base, nil
+	}
+
+	cas, err := newReloader(func() (*x509.CertPool, error) {
+		data, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", opts.ClientCAFile)
+		}
+		return pool, nil
+	}, opts.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client CA: %w", err)
+	}
+	mode := tls.VerifyClientCertIfGiven
+	switch opts.ClientAuth {
+	case ClientAuthRequire:
+		mode = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional, ClientAuthOff:
+	default:
+		return nil, fmt.Errorf("invalid client auth mode %q, want optional or require", opts.ClientAuth)
+	}
+	base.ClientAuth = mode
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = cas.get()
+		return cfg, nil
+	}
+	return base, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate as lowercase
+// hex, as shown by "openssl x509 -fingerprint -sha256" without colons.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// EnsureSelfSigned writes a self-signed certificate and key into dir unless
+// they already exist, and returns their paths. The certificate covers
+// localhost, the host name and every local address, and is valid for a year.
+func EnsureSelfSigned(dir string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if _, err := os.Stat(certFile); err == nil {
+		if _, err := os.Stat(keyFile); err == nil {
+			return certFile, keyFile, nil
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "copilot-go self-signed", Organization: []string{"copilot-go"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", err
+	}
+	slog.Info("Generated self-signed TLS certificate", "cert", certFile,
+		"fingerprint", Fingerprint(&x509.Certificate{Raw: der}))
+	return certFile, keyFile, nil
+}
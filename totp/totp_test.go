@@ -0,0 +1,104 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the RFC 6238 SHA-1 test key "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC 6238 appendix B SHA-1 vectors, truncated to the 6 digits used here:
+// the 8-digit values modulo 10^6.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		counter, ok := Validate(rfcSecret, v.code, at)
+		if !ok {
+			t.Errorf("Validate(%s) at %d rejected", v.code, v.unix)
+			continue
+		}
+		if counter != Counter(at) {
+			t.Errorf("Validate(%s) at %d matched counter %d, want %d", v.code, v.unix, counter, Counter(at))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{-2 * Period, false},
+		{-Period, true},
+		{0, true},
+		{Period, true},
+		{2 * Period, false},
+	} {
+		if _, ok := Validate(rfcSecret, code, at.Add(tc.offset)); ok != tc.ok {
+			t.Errorf("Validate at %v offset = %v, want %v", tc.offset, ok, tc.ok)
+		}
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	at := time.Unix(59, 0)
+	if _, ok := Validate(rfcSecret, "287 082", at); !ok {
+		t.Error("code with a space rejected")
+	}
+	if _, ok := Validate(strings.ToLower(rfcSecret), "287082", at); !ok {
+		t.Error("lower-case secret rejected")
+	}
+	for _, code := range []string{"", "28708", "2870820", "287083"} {
+		if _, ok := Validate(rfcSecret, code, at); ok {
+			t.Errorf("Validate(%q) accepted", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", at); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeSecret(secret)
+	if err != nil {
+		t.Fatalf("decode %q: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret is %d bytes, want 20", len(key))
+	}
+}
@@ -0,0 +1,271 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportBuffer    = 2048
+	exportBatchSize = 256
+	exportInterval  = 5 * time.Second
+	exportTimeout   = 10 * time.Second
+)
+
+// Config configures span export.
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector base URL (e.g. http://localhost:4318)
+	// or the full traces URL ending in /v1/traces.
+	Endpoint    string
+	ServiceName string
+	Headers     map[string]string
+}
+
+// ConfigFromEnv reads the standard OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME
+// variables. A traces-specific endpoint takes precedence over the base one.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		Headers:     make(map[string]string),
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			cfg.Headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return cfg
+}
+
+var (
+	spans      = make(chan *Span, exportBuffer)
+	exportStop = make(chan chan struct{})
+)
+
+// Init enables tracing and starts exporting to cfg.Endpoint. It does nothing
+// when no endpoint is configured.
+func Init(cfg Config) {
+	if cfg.Endpoint == "" {
+		return
+	}
+	url := strings.TrimRight(cfg.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "copilot-go"
+	}
+	e := &exporter{url: url, service: cfg.ServiceName, headers: cfg.Headers, client: &http.Client{Timeout: exportTimeout}}
+
+	enabledMu.Lock()
+	enabled = true
+	enabledMu.Unlock()
+
+	go e.run()
+	slog.Info("exporting spans", "url", url)
+}
+
+func enqueue(s *Span) {
+	select {
+	case spans <- s:
+	default:
+		// Drop rather than block the request when the collector falls behind.
+	}
+}
+
+type exporter struct {
+	url     string
+	service string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (e *exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-spans:
+			batch = append(batch, s)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-exportStop:
+			for len(spans) > 0 {
+				batch = append(batch, <-spans)
+			}
+			if len(batch) > 0 {
+				if err := e.export(batch); err != nil {
+					slog.Error("failed to export spans", "spans", len(batch), "err", err)
+				}
+			}
+			close(done)
+			return
+		}
+		if err := e.export(batch); err != nil {
+			slog.Error("failed to export spans", "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+}
+
+// Shutdown exports the queued spans and stops tracing, giving up when ctx
+// ends. It does nothing when tracing is disabled.
+func Shutdown(ctx context.Context) {
+	enabledMu.Lock()
+	wasEnabled := enabled
+	enabled = false
+	enabledMu.Unlock()
+	if !wasEnabled {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case exportStop <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *exporter) export(batch []*Span) error {
+	out := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out = append(out, s.otlp())
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs([]Attr{String("service.name", e.service)}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "copilot-go"},
+				"spans": out,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// OTLP/JSON encoding, see opentelemetry-proto's JSON mapping.
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              SpanKind    `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 = ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, ev := range s.events {
+		out.Events = append(out.Events, otlpEvent{TimeUnixNano: unixNano(ev.time), Name: ev.name, Attributes: otlpAttrs(ev.attrs)})
+	}
+	if s.failed {
+		out.Status = &otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return out
+}
+
+func otlpAttrs(attrs []Attr) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch val := a.Value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": val}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(val, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": val}
+		case bool:
+			v = map[string]interface{}{"boolValue": val}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(val)}
+		}
+		out = append(out, otlpAttr{Key: a.Key, Value: v})
+	}
+	return out
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+)
+
+// ClientTrace returns an httptrace hook that records connection setup and
+// first-byte timing as events on s, or nil when s is nil.
+func ClientTrace(s *Span) *httptrace.ClientTrace {
+	if s == nil {
+		return nil
+	}
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			s.AddEvent("get_conn", String("server.address", hostPort))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.AddEvent("got_conn", Bool("reused", info.Reused), Bool("was_idle", info.WasIdle))
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			s.AddEvent("dns_start")
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			s.AddEvent("dns_done", Bool("coalesced", info.Coalesced))
+		},
+		ConnectStart: func(network, addr string) {
+			s.AddEvent("connect_start", String("network.peer.address", addr))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				s.AddEvent("connect_done", String("error", err.Error()))
+				return
+			}
+			s.AddEvent("connect_done")
+		},
+		TLSHandshakeStart: func() {
+			s.AddEvent("tls_start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				s.AddEvent("tls_done", String("error", err.Error()))
+				return
+			}
+			s.AddEvent("tls_done", Bool("resumed", state.DidResume))
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			s.AddEvent("wrote_request")
+		},
+		GotFirstResponseByte: func() {
+			s.AddEvent("first_response_byte")
+		},
+	}
+}
@@ -0,0 +1,239 @@
+// Package tracing is a minimal OpenTelemetry-compatible tracer: W3C trace
+// context propagation, spans with attributes and events, and batched export
+// to an OTLP/HTTP (JSON) collector. Tracing is off until Init is called with
+// an endpoint; until then Start returns a nil *Span, whose methods are no-ops.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind mirrors the OTLP span kind enum.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are non-zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Attr is a span or event attribute.
+type Attr struct {
+	Key   string
+	Value interface{} // string, int64, float64 or bool
+}
+
+func String(key, value string) Attr          { return Attr{key, value} }
+func Int(key string, value int) Attr         { return Attr{key, int64(value)} }
+func Int64(key string, value int64) Attr     { return Attr{key, value} }
+func Float64(key string, value float64) Attr { return Attr{key, value} }
+func Bool(key string, value bool) Attr       { return Attr{key, value} }
+
+type event struct {
+	name  string
+	time  time.Time
+	attrs []Attr
+}
+
+// Span is one timed operation. All methods are safe on a nil receiver.
+type Span struct {
+	mu       sync.Mutex
+	name     string
+	kind     SpanKind
+	sc       SpanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    []Attr
+	events   []event
+	errMsg   string
+	failed   bool
+	ended    bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+var (
+	enabledMu sync.RWMutex
+	enabled   bool
+)
+
+// Enabled reports whether spans are being recorded.
+func Enabled() bool {
+	enabledMu.RLock()
+	defer enabledMu.RUnlock()
+	return enabled
+}
+
+// Start starts an internal span as a child of the span (or remote parent) in ctx.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	return StartWithKind(ctx, KindInternal, name, attrs...)
+}
+
+// StartWithKind starts a span of the given kind. It returns ctx unchanged and
+// a nil span when tracing is disabled.
+func StartWithKind(ctx context.Context, kind SpanKind, name string, attrs ...Attr) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.sc.TraceID = parent.sc.TraceID
+		s.sc.Sampled = parent.sc.Sampled
+		s.parentID = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		s.sc.TraceID = remote.TraceID
+		s.sc.Sampled = remote.Sampled
+		s.parentID = remote.SpanID
+	} else {
+		_, _ = rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	_, _ = rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SpanFromContext returns the current span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Extract returns ctx carrying the remote parent from a traceparent header, if valid.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get("traceparent")); ok {
+		return context.WithValue(ctx, remoteKey{}, sc)
+	}
+	return ctx
+}
+
+// SpanContext returns the span's identifiers.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes adds or overwrites attributes.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attrs {
+		replaced := false
+		for i := range s.attrs {
+			if s.attrs[i].Key == a.Key {
+				s.attrs[i] = a
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.attrs = append(s.attrs, a)
+		}
+	}
+}
+
+// AddEvent records a timestamped event on the span.
+func (s *Span) AddEvent(name string, attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, event{name: name, time: time.Now(), attrs: attrs})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = true
+	s.errMsg = msg
+	s.mu.Unlock()
+}
+
+// RecordError records err as an exception event and marks the span as failed.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.AddEvent("exception", String("exception.message", err.Error()))
+	s.SetError(err.Error())
+}
+
+// End finishes the span and queues it for export. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		enqueue(s)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+
+package main
+
+import "syscall"
+
+// withUmask runs fn with the process umask set to mask. The umask is
+// process-wide, so fn should be short.
+func withUmask(mask int, fn func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}